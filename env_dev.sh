@@ -4,6 +4,13 @@ export AWS_SECRET_ACCESS_KEY="YOUR_AWS_ACCESS_KEY"
 export GOOGLE_OAUTH_CLIENT_ID="YOUR_GOOGLE_CLIENT_ID"
 export GOOGLE_OAUTH_CLIENT_SECRET="YOUR_GOOGLE_CLIENT_SECRET"
 export GOOGLE_OAUTH_REDIRECT_URL="YOUR_GOOGLE_REDIRECT_URL"
+export GITHUB_OAUTH_CLIENT_ID="YOUR_GITHUB_CLIENT_ID"
+export GITHUB_OAUTH_CLIENT_SECRET="YOUR_GITHUB_CLIENT_SECRET"
+export GITHUB_OAUTH_REDIRECT_URL="YOUR_GITHUB_REDIRECT_URL"
+export SMTP_HOST="YOUR_SMTP_HOST"
+export SMTP_USERNAME="YOUR_SMTP_USERNAME"
+export SMTP_PASSWORD="YOUR_SMTP_PASSWORD"
+export SMTP_FROM="YOUR_SMTP_FROM_ADDRESS"
 export GIN_MODE=debug
 
 echo "Variables are set."
\ No newline at end of file
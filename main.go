@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
 	"time"
 
 	"github.com/akyoto/cache"
 	"github.com/aws/aws-sdk-go/aws/session"
+	dbSchema "github.com/bazuker/backend-bootstrap/pkg/db"
 	"github.com/bazuker/backend-bootstrap/pkg/db/dynamodb"
 	"github.com/bazuker/backend-bootstrap/pkg/filestore/s3"
+	"github.com/bazuker/backend-bootstrap/pkg/mailer/smtp"
 	"github.com/bazuker/backend-bootstrap/pkg/manager"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/auth"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/orgs"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/users"
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
 func main() {
@@ -22,21 +30,107 @@ func main() {
 		export GOOGLE_OAUTH_CLIENT_ID=""
 		export GOOGLE_OAUTH_CLIENT_SECRET=""
 		export GOOGLE_OAUTH_REDIRECT_URL=""
+		Any other OpenID Connect provider can be configured the same way, e.g.
+		export OKTA_OAUTH_ISSUER_URL=""
+		export OKTA_OAUTH_CLIENT_ID=""
+		export OKTA_OAUTH_CLIENT_SECRET=""
+		export OKTA_OAUTH_REDIRECT_URL=""
+		export GITHUB_OAUTH_CLIENT_ID=""
+		export GITHUB_OAUTH_CLIENT_SECRET=""
+		export GITHUB_OAUTH_REDIRECT_URL=""
+		export SMTP_HOST=""
+		export SMTP_USERNAME=""
+		export SMTP_PASSWORD=""
+		export SMTP_FROM=""
 	*/
 
+	// Initialize the authentication providers.
+	google, err := auth.NewOIDCProvider(context.Background(), auth.OIDCConfigFromEnv("google"))
+	if err != nil {
+		log.Fatalln("failed to initialize google auth provider:", err)
+	}
+	github := auth.NewGitHubProvider(auth.GitHubConfigFromEnv())
+	authProviders := auth.NewProviders(google, github)
+
 	// Initialize AWS stuff.
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 	db := dynamodb.New(dynamodb.Config{
-		AWSSession:     sess,
-		UsersTableName: "backend-bootstrap-users",
+		AWSSession:                   sess,
+		UsersTableName:               "backend-bootstrap-users",
+		RoleAssignmentsTableName:     "backend-bootstrap-role-assignments",
+		UserIdentitiesTableName:      "backend-bootstrap-user-identities",
+		PasswordCredentialsTableName: "backend-bootstrap-password-credentials",
+		TokensTableName:              "backend-bootstrap-tokens",
+		TOTPCredentialsTableName:     "backend-bootstrap-totp-credentials",
+		WebAuthnCredentialsTableName: "backend-bootstrap-webauthn-credentials",
+		APIKeysTableName:             "backend-bootstrap-api-keys",
+		AuditLogTableName:            "backend-bootstrap-audit-log",
+		OrganizationsTableName:       "backend-bootstrap-organizations",
+		OrganizationMembersTableName: "backend-bootstrap-organization-members",
+		InvitationsTableName:         "backend-bootstrap-invitations",
+		FilesTableName:               "backend-bootstrap-files",
 	})
+	// Normalize the emails of the users created before the emails were normalized.
+	// The migration can be removed once it has run.
+	if err = db.NormalizeUserEmails(); err != nil {
+		log.Println("failed to normalize user emails:", err)
+	}
 	fs := s3.New(s3.Config{
 		AWSSession: sess,
 		Bucket:     "backend-bootstrap-storage",
 	})
 
+	// Initialize the mailer.
+	mail := smtp.New(smtp.Config{
+		Host:     os.Getenv("SMTP_HOST"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	})
+	emailConfig := auth.EmailConfig{
+		VerifyEmailURL:   "https://example.com/verify-email",
+		ResetPasswordURL: "https://example.com/reset-password",
+		MagicLinkURL:     "https://example.com/api/v1/auth/magic-link/callback",
+	}
+	accountDeletionConfig := users.AccountDeletionConfig{
+		// The frontend page cancels the deletion of the account with the token.
+		RestoreAccountURL: "https://example.com/restore-account",
+	}
+	invitationConfig := orgs.InvitationConfig{
+		// The frontend page signs the user in and accepts the invitation with the token.
+		URL: "https://example.com/invitations",
+	}
+	redirectConfig := auth.RedirectConfig{
+		// Users can only be redirected back to the frontend after authentication.
+		AllowedOrigins: []string{"https://example.com"},
+		TokenDelivery:  auth.TokenDeliveryFragment,
+	}
+	sessionCookieConfig := auth.SessionCookieConfig{
+		// The frontend keeps the session in an HttpOnly cookie.
+		Enabled: true,
+		Domain:  "example.com",
+	}
+	profileSyncConfig := auth.ProfileSyncConfig{
+		// Keep the names, the locale and the photo up to date with the providers.
+		Enabled: true,
+		Photo:   true,
+	}
+	twoFactorConfig := auth.TwoFactorConfig{
+		Issuer: "Backend Bootstrap",
+		// Admins must use two-factor authentication.
+		RequiredAccessLevels: []string{dbSchema.AccessLevelAdmin},
+	}
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "Backend Bootstrap",
+		RPID:          "example.com",
+		RPOrigins:     []string{"https://example.com"},
+	})
+	if err != nil {
+		log.Fatalln("failed to initialize webauthn:", err)
+	}
+
 	// Initialize the manager.
 	m := manager.New(manager.Config{
 		ServerAddress:             ":9999",
@@ -44,6 +138,16 @@ func main() {
 		Cache:                     cache.New(time.Minute * 5),
 		DB:                        db,
 		FileStore:                 fs,
+		AuthProviders:             authProviders,
+		Mailer:                    mail,
+		Email:                     emailConfig,
+		AccountDeletion:           accountDeletionConfig,
+		Invitations:               invitationConfig,
+		Redirect:                  redirectConfig,
+		SessionCookie:             sessionCookieConfig,
+		ProfileSync:               profileSyncConfig,
+		TwoFactor:                 twoFactorConfig,
+		WebAuthn:                  webAuthn,
 	})
 
 	/*
@@ -51,7 +155,8 @@ func main() {
 		// No problemo!
 		// import localFS "github.com/bazuker/backend-bootstrap/pkg/filestore/local"
 		// import localDB "github.com/bazuker/backend-bootstrap/pkg/db/local"
-		// Initialize the local database and file storage.
+		// import localMailer "github.com/bazuker/backend-bootstrap/pkg/mailer/local"
+		// Initialize the local database, file storage and mailer.
 		db, err := localDB.New(localDB.Config{
 			// The directory must already exist. Only the file will be created.
 			Filename: "localdata/database.json",
@@ -64,6 +169,10 @@ func main() {
 			// The directory must already exist.
 			Directory: "localdata/",
 		})
+		mail := localMailer.New(localMailer.Config{
+			// The directory must already exist. Leave it empty to write emails to the log.
+			Directory: "localdata/",
+		})
 		// Initialize the manager.
 		m := manager.New(manager.Config{
 			ServerAddress:             ":9999",
@@ -71,6 +180,16 @@ func main() {
 			Cache:                     cache.New(time.Minute * 5),
 			DB:                        db,
 			FileStore:                 fs,
+			AuthProviders:             authProviders,
+			Mailer:                    mail,
+			Email:                     emailConfig,
+			AccountDeletion:           accountDeletionConfig,
+			Invitations:               invitationConfig,
+			Redirect:                  redirectConfig,
+			SessionCookie:             sessionCookieConfig,
+			ProfileSync:               profileSyncConfig,
+			TwoFactor:                 twoFactorConfig,
+			WebAuthn:                  webAuthn,
 		})
 	*/
 
@@ -1,12 +1,134 @@
 package db
 
+import "time"
+
 type Adapter interface {
-	// CreateUser creates a new user.
+	// CreateUser creates a new user. The email is normalized with NormalizeEmail.
 	CreateUser(user *User) error
+	// UpdateUser updates the fields of the user that are set in the update and returns the updated user.
+	UpdateUser(userID string, update UserUpdate) (User, error)
 	// UpdateUserPhotoURL updates user's photo URL.
 	UpdateUserPhotoURL(userID, photoURL string) error
+	// UpdateUserVerifiedEmail updates whether user's email is verified.
+	UpdateUserVerifiedEmail(userID string, verifiedEmail bool) error
+	// UpdateUserAccessLevel updates user's access level.
+	UpdateUserAccessLevel(userID, accessLevel string) error
+	// UpdateUserStatus updates user's status.
+	UpdateUserStatus(userID, status string) error
+	// DeleteUser deletes the user along with the role assignments, identities, credentials, API keys,
+	// memberships in organizations and the metadata of the files.
+	// The objects of the files must be deleted from the file store separately.
+	// Single-use tokens are not deleted as they expire on their own.
+	// The user is deleted last, so that a failed deletion can be retried.
+	DeleteUser(ID string) error
+	// GetUsersToErase finds the deleted users whose erasure is scheduled before the time.
+	GetUsersToErase(before time.Time) ([]User, error)
+	// EraseUser deletes the user the same way as DeleteUser and anonymizes the audit log entries
+	// of the user and of the actions performed by the user.
+	EraseUser(ID string) error
 	// GetUserByID finds a user by user ID.
 	GetUserByID(ID string) (User, error)
-	// GetUserByEmail finds a user by user email.
+	// GetUserByEmail finds a user by user email normalized with NormalizeEmail.
 	GetUserByEmail(email string) (User, error)
+	// GetUserRoles finds the names of the roles assigned to the user.
+	GetUserRoles(userID string) ([]string, error)
+	// AssignUserRole assigns the role to the user.
+	AssignUserRole(userID, role string) error
+	// UnassignUserRole removes the role from the user.
+	UnassignUserRole(userID, role string) error
+	// CreateUserIdentity links the identity to the user.
+	// Returns ErrAlreadyExists if the identity is already linked to a user.
+	CreateUserIdentity(identity *UserIdentity) error
+	// GetUserIdentity finds the identity by provider and subject.
+	GetUserIdentity(provider, subject string) (UserIdentity, error)
+	// GetUserIdentities finds all identities of the user.
+	GetUserIdentities(userID string) ([]UserIdentity, error)
+	// DeleteUserIdentity unlinks the identity from the user.
+	DeleteUserIdentity(userID, ID string) error
+	// CreateFile creates the metadata of a new file and adds its size to the storage used by the owner.
+	// Returns ErrQuotaExceeded if the storage used would exceed the quota.
+	CreateFile(file *File, quota int64) error
+	// GetFile finds the file of the user.
+	GetFile(userID, ID string) (File, error)
+	// GetFiles finds a page of the files of the user, from the oldest to the newest, starting at the cursor.
+	// An empty cursor starts at the first page. The cursor of the next page is empty on the last page.
+	// Returns ErrInvalidCursor if the cursor is not returned by a previous call.
+	GetFiles(userID string, limit int, cursor string) ([]File, string, error)
+	// DeleteFile deletes the metadata of the file of the user and subtracts its size from the storage used.
+	// The storage used never goes below zero.
+	DeleteFile(userID, ID string) error
+	// RecomputeStorageUsed sums the sizes of the files of the user, stores it as the storage used,
+	// sets StorageTracked and returns the updated user.
+	RecomputeStorageUsed(userID string) (User, error)
+	// CreateOrganization creates a new organization.
+	CreateOrganization(org *Organization) error
+	// UpdateOrganizationName updates the name of the organization and returns the updated organization.
+	UpdateOrganizationName(ID, name string) (Organization, error)
+	// DeleteOrganization deletes the organization along with the memberships and invitations.
+	DeleteOrganization(ID string) error
+	// GetOrganization finds an organization by ID.
+	GetOrganization(ID string) (Organization, error)
+	// PutOrganizationMember creates or overwrites the membership of the user in the organization.
+	PutOrganizationMember(member *OrganizationMember) error
+	// GetOrganizationMember finds the membership of the user in the organization.
+	GetOrganizationMember(orgID, userID string) (OrganizationMember, error)
+	// GetOrganizationMembers finds all members of the organization.
+	GetOrganizationMembers(orgID string) ([]OrganizationMember, error)
+	// GetUserMemberships finds all memberships of the user in organizations.
+	GetUserMemberships(userID string) ([]OrganizationMember, error)
+	// DeleteOrganizationMember removes the user from the organization.
+	DeleteOrganizationMember(orgID, userID string) error
+	// CreateInvitation creates a new invitation to an organization.
+	CreateInvitation(invitation *Invitation) error
+	// GetInvitation finds an invitation by ID.
+	GetInvitation(ID string) (Invitation, error)
+	// GetInvitationByTokenHash finds an invitation by the hash of the token.
+	GetInvitationByTokenHash(hash string) (Invitation, error)
+	// GetOrganizationInvitations finds all invitations to the organization.
+	GetOrganizationInvitations(orgID string) ([]Invitation, error)
+	// GetInvitationsByEmail finds all invitations of the email.
+	GetInvitationsByEmail(email string) ([]Invitation, error)
+	// UpdateInvitationToken replaces the token of the invitation and extends its expiration.
+	UpdateInvitationToken(ID, tokenHash, invitedBy string, expiresAt time.Time) error
+	// DeleteInvitation deletes the invitation.
+	// Returns ErrNotFound if it is already deleted, so an invitation is only accepted once.
+	DeleteInvitation(ID string) error
+	// PutPasswordCredential creates or overwrites user's password credential.
+	PutPasswordCredential(credential *PasswordCredential) error
+	// GetPasswordCredential finds user's password credential.
+	GetPasswordCredential(userID string) (PasswordCredential, error)
+	// PutTOTPCredential creates or overwrites user's TOTP credential.
+	PutTOTPCredential(credential *TOTPCredential) error
+	// GetTOTPCredential finds user's TOTP credential.
+	GetTOTPCredential(userID string) (TOTPCredential, error)
+	// DeleteTOTPCredential deletes user's TOTP credential.
+	DeleteTOTPCredential(userID string) error
+	// CreateWebAuthnCredential creates a new WebAuthn credential.
+	CreateWebAuthnCredential(credential *WebAuthnCredential) error
+	// GetWebAuthnCredentials finds all WebAuthn credentials of the user.
+	GetWebAuthnCredentials(userID string) ([]WebAuthnCredential, error)
+	// UpdateWebAuthnCredentialUsage updates the signature counter and the last usage time of the credential.
+	UpdateWebAuthnCredentialUsage(ID string, signCount uint32, lastUsedAt time.Time) error
+	// DeleteWebAuthnCredential deletes the WebAuthn credential of the user.
+	DeleteWebAuthnCredential(userID, ID string) error
+	// CreateAPIKey creates a new API key.
+	CreateAPIKey(key *APIKey) error
+	// GetAPIKeys finds all API keys of the user.
+	GetAPIKeys(userID string) ([]APIKey, error)
+	// GetAPIKeyByHash finds an API key by the hash of the key.
+	GetAPIKeyByHash(hash string) (APIKey, error)
+	// UpdateAPIKeyLastUsedAt updates the last usage time of the API key.
+	UpdateAPIKeyLastUsedAt(ID string, lastUsedAt time.Time) error
+	// DeleteAPIKey deletes the API key of the user.
+	DeleteAPIKey(userID, ID string) error
+	// CreateAuditEntry creates a new audit log entry.
+	CreateAuditEntry(entry *AuditEntry) error
+	// GetAuditEntries finds all audit log entries of the user.
+	GetAuditEntries(userID string) ([]AuditEntry, error)
+	// CreateToken creates a new single-use token.
+	CreateToken(token *Token) error
+	// GetToken finds the token by hash and purpose without deleting it.
+	GetToken(purpose, hash string) (Token, error)
+	// ConsumeToken finds the token by hash and purpose and deletes it.
+	ConsumeToken(purpose, hash string) (Token, error)
 }
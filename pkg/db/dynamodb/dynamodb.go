@@ -1,8 +1,13 @@
 package dynamodb
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -19,8 +24,20 @@ type DB struct {
 }
 
 type Config struct {
-	AWSSession     *session.Session
-	UsersTableName string
+	AWSSession                   *session.Session
+	UsersTableName               string
+	RoleAssignmentsTableName     string
+	UserIdentitiesTableName      string
+	PasswordCredentialsTableName string
+	TokensTableName              string
+	TOTPCredentialsTableName     string
+	WebAuthnCredentialsTableName string
+	APIKeysTableName             string
+	AuditLogTableName            string
+	OrganizationsTableName       string
+	OrganizationMembersTableName string
+	InvitationsTableName         string
+	FilesTableName               string
 }
 
 func New(cfg Config) *DB {
@@ -36,6 +53,7 @@ func New(cfg Config) *DB {
 }
 
 func (d DB) CreateUser(user *db.User) error {
+	user.Email = db.NormalizeEmail(user.Email)
 	av, err := dynamodbattribute.MarshalMap(user)
 	if err != nil {
 		return err
@@ -50,6 +68,110 @@ func (d DB) CreateUser(user *db.User) error {
 	return err
 }
 
+func (d DB) UpdateUser(userID string, update db.UserUpdate) (db.User, error) {
+	if userID == "" {
+		return db.User{}, errors.New("missing user ID")
+	}
+
+	expression := userUpdateExpression{
+		names:  map[string]*string{},
+		values: map[string]*dynamodb.AttributeValue{},
+	}
+	if update.FirstName != nil {
+		expression.set("firstName", *update.FirstName)
+	}
+	if update.LastName != nil {
+		expression.set("lastName", *update.LastName)
+	}
+	if update.Phone != nil {
+		expression.set("phone", *update.Phone)
+	}
+	if update.DOB != nil {
+		if update.DOB.IsZero() {
+			expression.set("dob", nil)
+		} else {
+			expression.set("dob", *update.DOB)
+		}
+	}
+	if update.Locale != nil {
+		expression.set("locale", *update.Locale)
+	}
+	if update.PhotoURL != nil {
+		expression.set("photoURL", *update.PhotoURL)
+	}
+	if update.PhotoSourceURL != nil {
+		expression.set("photoSourceURL", *update.PhotoSourceURL)
+	}
+	if update.EditedFields != nil {
+		expression.set("editedFields", *update.EditedFields)
+	}
+	if update.ErasureAt != nil {
+		if update.ErasureAt.IsZero() {
+			expression.set("erasureAt", nil)
+		} else {
+			expression.set("erasureAt", *update.ErasureAt)
+		}
+	}
+	if update.StorageQuota != nil {
+		expression.set("storageQuota", *update.StorageQuota)
+	}
+	if expression.err != nil {
+		return db.User{}, expression.err
+	}
+	if len(expression.sets) == 0 {
+		return d.GetUserByID(userID)
+	}
+
+	result, err := d.db.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeNames:  expression.names,
+		ExpressionAttributeValues: expression.values,
+		TableName:                 aws.String(d.cfg.UsersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(userID),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		UpdateExpression:    aws.String("set " + strings.Join(expression.sets, ", ")),
+		ReturnValues:        aws.String("ALL_NEW"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.User{}, db.ErrNotFound
+		}
+		return db.User{}, fmt.Errorf("failed to update user: %w", err)
+	}
+
+	var u db.User
+	err = dynamodbattribute.UnmarshalMap(result.Attributes, &u)
+	if err != nil {
+		return db.User{}, fmt.Errorf("failed to unmarshal user: %w", err)
+	}
+	return u, nil
+}
+
+// userUpdateExpression builds the update expression of the fields of a partial update.
+// The names are aliased, so that the fields cannot collide with the reserved words.
+type userUpdateExpression struct {
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+	sets   []string
+	err    error
+}
+
+func (e *userUpdateExpression) set(field string, value interface{}) {
+	av, err := dynamodbattribute.Marshal(value)
+	if err != nil {
+		e.err = fmt.Errorf("failed to marshal '%s': %w", field, err)
+		return
+	}
+	key := strconv.Itoa(len(e.sets))
+	e.names["#f"+key] = aws.String(field)
+	e.values[":v"+key] = av
+	e.sets = append(e.sets, "#f"+key+" = :v"+key)
+}
+
 func (d DB) UpdateUserPhotoURL(userID, photoURL string) error {
 	_, err := d.db.UpdateItem(&dynamodb.UpdateItemInput{
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
@@ -69,6 +191,266 @@ func (d DB) UpdateUserPhotoURL(userID, photoURL string) error {
 	return err
 }
 
+func (d DB) UpdateUserVerifiedEmail(userID string, verifiedEmail bool) error {
+	_, err := d.db.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v": {
+				BOOL: aws.Bool(verifiedEmail),
+			},
+		},
+		TableName: aws.String(d.cfg.UsersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(userID),
+			},
+		},
+		UpdateExpression: aws.String("set verifiedEmail = :v"),
+		ReturnValues:     aws.String("NONE"),
+	})
+	return err
+}
+
+func (d DB) UpdateUserAccessLevel(userID, accessLevel string) error {
+	_, err := d.db.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":a": {
+				S: aws.String(accessLevel),
+			},
+		},
+		TableName: aws.String(d.cfg.UsersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(userID),
+			},
+		},
+		UpdateExpression: aws.String("set accessLevel = :a"),
+		ReturnValues:     aws.String("NONE"),
+	})
+	return err
+}
+
+func (d DB) UpdateUserStatus(userID, status string) error {
+	_, err := d.db.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":s": {
+				S: aws.String(status),
+			},
+		},
+		// 'status' is a reserved word.
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("status"),
+		},
+		TableName: aws.String(d.cfg.UsersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(userID),
+			},
+		},
+		UpdateExpression: aws.String("set #s = :s"),
+		ReturnValues:     aws.String("NONE"),
+	})
+	return err
+}
+
+func (d DB) DeleteUser(id string) error {
+	if id == "" {
+		return errors.New("missing ID")
+	}
+
+	// The user is deleted last, so that the deletion is retried if any of the dependents fail to be deleted.
+	if _, err := d.GetUserByID(id); err != nil {
+		return err
+	}
+
+	roles, err := d.GetUserRoles(id)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if err = d.UnassignUserRole(id, role); err != nil && err != db.ErrNotFound {
+			return fmt.Errorf("failed to delete role assignment: %w", err)
+		}
+	}
+
+	identities, err := d.GetUserIdentities(id)
+	if err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		if err = d.DeleteUserIdentity(id, identity.ID); err != nil && err != db.ErrNotFound {
+			return fmt.Errorf("failed to delete identity: %w", err)
+		}
+	}
+
+	for _, tableName := range []string{d.cfg.PasswordCredentialsTableName, d.cfg.TOTPCredentialsTableName} {
+		_, err = d.db.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(tableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"userID": {
+					S: aws.String(id),
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete credential from '%s': %w", tableName, err)
+		}
+	}
+
+	webAuthnCredentials, err := d.GetWebAuthnCredentials(id)
+	if err != nil {
+		return err
+	}
+	for _, credential := range webAuthnCredentials {
+		if err = d.DeleteWebAuthnCredential(id, credential.ID); err != nil && err != db.ErrNotFound {
+			return fmt.Errorf("failed to delete WebAuthn credential: %w", err)
+		}
+	}
+
+	keys, err := d.GetAPIKeys(id)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = d.DeleteAPIKey(id, key.ID); err != nil && err != db.ErrNotFound {
+			return fmt.Errorf("failed to delete API key: %w", err)
+		}
+	}
+
+	memberships, err := d.GetUserMemberships(id)
+	if err != nil {
+		return err
+	}
+	for _, membership := range memberships {
+		if err = d.DeleteOrganizationMember(membership.OrgID, id); err != nil && err != db.ErrNotFound {
+			return fmt.Errorf("failed to delete organization membership: %w", err)
+		}
+	}
+
+	files, err := d.allFiles(id)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		// The user is deleted next, so the storage used is not updated.
+		_, err = d.db.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(d.cfg.FilesTableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"id": {
+					S: aws.String(file.ID),
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+	}
+
+	_, err = d.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.cfg.UsersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrNotFound
+		}
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	return nil
+}
+
+func (d DB) GetUsersToErase(before time.Time) ([]db.User, error) {
+	beforeAV, err := dynamodbattribute.Marshal(before.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	// The erasure runs in the background, so a scan of the deleted users is acceptable.
+	users := []db.User{}
+	var unmarshalErr error
+	err = d.db.ScanPages(&dynamodb.ScanInput{
+		TableName:        aws.String(d.cfg.UsersTableName),
+		FilterExpression: aws.String("#s = :s AND erasureAt < :b"),
+		// 'status' is a reserved word.
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":s": {
+				S: aws.String(db.UserStatusDeleted),
+			},
+			":b": beforeAV,
+		},
+	}, func(page *dynamodb.ScanOutput, _ bool) bool {
+		var pageUsers []db.User
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageUsers); unmarshalErr != nil {
+			return false
+		}
+		users = append(users, pageUsers...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users to erase: %w", err)
+	}
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal users: %w", unmarshalErr)
+	}
+	return users, nil
+}
+
+// EraseUser anonymizes the audit log before the user is deleted,
+// so that the erasure is retried if the anonymization fails.
+func (d DB) EraseUser(id string) error {
+	entries, err := d.GetAuditEntries(id)
+	if err != nil {
+		return err
+	}
+	// There is no index of the actors, as the entries are only looked up by actors here.
+	var actorEntries []db.AuditEntry
+	var unmarshalErr error
+	err = d.db.ScanPages(&dynamodb.ScanInput{
+		TableName:        aws.String(d.cfg.AuditLogTableName),
+		FilterExpression: aws.String("actorID = :a"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":a": {
+				S: aws.String(id),
+			},
+		},
+	}, func(page *dynamodb.ScanOutput, _ bool) bool {
+		var pageEntries []db.AuditEntry
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageEntries); unmarshalErr != nil {
+			return false
+		}
+		actorEntries = append(actorEntries, pageEntries...)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get audit entries of actor: %w", err)
+	}
+	if unmarshalErr != nil {
+		return fmt.Errorf("failed to unmarshal audit entries: %w", unmarshalErr)
+	}
+
+	for _, entry := range append(entries, actorEntries...) {
+		entry.IPAddress = ""
+		if entry.UserID == id {
+			entry.UserID = db.ErasedUserID
+		}
+		if entry.ActorID == id {
+			entry.ActorID = db.ErasedUserID
+		}
+		if err = d.CreateAuditEntry(&entry); err != nil {
+			return fmt.Errorf("failed to anonymize audit entry '%s': %w", entry.ID, err)
+		}
+	}
+	return d.DeleteUser(id)
+}
+
 func (d DB) GetUserByID(id string) (db.User, error) {
 	if id == "" {
 		return db.User{}, errors.New("missing ID")
@@ -110,7 +492,7 @@ func (d DB) GetUserByEmail(email string) (db.User, error) {
 				ComparisonOperator: aws.String("EQ"),
 				AttributeValueList: []*dynamodb.AttributeValue{
 					{
-						S: aws.String(email),
+						S: aws.String(db.NormalizeEmail(email)),
 					},
 				},
 			},
@@ -131,3 +513,1483 @@ func (d DB) GetUserByEmail(email string) (db.User, error) {
 
 	return u, nil
 }
+
+// NormalizeUserEmails is a one-off migration that normalizes the emails of the users
+// created before the emails were normalized, so that GetUserByEmail finds them.
+// The users whose normalized email belongs to another user are skipped and reported in the error.
+// It is safe to run the migration more than once.
+func (d DB) NormalizeUserEmails() error {
+	var users []db.User
+	var unmarshalErr error
+	err := d.db.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(d.cfg.UsersTableName),
+	}, func(page *dynamodb.ScanOutput, _ bool) bool {
+		var pageUsers []db.User
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageUsers); unmarshalErr != nil {
+			return false
+		}
+		users = append(users, pageUsers...)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan users: %w", err)
+	}
+	if unmarshalErr != nil {
+		return fmt.Errorf("failed to unmarshal users: %w", unmarshalErr)
+	}
+
+	var conflicts []string
+	for _, user := range users {
+		email := db.NormalizeEmail(user.Email)
+		if email == user.Email {
+			continue
+		}
+		other, err := d.GetUserByEmail(email)
+		if err == nil && other.ID != user.ID {
+			conflicts = append(conflicts, user.ID)
+			continue
+		}
+		if err != nil && err != db.ErrNotFound {
+			return err
+		}
+
+		_, err = d.db.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName: aws.String(d.cfg.UsersTableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"id": {
+					S: aws.String(user.ID),
+				},
+			},
+			ConditionExpression: aws.String("email = :o"),
+			UpdateExpression:    aws.String("set email = :e"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":o": {
+					S: aws.String(user.Email),
+				},
+				":e": {
+					S: aws.String(email),
+				},
+			},
+		})
+		if err != nil {
+			var conditionErr *dynamodb.ConditionalCheckFailedException
+			if errors.As(err, &conditionErr) {
+				// The user has been deleted or updated in the meantime.
+				continue
+			}
+			return fmt.Errorf("failed to normalize email of user '%s': %w", user.ID, err)
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("emails of users %s conflict with other users", strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+func (d DB) GetUserRoles(userID string) ([]string, error) {
+	if userID == "" {
+		return nil, errors.New("missing user ID")
+	}
+
+	result, err := d.db.Query(&dynamodb.QueryInput{
+		TableName: aws.String(d.cfg.RoleAssignmentsTableName),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"userID": {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(userID),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user roles: %w", err)
+	}
+
+	var assignments []db.RoleAssignment
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &assignments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal role assignments: %w", err)
+	}
+	roles := make([]string, len(assignments))
+	for i := range assignments {
+		roles[i] = assignments[i].Role
+	}
+	return roles, nil
+}
+
+func (d DB) AssignUserRole(userID, role string) error {
+	av, err := dynamodbattribute.MarshalMap(db.RoleAssignment{
+		UserID:    userID,
+		Role:      role,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(d.cfg.RoleAssignmentsTableName),
+	})
+	return err
+}
+
+func (d DB) UnassignUserRole(userID, role string) error {
+	_, err := d.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.cfg.RoleAssignmentsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"userID": {
+				S: aws.String(userID),
+			},
+			"role": {
+				S: aws.String(role),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(userID)"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (d DB) CreateUserIdentity(identity *db.UserIdentity) error {
+	av, err := dynamodbattribute.MarshalMap(identity)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(&dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(d.cfg.UserIdentitiesTableName),
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrAlreadyExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (d DB) GetUserIdentity(provider, subject string) (db.UserIdentity, error) {
+	if provider == "" || subject == "" {
+		return db.UserIdentity{}, errors.New("missing provider or subject")
+	}
+
+	result, err := d.db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(d.cfg.UserIdentitiesTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(db.UserIdentityID(provider, subject)),
+			},
+		},
+	})
+	if err != nil {
+		return db.UserIdentity{}, fmt.Errorf("failed to get identity: %w", err)
+	}
+	if result == nil || len(result.Item) == 0 {
+		return db.UserIdentity{}, db.ErrNotFound
+	}
+
+	var identity db.UserIdentity
+	err = dynamodbattribute.UnmarshalMap(result.Item, &identity)
+	if err != nil {
+		return db.UserIdentity{}, fmt.Errorf("failed to unmarshal identity: %w", err)
+	}
+	return identity, nil
+}
+
+func (d DB) GetUserIdentities(userID string) ([]db.UserIdentity, error) {
+	if userID == "" {
+		return nil, errors.New("missing user ID")
+	}
+
+	result, err := d.db.Query(&dynamodb.QueryInput{
+		TableName: aws.String(d.cfg.UserIdentitiesTableName),
+		IndexName: aws.String("userID-index"),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"userID": {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(userID),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get identities: %w", err)
+	}
+
+	identities := []db.UserIdentity{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &identities)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal identities: %w", err)
+	}
+	return identities, nil
+}
+
+func (d DB) DeleteUserIdentity(userID, id string) error {
+	_, err := d.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.cfg.UserIdentitiesTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		ConditionExpression: aws.String("userID = :u"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":u": {
+				S: aws.String(userID),
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// CreateFile puts the file and adds its size to the storage used by the owner in a transaction,
+// so that concurrent uploads cannot exceed the quota.
+func (d DB) CreateFile(file *db.File, quota int64) error {
+	// Users without any files have no storage used yet.
+	if file.Size > quota {
+		return db.ErrQuotaExceeded
+	}
+	av, err := dynamodbattribute.MarshalMap(file)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Put: &dynamodb.Put{
+					Item:                av,
+					TableName:           aws.String(d.cfg.FilesTableName),
+					ConditionExpression: aws.String("attribute_not_exists(id)"),
+				},
+			},
+			{
+				Update: d.storageUsedUpdate(file.UserID, file.Size, quota),
+			},
+		},
+	})
+	if err != nil {
+		switch failedCondition(err) {
+		case 0:
+			return db.ErrAlreadyExists
+		case 1:
+			return db.ErrQuotaExceeded
+		}
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	return nil
+}
+
+func (d DB) GetFile(userID, id string) (db.File, error) {
+	if userID == "" || id == "" {
+		return db.File{}, errors.New("missing user ID or ID")
+	}
+
+	result, err := d.db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(d.cfg.FilesTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+	})
+	if err != nil {
+		return db.File{}, fmt.Errorf("failed to get file: %w", err)
+	}
+	if result == nil || len(result.Item) == 0 {
+		return db.File{}, db.ErrNotFound
+	}
+
+	var file db.File
+	err = dynamodbattribute.UnmarshalMap(result.Item, &file)
+	if err != nil {
+		return db.File{}, fmt.Errorf("failed to unmarshal file: %w", err)
+	}
+	// Files of other users do not exist for the user.
+	if file.UserID != userID {
+		return db.File{}, db.ErrNotFound
+	}
+	return file, nil
+}
+
+// GetFiles returns the files in the order they were created.
+// The cursor is the encoded key of the last file of the page.
+func (d DB) GetFiles(userID string, limit int, cursor string) ([]db.File, string, error) {
+	if userID == "" {
+		return nil, "", errors.New("missing user ID")
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName: aws.String(d.cfg.FilesTableName),
+		IndexName: aws.String("userID-createdAt-index"),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"userID": {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(userID),
+					},
+				},
+			},
+		},
+		Limit: aws.Int64(int64(limit)),
+	}
+	if cursor != "" {
+		startKey, err := decodeCursor(cursor)
+		if err != nil || startKey["userID"] == nil || aws.StringValue(startKey["userID"].S) != userID {
+			return nil, "", db.ErrInvalidCursor
+		}
+		input.ExclusiveStartKey = startKey
+	}
+	result, err := d.db.Query(input)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get files: %w", err)
+	}
+
+	files := []db.File{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &files)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal files: %w", err)
+	}
+	if len(result.LastEvaluatedKey) == 0 {
+		return files, "", nil
+	}
+	nextCursor, err := encodeCursor(result.LastEvaluatedKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return files, nextCursor, nil
+}
+
+// allFiles finds all files of the user.
+func (d DB) allFiles(userID string) ([]db.File, error) {
+	var files []db.File
+	var unmarshalErr error
+	err := d.db.QueryPages(&dynamodb.QueryInput{
+		TableName: aws.String(d.cfg.FilesTableName),
+		IndexName: aws.String("userID-createdAt-index"),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"userID": {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(userID),
+					},
+				},
+			},
+		},
+	}, func(page *dynamodb.QueryOutput, _ bool) bool {
+		var pageFiles []db.File
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageFiles); unmarshalErr != nil {
+			return false
+		}
+		files = append(files, pageFiles...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get files: %w", err)
+	}
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal files: %w", unmarshalErr)
+	}
+	return files, nil
+}
+
+// DeleteFile deletes the file and subtracts its size from the storage used by the owner in a transaction.
+// The storage used never goes below zero.
+func (d DB) DeleteFile(userID, id string) error {
+	file, err := d.GetFile(userID, id)
+	if err != nil {
+		return err
+	}
+
+	err = d.deleteFile(file, d.storageUsedUpdate(userID, -file.Size, 0))
+	if failedCondition(err) == 1 {
+		// The storage used is less than the size of the file,
+		// e.g. the file was stored before the storage used was tracked.
+		err = d.deleteFile(file, d.storageUsedReset(userID, file.Size))
+	}
+	if err != nil {
+		if failedCondition(err) >= 0 {
+			return db.ErrNotFound
+		}
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return nil
+}
+
+// deleteFile deletes the file together with the update of the storage used by the owner in a transaction.
+func (d DB) deleteFile(file db.File, storageUsedUpdate *dynamodb.Update) error {
+	_, err := d.db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Delete: &dynamodb.Delete{
+					TableName: aws.String(d.cfg.FilesTableName),
+					Key: map[string]*dynamodb.AttributeValue{
+						"id": {
+							S: aws.String(file.ID),
+						},
+					},
+					ConditionExpression: aws.String("userID = :u"),
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":u": {
+							S: aws.String(file.UserID),
+						},
+					},
+				},
+			},
+			{
+				Update: storageUsedUpdate,
+			},
+		},
+	})
+	return err
+}
+
+// recomputeStorageUsedAttempts is how many times the storage used is recomputed
+// if the files of the user change in the meantime.
+const recomputeStorageUsedAttempts = 3
+
+// RecomputeStorageUsed sums the sizes of the files of the user and stores it as the storage used.
+// The storage used is only replaced if it has not changed since the files were listed,
+// otherwise the files are listed again.
+func (d DB) RecomputeStorageUsed(userID string) (db.User, error) {
+	for attempt := 0; attempt < recomputeStorageUsedAttempts; attempt++ {
+		user, err := d.GetUserByID(userID)
+		if err != nil {
+			return db.User{}, err
+		}
+		files, err := d.allFiles(userID)
+		if err != nil {
+			return db.User{}, err
+		}
+		var storageUsed int64
+		for _, file := range files {
+			storageUsed += file.Size
+		}
+
+		result, err := d.db.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName: aws.String(d.cfg.UsersTableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"id": {
+					S: aws.String(userID),
+				},
+			},
+			ConditionExpression: aws.String(
+				"attribute_exists(id) AND (attribute_not_exists(storageUsed) OR storageUsed = :o)",
+			),
+			UpdateExpression: aws.String("set storageUsed = :s, storageTracked = :t"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":o": {
+					N: aws.String(strconv.FormatInt(user.StorageUsed, 10)),
+				},
+				":s": {
+					N: aws.String(strconv.FormatInt(storageUsed, 10)),
+				},
+				":t": {
+					BOOL: aws.Bool(true),
+				},
+			},
+			ReturnValues: aws.String("ALL_NEW"),
+		})
+		if err != nil {
+			var conditionErr *dynamodb.ConditionalCheckFailedException
+			if errors.As(err, &conditionErr) {
+				continue
+			}
+			return db.User{}, fmt.Errorf("failed to update storage used: %w", err)
+		}
+
+		var u db.User
+		if err = dynamodbattribute.UnmarshalMap(result.Attributes, &u); err != nil {
+			return db.User{}, fmt.Errorf("failed to unmarshal user: %w", err)
+		}
+		return u, nil
+	}
+	return db.User{}, errors.New("failed to update storage used: the files keep changing")
+}
+
+// storageUsedUpdate adds the delta to the storage used by the user.
+// The storage used is only increased if it stays within the quota
+// and only decreased if it stays at or above zero.
+func (d DB) storageUsedUpdate(userID string, delta, quota int64) *dynamodb.Update {
+	update := &dynamodb.Update{
+		TableName: aws.String(d.cfg.UsersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(userID),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		UpdateExpression:    aws.String("add storageUsed :d"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":d": {
+				N: aws.String(strconv.FormatInt(delta, 10)),
+			},
+		},
+	}
+	if delta > 0 {
+		update.ConditionExpression = aws.String(
+			"attribute_exists(id) AND (attribute_not_exists(storageUsed) OR storageUsed <= :m)",
+		)
+		update.ExpressionAttributeValues[":m"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(quota-delta, 10)),
+		}
+	} else if delta < 0 {
+		update.ConditionExpression = aws.String("attribute_exists(id) AND storageUsed >= :m")
+		update.ExpressionAttributeValues[":m"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(-delta, 10)),
+		}
+	}
+	return update
+}
+
+// storageUsedReset sets the storage used by the user to zero
+// if it is less than the size that is subtracted.
+func (d DB) storageUsedReset(userID string, size int64) *dynamodb.Update {
+	return &dynamodb.Update{
+		TableName: aws.String(d.cfg.UsersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(userID),
+			},
+		},
+		ConditionExpression: aws.String(
+			"attribute_exists(id) AND (attribute_not_exists(storageUsed) OR storageUsed < :m)",
+		),
+		UpdateExpression: aws.String("set storageUsed = :z"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":m": {
+				N: aws.String(strconv.FormatInt(size, 10)),
+			},
+			":z": {
+				N: aws.String("0"),
+			},
+		},
+	}
+}
+
+// failedCondition returns the index of the item of the canceled transaction whose condition failed
+// or -1 if the transaction failed for another reason.
+func failedCondition(err error) int {
+	var canceledErr *dynamodb.TransactionCanceledException
+	if !errors.As(err, &canceledErr) {
+		return -1
+	}
+	for i, reason := range canceledErr.CancellationReasons {
+		if aws.StringValue(reason.Code) == "ConditionalCheckFailed" {
+			return i
+		}
+	}
+	return -1
+}
+
+// encodeCursor encodes the last evaluated key of a query, so it can be passed to the clients.
+func encodeCursor(key map[string]*dynamodb.AttributeValue) (string, error) {
+	var values map[string]string
+	if err := dynamodbattribute.UnmarshalMap(key, &values); err != nil {
+		return "", fmt.Errorf("failed to unmarshal cursor: %w", err)
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor decodes the exclusive start key of a query from the cursor.
+func decodeCursor(cursor string) (map[string]*dynamodb.AttributeValue, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	if err = json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return dynamodbattribute.MarshalMap(values)
+}
+
+func (d DB) CreateOrganization(org *db.Organization) error {
+	av, err := dynamodbattribute.MarshalMap(org)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(&dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(d.cfg.OrganizationsTableName),
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrAlreadyExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (d DB) UpdateOrganizationName(id, name string) (db.Organization, error) {
+	result, err := d.db.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":n": {
+				S: aws.String(name),
+			},
+		},
+		// 'name' is a reserved word.
+		ExpressionAttributeNames: map[string]*string{
+			"#n": aws.String("name"),
+		},
+		TableName: aws.String(d.cfg.OrganizationsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		UpdateExpression:    aws.String("set #n = :n"),
+		ReturnValues:        aws.String("ALL_NEW"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.Organization{}, db.ErrNotFound
+		}
+		return db.Organization{}, fmt.Errorf("failed to update organization: %w", err)
+	}
+
+	var org db.Organization
+	err = dynamodbattribute.UnmarshalMap(result.Attributes, &org)
+	if err != nil {
+		return db.Organization{}, fmt.Errorf("failed to unmarshal organization: %w", err)
+	}
+	return org, nil
+}
+
+func (d DB) DeleteOrganization(id string) error {
+	if id == "" {
+		return errors.New("missing ID")
+	}
+
+	_, err := d.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.cfg.OrganizationsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrNotFound
+		}
+		return fmt.Errorf("failed to delete organization: %w", err)
+	}
+
+	members, err := d.GetOrganizationMembers(id)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if err = d.DeleteOrganizationMember(id, member.UserID); err != nil && err != db.ErrNotFound {
+			return fmt.Errorf("failed to delete organization member: %w", err)
+		}
+	}
+
+	invitations, err := d.GetOrganizationInvitations(id)
+	if err != nil {
+		return err
+	}
+	for _, invitation := range invitations {
+		if err = d.DeleteInvitation(invitation.ID); err != nil && err != db.ErrNotFound {
+			return fmt.Errorf("failed to delete invitation: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (d DB) GetOrganization(id string) (db.Organization, error) {
+	if id == "" {
+		return db.Organization{}, errors.New("missing ID")
+	}
+
+	result, err := d.db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(d.cfg.OrganizationsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+	})
+	if err != nil {
+		return db.Organization{}, fmt.Errorf("failed to get organization: %w", err)
+	}
+	if result == nil || len(result.Item) == 0 {
+		return db.Organization{}, db.ErrNotFound
+	}
+
+	var org db.Organization
+	err = dynamodbattribute.UnmarshalMap(result.Item, &org)
+	if err != nil {
+		return db.Organization{}, fmt.Errorf("failed to unmarshal organization: %w", err)
+	}
+	return org, nil
+}
+
+func (d DB) PutOrganizationMember(member *db.OrganizationMember) error {
+	av, err := dynamodbattribute.MarshalMap(member)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(d.cfg.OrganizationMembersTableName),
+	})
+	return err
+}
+
+func (d DB) GetOrganizationMember(orgID, userID string) (db.OrganizationMember, error) {
+	if orgID == "" || userID == "" {
+		return db.OrganizationMember{}, errors.New("missing organization ID or user ID")
+	}
+
+	result, err := d.db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(d.cfg.OrganizationMembersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"orgID": {
+				S: aws.String(orgID),
+			},
+			"userID": {
+				S: aws.String(userID),
+			},
+		},
+	})
+	if err != nil {
+		return db.OrganizationMember{}, fmt.Errorf("failed to get organization member: %w", err)
+	}
+	if result == nil || len(result.Item) == 0 {
+		return db.OrganizationMember{}, db.ErrNotFound
+	}
+
+	var member db.OrganizationMember
+	err = dynamodbattribute.UnmarshalMap(result.Item, &member)
+	if err != nil {
+		return db.OrganizationMember{}, fmt.Errorf("failed to unmarshal organization member: %w", err)
+	}
+	return member, nil
+}
+
+func (d DB) GetOrganizationMembers(orgID string) ([]db.OrganizationMember, error) {
+	if orgID == "" {
+		return nil, errors.New("missing organization ID")
+	}
+
+	result, err := d.db.Query(&dynamodb.QueryInput{
+		TableName: aws.String(d.cfg.OrganizationMembersTableName),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"orgID": {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(orgID),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization members: %w", err)
+	}
+
+	members := []db.OrganizationMember{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &members)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal organization members: %w", err)
+	}
+	return members, nil
+}
+
+func (d DB) GetUserMemberships(userID string) ([]db.OrganizationMember, error) {
+	if userID == "" {
+		return nil, errors.New("missing user ID")
+	}
+
+	result, err := d.db.Query(&dynamodb.QueryInput{
+		TableName: aws.String(d.cfg.OrganizationMembersTableName),
+		IndexName: aws.String("userID-index"),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"userID": {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(userID),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memberships: %w", err)
+	}
+
+	memberships := []db.OrganizationMember{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &memberships)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal memberships: %w", err)
+	}
+	return memberships, nil
+}
+
+func (d DB) DeleteOrganizationMember(orgID, userID string) error {
+	_, err := d.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.cfg.OrganizationMembersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"orgID": {
+				S: aws.String(orgID),
+			},
+			"userID": {
+				S: aws.String(userID),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(userID)"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (d DB) CreateInvitation(invitation *db.Invitation) error {
+	av, err := dynamodbattribute.MarshalMap(invitation)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(&dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(d.cfg.InvitationsTableName),
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrAlreadyExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (d DB) GetInvitation(id string) (db.Invitation, error) {
+	if id == "" {
+		return db.Invitation{}, errors.New("missing ID")
+	}
+
+	result, err := d.db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(d.cfg.InvitationsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+	})
+	if err != nil {
+		return db.Invitation{}, fmt.Errorf("failed to get invitation: %w", err)
+	}
+	if result == nil || len(result.Item) == 0 {
+		return db.Invitation{}, db.ErrNotFound
+	}
+
+	var invitation db.Invitation
+	err = dynamodbattribute.UnmarshalMap(result.Item, &invitation)
+	if err != nil {
+		return db.Invitation{}, fmt.Errorf("failed to unmarshal invitation: %w", err)
+	}
+	return invitation, nil
+}
+
+func (d DB) GetInvitationByTokenHash(hash string) (db.Invitation, error) {
+	if hash == "" {
+		return db.Invitation{}, errors.New("missing hash")
+	}
+
+	invitations, err := d.queryInvitations("tokenHash-index", "tokenHash", hash)
+	if err != nil {
+		return db.Invitation{}, err
+	}
+	if len(invitations) == 0 {
+		return db.Invitation{}, db.ErrNotFound
+	}
+	return invitations[0], nil
+}
+
+func (d DB) GetOrganizationInvitations(orgID string) ([]db.Invitation, error) {
+	if orgID == "" {
+		return nil, errors.New("missing organization ID")
+	}
+	return d.queryInvitations("orgID-index", "orgID", orgID)
+}
+
+func (d DB) GetInvitationsByEmail(email string) ([]db.Invitation, error) {
+	if email == "" {
+		return nil, errors.New("missing email")
+	}
+	return d.queryInvitations("email-index", "email", email)
+}
+
+// queryInvitations finds the invitations by the key of the secondary index.
+func (d DB) queryInvitations(indexName, key, value string) ([]db.Invitation, error) {
+	result, err := d.db.Query(&dynamodb.QueryInput{
+		TableName: aws.String(d.cfg.InvitationsTableName),
+		IndexName: aws.String(indexName),
+		KeyConditions: map[string]*dynamodb.Condition{
+			key: {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(value),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invitations by %s: %w", key, err)
+	}
+
+	invitations := []db.Invitation{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &invitations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal invitations: %w", err)
+	}
+	return invitations, nil
+}
+
+func (d DB) UpdateInvitationToken(id, tokenHash, invitedBy string, expiresAt time.Time) error {
+	expiresAtAV, err := dynamodbattribute.Marshal(expiresAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":t": {
+				S: aws.String(tokenHash),
+			},
+			":i": {
+				S: aws.String(invitedBy),
+			},
+			":e": expiresAtAV,
+		},
+		TableName: aws.String(d.cfg.InvitationsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		UpdateExpression:    aws.String("set tokenHash = :t, invitedBy = :i, expiresAt = :e"),
+		ReturnValues:        aws.String("NONE"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (d DB) DeleteInvitation(id string) error {
+	_, err := d.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.cfg.InvitationsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (d DB) PutPasswordCredential(credential *db.PasswordCredential) error {
+	av, err := dynamodbattribute.MarshalMap(credential)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(d.cfg.PasswordCredentialsTableName),
+	})
+	return err
+}
+
+func (d DB) GetPasswordCredential(userID string) (db.PasswordCredential, error) {
+	if userID == "" {
+		return db.PasswordCredential{}, errors.New("missing user ID")
+	}
+
+	result, err := d.db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(d.cfg.PasswordCredentialsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"userID": {
+				S: aws.String(userID),
+			},
+		},
+	})
+	if err != nil {
+		return db.PasswordCredential{}, fmt.Errorf("failed to get password credential: %w", err)
+	}
+	if result == nil || len(result.Item) == 0 {
+		return db.PasswordCredential{}, db.ErrNotFound
+	}
+
+	var credential db.PasswordCredential
+	err = dynamodbattribute.UnmarshalMap(result.Item, &credential)
+	if err != nil {
+		return db.PasswordCredential{}, fmt.Errorf("failed to unmarshal password credential: %w", err)
+	}
+	return credential, nil
+}
+
+func (d DB) PutTOTPCredential(credential *db.TOTPCredential) error {
+	av, err := dynamodbattribute.MarshalMap(credential)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(d.cfg.TOTPCredentialsTableName),
+	})
+	return err
+}
+
+func (d DB) GetTOTPCredential(userID string) (db.TOTPCredential, error) {
+	if userID == "" {
+		return db.TOTPCredential{}, errors.New("missing user ID")
+	}
+
+	result, err := d.db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(d.cfg.TOTPCredentialsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"userID": {
+				S: aws.String(userID),
+			},
+		},
+	})
+	if err != nil {
+		return db.TOTPCredential{}, fmt.Errorf("failed to get TOTP credential: %w", err)
+	}
+	if result == nil || len(result.Item) == 0 {
+		return db.TOTPCredential{}, db.ErrNotFound
+	}
+
+	var credential db.TOTPCredential
+	err = dynamodbattribute.UnmarshalMap(result.Item, &credential)
+	if err != nil {
+		return db.TOTPCredential{}, fmt.Errorf("failed to unmarshal TOTP credential: %w", err)
+	}
+	return credential, nil
+}
+
+func (d DB) DeleteTOTPCredential(userID string) error {
+	_, err := d.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.cfg.TOTPCredentialsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"userID": {
+				S: aws.String(userID),
+			},
+		},
+	})
+	return err
+}
+
+func (d DB) CreateWebAuthnCredential(credential *db.WebAuthnCredential) error {
+	av, err := dynamodbattribute.MarshalMap(credential)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(d.cfg.WebAuthnCredentialsTableName),
+		// Credential IDs must be unique across all users.
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	return err
+}
+
+func (d DB) GetWebAuthnCredentials(userID string) ([]db.WebAuthnCredential, error) {
+	if userID == "" {
+		return nil, errors.New("missing user ID")
+	}
+
+	result, err := d.db.Query(&dynamodb.QueryInput{
+		TableName: aws.String(d.cfg.WebAuthnCredentialsTableName),
+		IndexName: aws.String("userID-index"),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"userID": {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(userID),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get WebAuthn credentials: %w", err)
+	}
+
+	credentials := []db.WebAuthnCredential{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal WebAuthn credentials: %w", err)
+	}
+	return credentials, nil
+}
+
+func (d DB) UpdateWebAuthnCredentialUsage(id string, signCount uint32, lastUsedAt time.Time) error {
+	lastUsedAtAV, err := dynamodbattribute.Marshal(lastUsedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":s": {
+				N: aws.String(strconv.FormatUint(uint64(signCount), 10)),
+			},
+			":l": lastUsedAtAV,
+		},
+		TableName: aws.String(d.cfg.WebAuthnCredentialsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		UpdateExpression: aws.String("set signCount = :s, lastUsedAt = :l"),
+		ReturnValues:     aws.String("NONE"),
+	})
+	return err
+}
+
+func (d DB) DeleteWebAuthnCredential(userID, id string) error {
+	_, err := d.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.cfg.WebAuthnCredentialsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		ConditionExpression: aws.String("userID = :u"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":u": {
+				S: aws.String(userID),
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (d DB) CreateAPIKey(key *db.APIKey) error {
+	av, err := dynamodbattribute.MarshalMap(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(d.cfg.APIKeysTableName),
+	})
+	return err
+}
+
+func (d DB) GetAPIKeys(userID string) ([]db.APIKey, error) {
+	if userID == "" {
+		return nil, errors.New("missing user ID")
+	}
+
+	result, err := d.db.Query(&dynamodb.QueryInput{
+		TableName: aws.String(d.cfg.APIKeysTableName),
+		IndexName: aws.String("userID-index"),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"userID": {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(userID),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API keys: %w", err)
+	}
+
+	keys := []db.APIKey{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal API keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (d DB) GetAPIKeyByHash(hash string) (db.APIKey, error) {
+	if hash == "" {
+		return db.APIKey{}, errors.New("missing hash")
+	}
+
+	result, err := d.db.Query(&dynamodb.QueryInput{
+		TableName: aws.String(d.cfg.APIKeysTableName),
+		IndexName: aws.String("hash-index"),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"hash": {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(hash),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return db.APIKey{}, fmt.Errorf("failed to get API key by hash: %w", err)
+	}
+	if result == nil || len(result.Items) == 0 || len(result.Items[0]) == 0 {
+		return db.APIKey{}, db.ErrNotFound
+	}
+
+	var key db.APIKey
+	err = dynamodbattribute.UnmarshalMap(result.Items[0], &key)
+	if err != nil {
+		return db.APIKey{}, fmt.Errorf("failed to unmarshal API key: %w", err)
+	}
+	return key, nil
+}
+
+func (d DB) UpdateAPIKeyLastUsedAt(id string, lastUsedAt time.Time) error {
+	lastUsedAtAV, err := dynamodbattribute.Marshal(lastUsedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":l": lastUsedAtAV,
+		},
+		TableName: aws.String(d.cfg.APIKeysTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		UpdateExpression: aws.String("set lastUsedAt = :l"),
+		ReturnValues:     aws.String("NONE"),
+	})
+	return err
+}
+
+func (d DB) DeleteAPIKey(userID, id string) error {
+	_, err := d.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.cfg.APIKeysTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		ConditionExpression: aws.String("userID = :u"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":u": {
+				S: aws.String(userID),
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (d DB) CreateAuditEntry(entry *db.AuditEntry) error {
+	av, err := dynamodbattribute.MarshalMap(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(d.cfg.AuditLogTableName),
+	})
+	return err
+}
+
+func (d DB) GetAuditEntries(userID string) ([]db.AuditEntry, error) {
+	if userID == "" {
+		return nil, errors.New("missing user ID")
+	}
+
+	result, err := d.db.Query(&dynamodb.QueryInput{
+		TableName: aws.String(d.cfg.AuditLogTableName),
+		IndexName: aws.String("userID-index"),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"userID": {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(userID),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audit entries: %w", err)
+	}
+
+	entries := []db.AuditEntry{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal audit entries: %w", err)
+	}
+	return entries, nil
+}
+
+func (d DB) CreateToken(token *db.Token) error {
+	av, err := dynamodbattribute.MarshalMap(token)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(d.cfg.TokensTableName),
+	})
+	return err
+}
+
+func (d DB) GetToken(purpose, hash string) (db.Token, error) {
+	if hash == "" {
+		return db.Token{}, errors.New("missing hash")
+	}
+
+	result, err := d.db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(d.cfg.TokensTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"hash": {
+				S: aws.String(hash),
+			},
+		},
+	})
+	if err != nil {
+		return db.Token{}, fmt.Errorf("failed to get token: %w", err)
+	}
+	if result == nil || len(result.Item) == 0 {
+		return db.Token{}, db.ErrNotFound
+	}
+
+	var token db.Token
+	err = dynamodbattribute.UnmarshalMap(result.Item, &token)
+	if err != nil {
+		return db.Token{}, fmt.Errorf("failed to unmarshal token: %w", err)
+	}
+	if token.Purpose != purpose {
+		return db.Token{}, db.ErrNotFound
+	}
+	return token, nil
+}
+
+func (d DB) ConsumeToken(purpose, hash string) (db.Token, error) {
+	if hash == "" {
+		return db.Token{}, errors.New("missing hash")
+	}
+
+	// Conditional delete guarantees that the token is consumed only once.
+	result, err := d.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.cfg.TokensTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"hash": {
+				S: aws.String(hash),
+			},
+		},
+		ConditionExpression: aws.String("purpose = :p"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":p": {
+				S: aws.String(purpose),
+			},
+		},
+		ReturnValues: aws.String("ALL_OLD"),
+	})
+	if err != nil {
+		var conditionErr *dynamodb.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return db.Token{}, db.ErrNotFound
+		}
+		return db.Token{}, fmt.Errorf("failed to consume token: %w", err)
+	}
+
+	var token db.Token
+	err = dynamodbattribute.UnmarshalMap(result.Attributes, &token)
+	if err != nil {
+		return db.Token{}, fmt.Errorf("failed to unmarshal token: %w", err)
+	}
+	return token, nil
+}
@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/bazuker/backend-bootstrap/pkg/db"
 )
@@ -17,7 +20,19 @@ type DB struct {
 }
 
 type localStorage struct {
-	Users []db.User
+	Users               []db.User
+	RoleAssignments     []db.RoleAssignment
+	UserIdentities      []db.UserIdentity
+	PasswordCredentials []db.PasswordCredential
+	Tokens              []db.Token
+	TOTPCredentials     []db.TOTPCredential
+	WebAuthnCredentials []db.WebAuthnCredential
+	APIKeys             []db.APIKey
+	AuditEntries        []db.AuditEntry
+	Organizations       []db.Organization
+	OrganizationMembers []db.OrganizationMember
+	Invitations         []db.Invitation
+	Files               []db.File
 }
 
 type Config struct {
@@ -27,7 +42,19 @@ type Config struct {
 func New(cfg Config) (*DB, error) {
 	database := &DB{
 		storage: &localStorage{
-			Users: []db.User{},
+			Users:               []db.User{},
+			RoleAssignments:     []db.RoleAssignment{},
+			UserIdentities:      []db.UserIdentity{},
+			PasswordCredentials: []db.PasswordCredential{},
+			Tokens:              []db.Token{},
+			TOTPCredentials:     []db.TOTPCredential{},
+			WebAuthnCredentials: []db.WebAuthnCredential{},
+			APIKeys:             []db.APIKey{},
+			AuditEntries:        []db.AuditEntry{},
+			Organizations:       []db.Organization{},
+			OrganizationMembers: []db.OrganizationMember{},
+			Invitations:         []db.Invitation{},
+			Files:               []db.File{},
 		},
 		cfg: cfg,
 		mx:  sync.Mutex{},
@@ -50,11 +77,61 @@ func (d *DB) CreateUser(user *db.User) error {
 	d.mx.Lock()
 	defer d.mx.Unlock()
 
+	user.Email = db.NormalizeEmail(user.Email)
 	d.storage.Users = append(d.storage.Users, *user)
 
 	return d.saveStorage()
 }
 
+func (d *DB) UpdateUser(userID string, update db.UserUpdate) (db.User, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	userIndex := d.findUserIndex(userID)
+	if userIndex < 0 {
+		return db.User{}, db.ErrNotFound
+	}
+	user := &d.storage.Users[userIndex]
+	if update.FirstName != nil {
+		user.FirstName = *update.FirstName
+	}
+	if update.LastName != nil {
+		user.LastName = *update.LastName
+	}
+	if update.Phone != nil {
+		user.Phone = *update.Phone
+	}
+	if update.DOB != nil {
+		user.DOB = update.DOB
+		if update.DOB.IsZero() {
+			user.DOB = nil
+		}
+	}
+	if update.Locale != nil {
+		user.Locale = *update.Locale
+	}
+	if update.PhotoURL != nil {
+		user.PhotoURL = *update.PhotoURL
+	}
+	if update.PhotoSourceURL != nil {
+		user.PhotoSourceURL = *update.PhotoSourceURL
+	}
+	if update.EditedFields != nil {
+		user.EditedFields = *update.EditedFields
+	}
+	if update.ErasureAt != nil {
+		user.ErasureAt = update.ErasureAt
+		if update.ErasureAt.IsZero() {
+			user.ErasureAt = nil
+		}
+	}
+	if update.StorageQuota != nil {
+		user.StorageQuota = *update.StorageQuota
+	}
+
+	return *user, d.saveStorage()
+}
+
 func (d *DB) UpdateUserPhotoURL(userID, photoURL string) error {
 	d.mx.Lock()
 	defer d.mx.Unlock()
@@ -74,6 +151,169 @@ func (d *DB) UpdateUserPhotoURL(userID, photoURL string) error {
 	return d.saveStorage()
 }
 
+func (d *DB) UpdateUserVerifiedEmail(userID string, verifiedEmail bool) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	userIndex := d.findUserIndex(userID)
+	if userIndex < 0 {
+		return db.ErrNotFound
+	}
+	d.storage.Users[userIndex].VerifiedEmail = verifiedEmail
+
+	return d.saveStorage()
+}
+
+func (d *DB) UpdateUserAccessLevel(userID, accessLevel string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	userIndex := d.findUserIndex(userID)
+	if userIndex < 0 {
+		return db.ErrNotFound
+	}
+	d.storage.Users[userIndex].AccessLevel = accessLevel
+
+	return d.saveStorage()
+}
+
+func (d *DB) UpdateUserStatus(userID, status string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	userIndex := d.findUserIndex(userID)
+	if userIndex < 0 {
+		return db.ErrNotFound
+	}
+	d.storage.Users[userIndex].Status = status
+
+	return d.saveStorage()
+}
+
+func (d *DB) DeleteUser(id string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if err := d.deleteUser(id); err != nil {
+		return err
+	}
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetUsersToErase(before time.Time) ([]db.User, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	users := []db.User{}
+	for i := range d.storage.Users {
+		user := d.storage.Users[i]
+		if user.Status == db.UserStatusDeleted && user.ErasureAt != nil && user.ErasureAt.Before(before) {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+func (d *DB) EraseUser(id string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if err := d.deleteUser(id); err != nil {
+		return err
+	}
+	for i := range d.storage.AuditEntries {
+		entry := &d.storage.AuditEntries[i]
+		if entry.UserID == id || entry.ActorID == id {
+			entry.IPAddress = ""
+		}
+		if entry.UserID == id {
+			entry.UserID = db.ErasedUserID
+		}
+		if entry.ActorID == id {
+			entry.ActorID = db.ErasedUserID
+		}
+	}
+
+	return d.saveStorage()
+}
+
+// deleteUser deletes the user with the dependent records without saving the storage.
+func (d *DB) deleteUser(id string) error {
+	userIndex := d.findUserIndex(id)
+	if userIndex < 0 {
+		return db.ErrNotFound
+	}
+	d.storage.Users = append(d.storage.Users[:userIndex], d.storage.Users[userIndex+1:]...)
+
+	roleAssignments := []db.RoleAssignment{}
+	for _, assignment := range d.storage.RoleAssignments {
+		if assignment.UserID != id {
+			roleAssignments = append(roleAssignments, assignment)
+		}
+	}
+	d.storage.RoleAssignments = roleAssignments
+
+	identities := []db.UserIdentity{}
+	for _, identity := range d.storage.UserIdentities {
+		if identity.UserID != id {
+			identities = append(identities, identity)
+		}
+	}
+	d.storage.UserIdentities = identities
+
+	passwordCredentials := []db.PasswordCredential{}
+	for _, credential := range d.storage.PasswordCredentials {
+		if credential.UserID != id {
+			passwordCredentials = append(passwordCredentials, credential)
+		}
+	}
+	d.storage.PasswordCredentials = passwordCredentials
+
+	totpCredentials := []db.TOTPCredential{}
+	for _, credential := range d.storage.TOTPCredentials {
+		if credential.UserID != id {
+			totpCredentials = append(totpCredentials, credential)
+		}
+	}
+	d.storage.TOTPCredentials = totpCredentials
+
+	webAuthnCredentials := []db.WebAuthnCredential{}
+	for _, credential := range d.storage.WebAuthnCredentials {
+		if credential.UserID != id {
+			webAuthnCredentials = append(webAuthnCredentials, credential)
+		}
+	}
+	d.storage.WebAuthnCredentials = webAuthnCredentials
+
+	apiKeys := []db.APIKey{}
+	for _, key := range d.storage.APIKeys {
+		if key.UserID != id {
+			apiKeys = append(apiKeys, key)
+		}
+	}
+	d.storage.APIKeys = apiKeys
+
+	members := []db.OrganizationMember{}
+	for _, member := range d.storage.OrganizationMembers {
+		if member.UserID != id {
+			members = append(members, member)
+		}
+	}
+	d.storage.OrganizationMembers = members
+
+	files := []db.File{}
+	for _, file := range d.storage.Files {
+		if file.UserID != id {
+			files = append(files, file)
+		}
+	}
+	d.storage.Files = files
+
+	return nil
+}
+
 func (d *DB) GetUserByID(id string) (db.User, error) {
 	if id == "" {
 		return db.User{}, errors.New("missing id")
@@ -99,8 +339,10 @@ func (d *DB) GetUserByEmail(email string) (db.User, error) {
 	d.mx.Lock()
 	defer d.mx.Unlock()
 
+	// Users created before the emails were normalized are matched as well.
+	email = db.NormalizeEmail(email)
 	for i := range d.storage.Users {
-		if d.storage.Users[i].Email == email {
+		if db.NormalizeEmail(d.storage.Users[i].Email) == email {
 			return d.storage.Users[i], nil
 		}
 	}
@@ -108,6 +350,811 @@ func (d *DB) GetUserByEmail(email string) (db.User, error) {
 	return db.User{}, db.ErrNotFound
 }
 
+func (d *DB) GetUserRoles(userID string) ([]string, error) {
+	if userID == "" {
+		return nil, errors.New("missing user id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	roles := []string{}
+	for i := range d.storage.RoleAssignments {
+		if d.storage.RoleAssignments[i].UserID == userID {
+			roles = append(roles, d.storage.RoleAssignments[i].Role)
+		}
+	}
+
+	return roles, nil
+}
+
+func (d *DB) AssignUserRole(userID, role string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.RoleAssignments {
+		if d.storage.RoleAssignments[i].UserID == userID && d.storage.RoleAssignments[i].Role == role {
+			return nil
+		}
+	}
+	d.storage.RoleAssignments = append(d.storage.RoleAssignments, db.RoleAssignment{
+		UserID:    userID,
+		Role:      role,
+		CreatedAt: time.Now().UTC(),
+	})
+
+	return d.saveStorage()
+}
+
+func (d *DB) UnassignUserRole(userID, role string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i, assignment := range d.storage.RoleAssignments {
+		if assignment.UserID == userID && assignment.Role == role {
+			d.storage.RoleAssignments = append(d.storage.RoleAssignments[:i], d.storage.RoleAssignments[i+1:]...)
+			return d.saveStorage()
+		}
+	}
+
+	return db.ErrNotFound
+}
+
+func (d *DB) CreateUserIdentity(identity *db.UserIdentity) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.UserIdentities {
+		if d.storage.UserIdentities[i].ID == identity.ID {
+			return db.ErrAlreadyExists
+		}
+	}
+	d.storage.UserIdentities = append(d.storage.UserIdentities, *identity)
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetUserIdentity(provider, subject string) (db.UserIdentity, error) {
+	if provider == "" || subject == "" {
+		return db.UserIdentity{}, errors.New("missing provider or subject")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	id := db.UserIdentityID(provider, subject)
+	for i := range d.storage.UserIdentities {
+		if d.storage.UserIdentities[i].ID == id {
+			return d.storage.UserIdentities[i], nil
+		}
+	}
+
+	return db.UserIdentity{}, db.ErrNotFound
+}
+
+func (d *DB) GetUserIdentities(userID string) ([]db.UserIdentity, error) {
+	if userID == "" {
+		return nil, errors.New("missing user id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	identities := []db.UserIdentity{}
+	for i := range d.storage.UserIdentities {
+		if d.storage.UserIdentities[i].UserID == userID {
+			identities = append(identities, d.storage.UserIdentities[i])
+		}
+	}
+
+	return identities, nil
+}
+
+func (d *DB) DeleteUserIdentity(userID, id string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i, identity := range d.storage.UserIdentities {
+		if identity.ID == id && identity.UserID == userID {
+			d.storage.UserIdentities = append(d.storage.UserIdentities[:i], d.storage.UserIdentities[i+1:]...)
+			return d.saveStorage()
+		}
+	}
+
+	return db.ErrNotFound
+}
+
+func (d *DB) CreateFile(file *db.File, quota int64) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	userIndex := d.findUserIndex(file.UserID)
+	if userIndex < 0 {
+		return db.ErrNotFound
+	}
+	for i := range d.storage.Files {
+		if d.storage.Files[i].ID == file.ID {
+			return db.ErrAlreadyExists
+		}
+	}
+	user := &d.storage.Users[userIndex]
+	if user.StorageUsed+file.Size > quota {
+		return db.ErrQuotaExceeded
+	}
+	user.StorageUsed += file.Size
+	d.storage.Files = append(d.storage.Files, *file)
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetFile(userID, id string) (db.File, error) {
+	if userID == "" || id == "" {
+		return db.File{}, errors.New("missing user id or id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.Files {
+		if d.storage.Files[i].ID == id && d.storage.Files[i].UserID == userID {
+			return d.storage.Files[i], nil
+		}
+	}
+
+	return db.File{}, db.ErrNotFound
+}
+
+// GetFiles returns the files in the order they were created.
+// The cursor is the creation time and the ID of the last file of the page,
+// so the pages stay consistent when the files are deleted.
+func (d *DB) GetFiles(userID string, limit int, cursor string) ([]db.File, string, error) {
+	if userID == "" {
+		return nil, "", errors.New("missing user id")
+	}
+	var after db.File
+	if cursor != "" {
+		createdAt, id, ok := strings.Cut(cursor, "_")
+		if !ok {
+			return nil, "", db.ErrInvalidCursor
+		}
+		var err error
+		if after.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+			return nil, "", db.ErrInvalidCursor
+		}
+		after.ID = id
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	files := []db.File{}
+	for i := range d.storage.Files {
+		file := d.storage.Files[i]
+		if file.UserID != userID {
+			continue
+		}
+		if cursor != "" && !fileAfter(file, after) {
+			continue
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return fileAfter(files[j], files[i])
+	})
+	if len(files) <= limit {
+		return files, "", nil
+	}
+	files = files[:limit]
+	last := files[len(files)-1]
+
+	return files, last.CreatedAt.Format(time.RFC3339Nano) + "_" + last.ID, nil
+}
+
+// fileAfter returns true if the file is created after the other file.
+func fileAfter(file, other db.File) bool {
+	if file.CreatedAt.Equal(other.CreatedAt) {
+		return file.ID > other.ID
+	}
+	return file.CreatedAt.After(other.CreatedAt)
+}
+
+func (d *DB) DeleteFile(userID, id string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i, file := range d.storage.Files {
+		if file.ID == id && file.UserID == userID {
+			d.storage.Files = append(d.storage.Files[:i], d.storage.Files[i+1:]...)
+			if userIndex := d.findUserIndex(userID); userIndex >= 0 {
+				user := &d.storage.Users[userIndex]
+				user.StorageUsed = max(user.StorageUsed-file.Size, 0)
+			}
+			return d.saveStorage()
+		}
+	}
+
+	return db.ErrNotFound
+}
+
+func (d *DB) RecomputeStorageUsed(userID string) (db.User, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	userIndex := d.findUserIndex(userID)
+	if userIndex < 0 {
+		return db.User{}, db.ErrNotFound
+	}
+	var storageUsed int64
+	for _, file := range d.storage.Files {
+		if file.UserID == userID {
+			storageUsed += file.Size
+		}
+	}
+	user := &d.storage.Users[userIndex]
+	user.StorageUsed = storageUsed
+	user.StorageTracked = true
+
+	return *user, d.saveStorage()
+}
+
+func (d *DB) CreateOrganization(org *db.Organization) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.Organizations {
+		if d.storage.Organizations[i].ID == org.ID {
+			return db.ErrAlreadyExists
+		}
+	}
+	d.storage.Organizations = append(d.storage.Organizations, *org)
+
+	return d.saveStorage()
+}
+
+func (d *DB) UpdateOrganizationName(id, name string) (db.Organization, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.Organizations {
+		if d.storage.Organizations[i].ID == id {
+			d.storage.Organizations[i].Name = name
+			return d.storage.Organizations[i], d.saveStorage()
+		}
+	}
+
+	return db.Organization{}, db.ErrNotFound
+}
+
+func (d *DB) DeleteOrganization(id string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	orgIndex := -1
+	for i := range d.storage.Organizations {
+		if d.storage.Organizations[i].ID == id {
+			orgIndex = i
+			break
+		}
+	}
+	if orgIndex < 0 {
+		return db.ErrNotFound
+	}
+	d.storage.Organizations = append(d.storage.Organizations[:orgIndex], d.storage.Organizations[orgIndex+1:]...)
+
+	members := []db.OrganizationMember{}
+	for _, member := range d.storage.OrganizationMembers {
+		if member.OrgID != id {
+			members = append(members, member)
+		}
+	}
+	d.storage.OrganizationMembers = members
+
+	invitations := []db.Invitation{}
+	for _, invitation := range d.storage.Invitations {
+		if invitation.OrgID != id {
+			invitations = append(invitations, invitation)
+		}
+	}
+	d.storage.Invitations = invitations
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetOrganization(id string) (db.Organization, error) {
+	if id == "" {
+		return db.Organization{}, errors.New("missing id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.Organizations {
+		if d.storage.Organizations[i].ID == id {
+			return d.storage.Organizations[i], nil
+		}
+	}
+
+	return db.Organization{}, db.ErrNotFound
+}
+
+func (d *DB) PutOrganizationMember(member *db.OrganizationMember) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.OrganizationMembers {
+		if d.storage.OrganizationMembers[i].OrgID == member.OrgID && d.storage.OrganizationMembers[i].UserID == member.UserID {
+			d.storage.OrganizationMembers[i] = *member
+			return d.saveStorage()
+		}
+	}
+	d.storage.OrganizationMembers = append(d.storage.OrganizationMembers, *member)
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetOrganizationMember(orgID, userID string) (db.OrganizationMember, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.OrganizationMembers {
+		if d.storage.OrganizationMembers[i].OrgID == orgID && d.storage.OrganizationMembers[i].UserID == userID {
+			return d.storage.OrganizationMembers[i], nil
+		}
+	}
+
+	return db.OrganizationMember{}, db.ErrNotFound
+}
+
+func (d *DB) GetOrganizationMembers(orgID string) ([]db.OrganizationMember, error) {
+	if orgID == "" {
+		return nil, errors.New("missing organization id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	members := []db.OrganizationMember{}
+	for i := range d.storage.OrganizationMembers {
+		if d.storage.OrganizationMembers[i].OrgID == orgID {
+			members = append(members, d.storage.OrganizationMembers[i])
+		}
+	}
+
+	return members, nil
+}
+
+func (d *DB) GetUserMemberships(userID string) ([]db.OrganizationMember, error) {
+	if userID == "" {
+		return nil, errors.New("missing user id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	memberships := []db.OrganizationMember{}
+	for i := range d.storage.OrganizationMembers {
+		if d.storage.OrganizationMembers[i].UserID == userID {
+			memberships = append(memberships, d.storage.OrganizationMembers[i])
+		}
+	}
+
+	return memberships, nil
+}
+
+func (d *DB) DeleteOrganizationMember(orgID, userID string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i, member := range d.storage.OrganizationMembers {
+		if member.OrgID == orgID && member.UserID == userID {
+			d.storage.OrganizationMembers = append(d.storage.OrganizationMembers[:i], d.storage.OrganizationMembers[i+1:]...)
+			return d.saveStorage()
+		}
+	}
+
+	return db.ErrNotFound
+}
+
+func (d *DB) CreateInvitation(invitation *db.Invitation) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.Invitations {
+		if d.storage.Invitations[i].ID == invitation.ID {
+			return db.ErrAlreadyExists
+		}
+	}
+	d.storage.Invitations = append(d.storage.Invitations, *invitation)
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetInvitation(id string) (db.Invitation, error) {
+	if id == "" {
+		return db.Invitation{}, errors.New("missing id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.Invitations {
+		if d.storage.Invitations[i].ID == id {
+			return d.storage.Invitations[i], nil
+		}
+	}
+
+	return db.Invitation{}, db.ErrNotFound
+}
+
+func (d *DB) GetInvitationByTokenHash(hash string) (db.Invitation, error) {
+	if hash == "" {
+		return db.Invitation{}, errors.New("missing hash")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.Invitations {
+		if d.storage.Invitations[i].TokenHash == hash {
+			return d.storage.Invitations[i], nil
+		}
+	}
+
+	return db.Invitation{}, db.ErrNotFound
+}
+
+func (d *DB) GetOrganizationInvitations(orgID string) ([]db.Invitation, error) {
+	if orgID == "" {
+		return nil, errors.New("missing organization id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	invitations := []db.Invitation{}
+	for i := range d.storage.Invitations {
+		if d.storage.Invitations[i].OrgID == orgID {
+			invitations = append(invitations, d.storage.Invitations[i])
+		}
+	}
+
+	return invitations, nil
+}
+
+func (d *DB) GetInvitationsByEmail(email string) ([]db.Invitation, error) {
+	if email == "" {
+		return nil, errors.New("missing email")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	invitations := []db.Invitation{}
+	for i := range d.storage.Invitations {
+		if d.storage.Invitations[i].Email == email {
+			invitations = append(invitations, d.storage.Invitations[i])
+		}
+	}
+
+	return invitations, nil
+}
+
+func (d *DB) UpdateInvitationToken(id, tokenHash, invitedBy string, expiresAt time.Time) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.Invitations {
+		if d.storage.Invitations[i].ID == id {
+			d.storage.Invitations[i].TokenHash = tokenHash
+			d.storage.Invitations[i].InvitedBy = invitedBy
+			d.storage.Invitations[i].ExpiresAt = expiresAt
+			return d.saveStorage()
+		}
+	}
+
+	return db.ErrNotFound
+}
+
+func (d *DB) DeleteInvitation(id string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i, invitation := range d.storage.Invitations {
+		if invitation.ID == id {
+			d.storage.Invitations = append(d.storage.Invitations[:i], d.storage.Invitations[i+1:]...)
+			return d.saveStorage()
+		}
+	}
+
+	return db.ErrNotFound
+}
+
+func (d *DB) PutPasswordCredential(credential *db.PasswordCredential) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.PasswordCredentials {
+		if d.storage.PasswordCredentials[i].UserID == credential.UserID {
+			d.storage.PasswordCredentials[i] = *credential
+			return d.saveStorage()
+		}
+	}
+	d.storage.PasswordCredentials = append(d.storage.PasswordCredentials, *credential)
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetPasswordCredential(userID string) (db.PasswordCredential, error) {
+	if userID == "" {
+		return db.PasswordCredential{}, errors.New("missing user id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.PasswordCredentials {
+		if d.storage.PasswordCredentials[i].UserID == userID {
+			return d.storage.PasswordCredentials[i], nil
+		}
+	}
+
+	return db.PasswordCredential{}, db.ErrNotFound
+}
+
+func (d *DB) PutTOTPCredential(credential *db.TOTPCredential) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.TOTPCredentials {
+		if d.storage.TOTPCredentials[i].UserID == credential.UserID {
+			d.storage.TOTPCredentials[i] = *credential
+			return d.saveStorage()
+		}
+	}
+	d.storage.TOTPCredentials = append(d.storage.TOTPCredentials, *credential)
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetTOTPCredential(userID string) (db.TOTPCredential, error) {
+	if userID == "" {
+		return db.TOTPCredential{}, errors.New("missing user id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.TOTPCredentials {
+		if d.storage.TOTPCredentials[i].UserID == userID {
+			return d.storage.TOTPCredentials[i], nil
+		}
+	}
+
+	return db.TOTPCredential{}, db.ErrNotFound
+}
+
+func (d *DB) DeleteTOTPCredential(userID string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.TOTPCredentials {
+		if d.storage.TOTPCredentials[i].UserID == userID {
+			d.storage.TOTPCredentials = append(d.storage.TOTPCredentials[:i], d.storage.TOTPCredentials[i+1:]...)
+			return d.saveStorage()
+		}
+	}
+
+	return db.ErrNotFound
+}
+
+func (d *DB) CreateWebAuthnCredential(credential *db.WebAuthnCredential) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.storage.WebAuthnCredentials = append(d.storage.WebAuthnCredentials, *credential)
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetWebAuthnCredentials(userID string) ([]db.WebAuthnCredential, error) {
+	if userID == "" {
+		return nil, errors.New("missing user id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	credentials := []db.WebAuthnCredential{}
+	for i := range d.storage.WebAuthnCredentials {
+		if d.storage.WebAuthnCredentials[i].UserID == userID {
+			credentials = append(credentials, d.storage.WebAuthnCredentials[i])
+		}
+	}
+
+	return credentials, nil
+}
+
+func (d *DB) UpdateWebAuthnCredentialUsage(id string, signCount uint32, lastUsedAt time.Time) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.WebAuthnCredentials {
+		if d.storage.WebAuthnCredentials[i].ID == id {
+			d.storage.WebAuthnCredentials[i].SignCount = signCount
+			d.storage.WebAuthnCredentials[i].LastUsedAt = &lastUsedAt
+			return d.saveStorage()
+		}
+	}
+
+	return db.ErrNotFound
+}
+
+func (d *DB) DeleteWebAuthnCredential(userID, id string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i, credential := range d.storage.WebAuthnCredentials {
+		if credential.ID == id && credential.UserID == userID {
+			d.storage.WebAuthnCredentials = append(d.storage.WebAuthnCredentials[:i], d.storage.WebAuthnCredentials[i+1:]...)
+			return d.saveStorage()
+		}
+	}
+
+	return db.ErrNotFound
+}
+
+func (d *DB) CreateAPIKey(key *db.APIKey) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.storage.APIKeys = append(d.storage.APIKeys, *key)
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetAPIKeys(userID string) ([]db.APIKey, error) {
+	if userID == "" {
+		return nil, errors.New("missing user id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	keys := []db.APIKey{}
+	for i := range d.storage.APIKeys {
+		if d.storage.APIKeys[i].UserID == userID {
+			keys = append(keys, d.storage.APIKeys[i])
+		}
+	}
+
+	return keys, nil
+}
+
+func (d *DB) GetAPIKeyByHash(hash string) (db.APIKey, error) {
+	if hash == "" {
+		return db.APIKey{}, errors.New("missing hash")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.APIKeys {
+		if d.storage.APIKeys[i].Hash == hash {
+			return d.storage.APIKeys[i], nil
+		}
+	}
+
+	return db.APIKey{}, db.ErrNotFound
+}
+
+func (d *DB) UpdateAPIKeyLastUsedAt(id string, lastUsedAt time.Time) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i := range d.storage.APIKeys {
+		if d.storage.APIKeys[i].ID == id {
+			d.storage.APIKeys[i].LastUsedAt = &lastUsedAt
+			return d.saveStorage()
+		}
+	}
+
+	return db.ErrNotFound
+}
+
+func (d *DB) DeleteAPIKey(userID, id string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i, key := range d.storage.APIKeys {
+		if key.ID == id && key.UserID == userID {
+			d.storage.APIKeys = append(d.storage.APIKeys[:i], d.storage.APIKeys[i+1:]...)
+			return d.saveStorage()
+		}
+	}
+
+	return db.ErrNotFound
+}
+
+func (d *DB) CreateAuditEntry(entry *db.AuditEntry) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.storage.AuditEntries = append(d.storage.AuditEntries, *entry)
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetAuditEntries(userID string) ([]db.AuditEntry, error) {
+	if userID == "" {
+		return nil, errors.New("missing user id")
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	entries := []db.AuditEntry{}
+	for i := range d.storage.AuditEntries {
+		if d.storage.AuditEntries[i].UserID == userID {
+			entries = append(entries, d.storage.AuditEntries[i])
+		}
+	}
+
+	return entries, nil
+}
+
+func (d *DB) CreateToken(token *db.Token) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	// Drop expired tokens, so they do not pile up.
+	now := time.Now()
+	tokens := d.storage.Tokens[:0]
+	for _, t := range d.storage.Tokens {
+		if t.ExpiresAt.After(now) {
+			tokens = append(tokens, t)
+		}
+	}
+	d.storage.Tokens = append(tokens, *token)
+
+	return d.saveStorage()
+}
+
+func (d *DB) GetToken(purpose, hash string) (db.Token, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for _, t := range d.storage.Tokens {
+		if t.Hash == hash && t.Purpose == purpose {
+			return t, nil
+		}
+	}
+
+	return db.Token{}, db.ErrNotFound
+}
+
+func (d *DB) ConsumeToken(purpose, hash string) (db.Token, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for i, t := range d.storage.Tokens {
+		if t.Hash == hash && t.Purpose == purpose {
+			d.storage.Tokens = append(d.storage.Tokens[:i], d.storage.Tokens[i+1:]...)
+			return t, d.saveStorage()
+		}
+	}
+
+	return db.Token{}, db.ErrNotFound
+}
+
+func (d *DB) findUserIndex(userID string) int {
+	for i := range d.storage.Users {
+		if d.storage.Users[i].ID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
 func (d *DB) saveStorage() error {
 	data, _ := json.Marshal(d.storage)
 	return os.WriteFile(d.cfg.Filename, data, os.ModePerm)
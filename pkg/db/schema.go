@@ -2,6 +2,8 @@ package db
 
 import (
 	"errors"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -10,6 +12,34 @@ const (
 	AccessLevelAdmin = "admin"
 )
 
+const (
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+	UserStatusDeleted   = "deleted"
+)
+
+// Profile fields of the user that are synced from the identity providers unless the user edits them.
+const (
+	UserFieldFirstName = "firstName"
+	UserFieldLastName  = "lastName"
+	UserFieldLocale    = "locale"
+	UserFieldPhoto     = "photoURL"
+)
+
+// Roles of the members of an organization, from the most to the least privileged.
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+const (
+	TokenPurposeEmailVerification = "emailVerification"
+	TokenPurposePasswordReset     = "passwordReset"
+	TokenPurposeMagicLink         = "magicLink"
+	TokenPurposeAccountRestore    = "accountRestore"
+)
+
 type User struct {
 	ID            string     `json:"id"`
 	FirstName     string     `json:"firstName"`
@@ -20,8 +50,242 @@ type User struct {
 	VerifiedEmail bool       `json:"verifiedEmail"`
 	AccessLevel   string     `json:"accessLevel"`
 	PhotoURL      string     `json:"photoURL"`
+	// PhotoSourceURL is the URL of the provider's picture the photo was downloaded from.
+	PhotoSourceURL string `json:"photoSourceURL,omitempty"`
+	// Locale is the preferred locale of the user, e.g. 'en' or 'de-AT'.
+	Locale string `json:"locale"`
+	// EditedFields are the profile fields the user has edited, e.g. UserFieldFirstName.
+	// They are no longer synced from the identity providers.
+	EditedFields []string `json:"editedFields,omitempty"`
+	// Status is one of UserStatusActive, UserStatusSuspended or UserStatusDeleted.
+	// Only active users can sign in or use their API keys.
+	Status string `json:"status"`
+	// ErasureAt is when the user deleted by themselves is erased for good.
+	ErasureAt *time.Time `json:"erasureAt,omitempty"`
+	// StorageUsed is the total size of the library files of the user in bytes, excluding the photo.
+	StorageUsed int64 `json:"storageUsed"`
+	// StorageTracked is set once StorageUsed accounts for all files of the user,
+	// including the files stored before the storage used was tracked.
+	StorageTracked bool `json:"storageTracked,omitempty"`
+	// StorageQuota overrides the storage quota of the user's access level if it is set.
+	StorageQuota int64 `json:"storageQuota,omitempty"`
 }
 
+// UserUpdate is a partial update of a user.
+// Only the fields that are not nil are updated.
+type UserUpdate struct {
+	FirstName *string
+	LastName  *string
+	Phone     *string
+	// DOB is removed if it is the zero time.
+	DOB            *time.Time
+	Locale         *string
+	PhotoURL       *string
+	PhotoSourceURL *string
+	EditedFields   *[]string
+	// ErasureAt is removed if it is the zero time.
+	ErasureAt *time.Time
+	// StorageQuota of zero removes the override.
+	StorageQuota *int64
+}
+
+// IsActive returns true if the user is active.
+// Users created before the status was introduced have no status and are active.
+func (u User) IsActive() bool {
+	return u.Status == UserStatusActive || u.Status == ""
+}
+
+// IsEdited returns true if the user has edited the profile field.
+func (u User) IsEdited(field string) bool {
+	return slices.Contains(u.EditedFields, field)
+}
+
+// WithEditedFields returns the edited fields of the user along with the given ones.
+func (u User) WithEditedFields(fields ...string) []string {
+	edited := append([]string{}, u.EditedFields...)
+	for _, field := range fields {
+		if !slices.Contains(edited, field) {
+			edited = append(edited, field)
+		}
+	}
+	return edited
+}
+
+// NormalizeEmail returns the email in the form it is stored and matched in, so that the emails
+// entered by the users and the emails from the identity providers match regardless of the case.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// RoleAssignment is a role assigned to a user.
+type RoleAssignment struct {
+	UserID    string    `json:"userID"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// PasswordCredential is the password of a user.
+// It is stored separately from the user, so the hash never leaves the server along with the user.
+type PasswordCredential struct {
+	UserID    string    `json:"userID"`
+	Hash      string    `json:"hash"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// TOTPCredential is the time-based one-time password second factor of a user.
+type TOTPCredential struct {
+	UserID string `json:"userID"`
+	Secret string `json:"secret"`
+	// Enabled is false until the user confirms the enrollment with a valid code.
+	Enabled bool `json:"enabled"`
+	// RecoveryCodeHashes are the hashes of unused recovery codes.
+	RecoveryCodeHashes []string `json:"recoveryCodeHashes"`
+	// LastUsedStep is the time step of the last accepted code.
+	// It is used to reject reused codes.
+	LastUsedStep int64     `json:"lastUsedStep"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// WebAuthnCredential is a passkey or a security key of a user.
+type WebAuthnCredential struct {
+	// ID is the base64url encoded credential ID.
+	ID              string   `json:"id"`
+	UserID          string   `json:"userID"`
+	Name            string   `json:"name"`
+	PublicKey       []byte   `json:"publicKey"`
+	AttestationType string   `json:"attestationType"`
+	Transports      []string `json:"transports"`
+	AAGUID          []byte   `json:"aaguid"`
+	// SignCount is the last signature counter reported by the authenticator.
+	SignCount      uint32     `json:"signCount"`
+	UserPresent    bool       `json:"userPresent"`
+	UserVerified   bool       `json:"userVerified"`
+	BackupEligible bool       `json:"backupEligible"`
+	BackupState    bool       `json:"backupState"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	LastUsedAt     *time.Time `json:"lastUsedAt"`
+}
+
+// APIKey is a personal API key of a user for machine access.
+// Only the hash of the key is stored.
+type APIKey struct {
+	ID     string `json:"id"`
+	UserID string `json:"userID"`
+	Name   string `json:"name"`
+	// Prefix is the beginning of the key that helps users identify it.
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"hash"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// UserIdentity links a user to the account of an identity provider.
+type UserIdentity struct {
+	// ID is the provider and the subject, see UserIdentityID.
+	ID       string `json:"id"`
+	UserID   string `json:"userID"`
+	Provider string `json:"provider"`
+	// Subject is the unique user identifier assigned by the provider.
+	Subject string `json:"subject"`
+	// Email is the email of the account at the time it was linked.
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// UserIdentityID returns the ID of the identity of the provider's subject.
+func UserIdentityID(provider, subject string) string {
+	return provider + ":" + subject
+}
+
+// File is the metadata of a file of a user in the file store.
+type File struct {
+	ID string `json:"id"`
+	// UserID is the owner of the file.
+	UserID      string `json:"userID"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	// Checksum is the hex encoded SHA-256 of the content.
+	Checksum string `json:"checksum"`
+	// Key is the key of the object in the file store.
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Organization is a workspace shared by a team of users.
+type Organization struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// CreatedBy is the user who created the organization.
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// OrganizationMember is the membership of a user in an organization.
+type OrganizationMember struct {
+	OrgID  string `json:"orgID"`
+	UserID string `json:"userID"`
+	// Role is one of OrgRoleOwner, OrgRoleAdmin or OrgRoleMember.
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Invitation invites the email to join an organization with the role.
+// Only the hash of the token sent in the invitation link is stored.
+type Invitation struct {
+	ID        string `json:"id"`
+	OrgID     string `json:"orgID"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	TokenHash string `json:"tokenHash,omitempty"`
+	// InvitedBy is the member who created or last resent the invitation.
+	InvitedBy string    `json:"invitedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// AuditEntry is a record of an action performed on a user's account.
+type AuditEntry struct {
+	ID string `json:"id"`
+	// UserID is the user whose account the action was performed on.
+	UserID string `json:"userID"`
+	Action string `json:"action"`
+	// ActorID is the user who performed the action.
+	ActorID string `json:"actorID"`
+	// ImpersonatorID is the admin who performed the action on behalf of the actor.
+	ImpersonatorID string    `json:"impersonatorID,omitempty"`
+	APIKeyID       string    `json:"apiKeyID,omitempty"`
+	IPAddress      string    `json:"ipAddress"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// Token is a single-use token sent to the user, e.g. in an email verification link.
+// Only the hash of the token is stored.
+type Token struct {
+	Hash    string `json:"hash"`
+	Purpose string `json:"purpose"`
+	UserID  string `json:"userID"`
+	Email   string `json:"email"`
+	// RedirectURL is where the user is redirected after the token is used.
+	RedirectURL string `json:"redirectURL,omitempty"`
+	// Scopes are requested for the session created with the token.
+	Scopes []string `json:"scopes,omitempty"`
+	// CodeChallenge is the PKCE challenge of the one-time code issued with the token.
+	CodeChallenge string `json:"codeChallenge,omitempty"`
+	// Nonce binds the token to the browser it was requested from.
+	Nonce     string    `json:"nonce,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ErasedUserID replaces the IDs of the erased users in the audit log.
+const ErasedUserID = "erased"
+
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrQuotaExceeded = errors.New("quota exceeded")
 )
@@ -0,0 +1,54 @@
+package local
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bazuker/backend-bootstrap/pkg/mailer"
+)
+
+// Mailer writes messages to files or to the log instead of sending them.
+// Suitable for local development and tests.
+type Mailer struct {
+	cfg Config
+}
+
+type Config struct {
+	// Directory to write the messages to. The directory must already exist.
+	// The messages are written to the log if it is empty.
+	Directory string
+}
+
+func New(cfg Config) *Mailer {
+	return &Mailer{
+		cfg: cfg,
+	}
+}
+
+func (m *Mailer) Send(message mailer.Message) error {
+	content := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", message.To, message.Subject, message.Body)
+	if len(m.cfg.Directory) == 0 {
+		log.Printf("email:\n%s", content)
+		return nil
+	}
+	filename := fmt.Sprintf("%d-%s.txt", time.Now().UnixNano(), sanitizeFilename(message.To))
+	return os.WriteFile(filepath.Join(m.cfg.Directory, filename), []byte(content), os.ModePerm)
+}
+
+// sanitizeFilename replaces the characters of the recipient that are not safe in a filename,
+// so that the messages are always written to the directory.
+func sanitizeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '@', r == '.', r == '+', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
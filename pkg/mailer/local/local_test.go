@@ -0,0 +1,55 @@
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazuker/backend-bootstrap/pkg/mailer"
+)
+
+func TestMailerSend(t *testing.T) {
+	directory := t.TempDir()
+	m := New(Config{Directory: directory})
+
+	err := m.Send(mailer.Message{
+		To:      "../user+tag@example.com",
+		Subject: "Reset your password",
+		Body:    "https://example.com/reset-password?token=abc",
+	})
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+
+	// The message is written into the directory even if the recipient is not a safe filename.
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("failed to read directory: %s", err)
+	}
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), "-.._user+tag@example.com.txt") {
+		t.Fatalf("unexpected files %v", entries)
+	}
+	content, err := os.ReadFile(filepath.Join(directory, entries[0].Name()))
+	if err != nil {
+		t.Fatalf("failed to read message: %s", err)
+	}
+	expected := "To: ../user+tag@example.com\nSubject: Reset your password\n\nhttps://example.com/reset-password?token=abc\n"
+	if string(content) != expected {
+		t.Errorf("expected %q, got %q", expected, string(content))
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := map[string]string{
+		"user@example.com":        "user@example.com",
+		"first.last+tag@x.io":     "first.last+tag@x.io",
+		"../../etc/passwd":        ".._.._etc_passwd",
+		"a\\b\x00c d@example.com": "a_b_c_d@example.com",
+	}
+	for name, expected := range tests {
+		if sanitized := sanitizeFilename(name); sanitized != expected {
+			t.Errorf("expected '%s' for '%s', got '%s'", expected, name, sanitized)
+		}
+	}
+}
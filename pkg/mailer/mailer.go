@@ -0,0 +1,13 @@
+package mailer
+
+type Message struct {
+	To      string
+	Subject string
+	// Body is the plain text body of the message.
+	Body string
+}
+
+type Mailer interface {
+	// Send sends the message.
+	Send(message Message) error
+}
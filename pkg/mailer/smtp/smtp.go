@@ -0,0 +1,64 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"github.com/bazuker/backend-bootstrap/pkg/mailer"
+)
+
+// Mailer sends messages via an SMTP server.
+type Mailer struct {
+	cfg Config
+}
+
+type Config struct {
+	Host string
+	Port int
+	// Username and Password are optional.
+	// Note: net/smtp only sends credentials over TLS or to localhost.
+	Username string
+	Password string
+	// From is the sender address, e.g. no-reply@example.com
+	From string
+}
+
+func New(cfg Config) *Mailer {
+	if cfg.Port == 0 {
+		cfg.Port = 587
+	}
+	return &Mailer{
+		cfg: cfg,
+	}
+}
+
+func (m *Mailer) Send(message mailer.Message) error {
+	var auth smtp.Auth
+	if len(m.cfg.Username) > 0 {
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)
+	}
+	addr := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+	err := smtp.SendMail(addr, auth, m.cfg.From, []string{message.To}, m.buildMessage(message))
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+func (m *Mailer) buildMessage(message mailer.Message) []byte {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(buf, "To: %s\r\n", message.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(message.Body)
+	return buf.Bytes()
+}
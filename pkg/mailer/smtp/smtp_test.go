@@ -0,0 +1,141 @@
+package smtp
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bazuker/backend-bootstrap/pkg/mailer"
+)
+
+// smtpSink is an SMTP server that accepts a single message and records the conversation.
+type smtpSink struct {
+	listener net.Listener
+	from     string
+	to       []string
+	data     string
+	done     chan struct{}
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sink := &smtpSink{listener: listener, done: make(chan struct{})}
+	go sink.serve(t)
+	return sink
+}
+
+func (s *smtpSink) serve(t *testing.T) {
+	defer close(s.done)
+	conn, err := s.listener.Accept()
+	if err != nil {
+		t.Errorf("failed to accept: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		if _, err := conn.Write([]byte(line + "\r\n")); err != nil {
+			t.Errorf("failed to reply: %s", err)
+		}
+	}
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Errorf("failed to read command: %s", err)
+			return
+		}
+		command := strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			s.from = strings.Trim(strings.TrimPrefix(command, "MAIL FROM:"), "<>")
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			s.to = append(s.to, strings.Trim(strings.TrimPrefix(command, "RCPT TO:"), "<>"))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err = r.ReadString('\n')
+				if err != nil {
+					t.Errorf("failed to read data: %s", err)
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.data = data.String()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestMailerSend(t *testing.T) {
+	sink := newSMTPSink(t)
+	addr := sink.listener.Addr().(*net.TCPAddr)
+	m := New(Config{
+		Host: addr.IP.String(),
+		Port: addr.Port,
+		From: "no-reply@example.com",
+	})
+
+	err := m.Send(mailer.Message{
+		To:      "user@example.com",
+		Subject: "Vérifiez votre email",
+		Body:    "Follow the link:\r\n\r\nhttps://example.com/verify-email?token=abc",
+	})
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	<-sink.done
+
+	if sink.from != "no-reply@example.com" {
+		t.Errorf("unexpected sender '%s'", sink.from)
+	}
+	if len(sink.to) != 1 || sink.to[0] != "user@example.com" {
+		t.Errorf("unexpected recipients %v", sink.to)
+	}
+	for _, expected := range []string{
+		"From: no-reply@example.com\r\n",
+		"To: user@example.com\r\n",
+		"Subject: =?utf-8?q?V=C3=A9rifiez_votre_email?=\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"\r\n\r\nFollow the link:\r\n\r\nhttps://example.com/verify-email?token=abc",
+	} {
+		if !strings.Contains(sink.data, expected) {
+			t.Errorf("expected '%q' in the message:\n%s", expected, sink.data)
+		}
+	}
+}
+
+func TestMailerSendUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	m := New(Config{Host: addr.IP.String(), Port: addr.Port, From: "no-reply@example.com"})
+	if err = m.Send(mailer.Message{To: "user@example.com"}); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,267 @@
+package admin
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/filestore"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/audit"
+	authHandlers "github.com/bazuker/backend-bootstrap/pkg/manager/auth"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/rbac"
+	usersHandlers "github.com/bazuker/backend-bootstrap/pkg/manager/users"
+	"github.com/gin-gonic/gin"
+)
+
+type accessLevelRequest struct {
+	AccessLevel string `json:"accessLevel" binding:"required,oneof=basic admin"`
+}
+
+type storageQuotaRequest struct {
+	// Quota is the storage quota of the user in bytes. Zero resets it to the quota of the access level.
+	Quota *int64 `json:"quota" binding:"required,min=0"`
+}
+
+type impersonationResponse struct {
+	AccessToken string    `json:"accessToken"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// Middleware returns the handlers that authorize admin actions.
+// The session or the API key must have 'admin:users' scope
+// and the user must have 'users:write:any' permission.
+// It must be used after the authentication check.
+func Middleware() gin.HandlersChain {
+	return gin.HandlersChain{
+		authHandlers.RequireScope(authHandlers.ScopeAdminUsers),
+		rbac.RequirePermission(rbac.PermissionUsersWriteAny),
+	}
+}
+
+// HandleUpdateAccessLevel changes the access level of a user.
+// The roles are kept in line with the access level and the sessions of the user are revoked,
+// so the new access level applies immediately.
+func HandleUpdateAccessLevel(c *gin.Context) {
+	var req accessLevelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	user, ok := targetUserOrAbort(c)
+	if !ok {
+		return
+	}
+
+	// Migrate the user to roles first, so the migration does not override the change.
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	if _, err := rbac.UserRoles(database, user.ID); err != nil {
+		log.Printf("failed to get roles of user '%s': %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var err error
+	if req.AccessLevel == db.AccessLevelAdmin {
+		err = database.AssignUserRole(user.ID, rbac.RoleSuperuser)
+	} else {
+		err = demoteUserRoles(database, user.ID)
+	}
+	if err != nil {
+		log.Printf("failed to update roles of user '%s': %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = database.UpdateUserAccessLevel(user.ID, req.AccessLevel); err != nil {
+		log.Printf("failed to update user '%s' access level: %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	authHandlers.RevokeUserSessions(c.MustGet(helper.ContextCache).(*cache.Cache), user.ID)
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// demoteUserRoles replaces the superuser role with the member role.
+func demoteUserRoles(database db.Adapter, userID string) error {
+	if err := database.AssignUserRole(userID, rbac.RoleMember); err != nil {
+		return err
+	}
+	if err := rbac.UnassignUserRole(database, userID, rbac.RoleSuperuser); err != nil && err != db.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// HandleUpdateStorageQuota overrides the storage quota of a user.
+// The files already stored are kept even if they exceed the new quota.
+func HandleUpdateStorageQuota(c *gin.Context) {
+	var req storageQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	user, ok := findUserOrAbort(c)
+	if !ok {
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	user, err := database.UpdateUser(user.ID, db.UserUpdate{StorageQuota: req.Quota})
+	if err != nil {
+		log.Printf("failed to update user '%s' storage quota: %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// HandleDisableUser suspends the account of a user and revokes all of their sessions.
+func HandleDisableUser(c *gin.Context) {
+	user, ok := targetUserOrAbort(c)
+	if !ok {
+		return
+	}
+	updateUserStatus(c, user, db.UserStatusSuspended)
+}
+
+// HandleEnableUser reactivates the suspended account of a user.
+// The account deleted by the user is restored and no longer erased.
+func HandleEnableUser(c *gin.Context) {
+	user, ok := targetUserOrAbort(c)
+	if !ok {
+		return
+	}
+	if user.ErasureAt != nil {
+		database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+		if _, err := database.UpdateUser(user.ID, db.UserUpdate{ErasureAt: &time.Time{}}); err != nil {
+			log.Printf("failed to cancel erasure of user '%s': %s\n", user.ID, err.Error())
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	updateUserStatus(c, user, db.UserStatusActive)
+}
+
+func updateUserStatus(c *gin.Context, user db.User, status string) {
+	if err := authHandlers.UpdateUserStatus(c, user.ID, status); err != nil {
+		log.Printf("failed to update user '%s' status: %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// HandleRevokeUserSessions signs a user out of all sessions.
+// API keys are not affected.
+func HandleRevokeUserSessions(c *gin.Context) {
+	user, ok := findUserOrAbort(c)
+	if !ok {
+		return
+	}
+
+	authHandlers.RevokeUserSessions(c.MustGet(helper.ContextCache).(*cache.Cache), user.ID)
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// HandleDeleteUser erases a user together with their photo and files
+// and anonymizes the audit log the same way as the erasure of the accounts deleted by the users.
+// The deletion is recorded in the audit log without the ID of the user.
+func HandleDeleteUser(c *gin.Context) {
+	user, ok := targetUserOrAbort(c)
+	if !ok {
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	fs := c.MustGet(helper.ContextFileStore).(filestore.FileStore)
+	if err := usersHandlers.DeleteUserObjects(database, fs, user); err != nil {
+		log.Printf("failed to delete objects of user '%s': %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err := database.EraseUser(user.ID); err != nil {
+		log.Printf("failed to erase user '%s': %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	authHandlers.RevokeUserSessions(c.MustGet(helper.ContextCache).(*cache.Cache), user.ID)
+	audit.Record(c, audit.ActionAdminDelete, db.ErasedUserID)
+
+	log.Printf("user '%s' was deleted by '%s'\n", user.ID, c.MustGet(helper.ContextUserID).(string))
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// HandleImpersonateUser issues a short-lived session of a user for the authenticated admin.
+// Admins, including the users with admin permissions from their roles, and inactive users cannot be impersonated.
+func HandleImpersonateUser(c *gin.Context) {
+	user, ok := targetUserOrAbort(c)
+	if !ok {
+		return
+	}
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	roles, err := rbac.UserRoles(database, user.ID)
+	if err != nil {
+		log.Printf("failed to get roles of user '%s': %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	permissions := c.MustGet(helper.ContextRoles).(rbac.Roles).Permissions(roles)
+	if user.AccessLevel == db.AccessLevelAdmin || rbac.HasAdminPermission(permissions) {
+		c.AbortWithStatusJSON(http.StatusForbidden, helper.HTTPMessage{Message: "admins cannot be impersonated"})
+		return
+	}
+	if !user.IsActive() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: "inactive users cannot be impersonated"})
+		return
+	}
+
+	accessToken, expiresAt := authHandlers.CreateImpersonationSession(c, user, c.MustGet(helper.ContextUserID).(string))
+
+	c.JSON(http.StatusOK, impersonationResponse{
+		AccessToken: accessToken,
+		ExpiresAt:   expiresAt,
+	})
+}
+
+// targetUserOrAbort finds the user from the path like findUserOrAbort
+// and also rejects the admins acting on their own account, so they cannot lock themselves out.
+func targetUserOrAbort(c *gin.Context) (db.User, bool) {
+	if c.Param("userid") == c.MustGet(helper.ContextUserID).(string) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "admins cannot perform this action on their own account",
+		})
+		return db.User{}, false
+	}
+	return findUserOrAbort(c)
+}
+
+// findUserOrAbort finds the user from the path and aborts the request if there is none.
+func findUserOrAbort(c *gin.Context) (db.User, bool) {
+	userID := c.Param("userid")
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		if err == db.ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{Message: "user not found"})
+			return db.User{}, false
+		}
+		log.Printf("failed to get user by ID '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return db.User{}, false
+	}
+	return user, true
+}
@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Actions recorded in the audit log.
+const (
+	ActionProfileUpdate       = "profile.update"
+	ActionAccountExport       = "account.export"
+	ActionAccountDelete       = "account.delete"
+	ActionPhotoUpload         = "photo.upload"
+	ActionPhotoDelete         = "photo.delete"
+	ActionFileUpload          = "file.upload"
+	ActionFileDelete          = "file.delete"
+	ActionAPIKeyCreate        = "apiKey.create"
+	ActionAPIKeyDelete        = "apiKey.delete"
+	ActionTOTPEnable          = "totp.enable"
+	ActionTOTPDisable         = "totp.disable"
+	ActionWebAuthnRegister    = "webAuthn.register"
+	ActionWebAuthnDelete      = "webAuthn.delete"
+	ActionIdentityLink        = "identity.link"
+	ActionIdentityUnlink      = "identity.unlink"
+	ActionOrgCreate           = "org.create"
+	ActionOrgUpdate           = "org.update"
+	ActionOrgDelete           = "org.delete"
+	ActionOrgMemberUpdate     = "org.memberUpdate"
+	ActionOrgMemberRemove     = "org.memberRemove"
+	ActionOrgInvite           = "org.invite"
+	ActionOrgInviteResend     = "org.inviteResend"
+	ActionOrgInviteRevoke     = "org.inviteRevoke"
+	ActionOrgInviteAccept     = "org.inviteAccept"
+	ActionRoleAssign          = "role.assign"
+	ActionRoleUnassign        = "role.unassign"
+	ActionAdminAccessLevel    = "admin.accessLevel"
+	ActionAdminStorageQuota   = "admin.storageQuota"
+	ActionAdminDisable        = "admin.disable"
+	ActionAdminEnable         = "admin.enable"
+	ActionAdminRevokeSessions = "admin.revokeSessions"
+	ActionAdminDelete         = "admin.delete"
+	ActionAdminImpersonate    = "admin.impersonate"
+)
+
+// Middleware returns a middleware that records the action in the audit log
+// if the next handlers succeed.
+// The action is recorded for the user from 'userid' path parameter if there is one,
+// otherwise for the authenticated user.
+// It must be used after the authentication check.
+func Middleware(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if c.IsAborted() || c.Writer.Status() >= http.StatusBadRequest {
+			return
+		}
+		userID := c.Param("userid")
+		if len(userID) == 0 {
+			userID = c.MustGet(helper.ContextUserID).(string)
+		}
+		Record(c, action, userID)
+	}
+}
+
+// Record records the action performed on the user's account by the authenticated user.
+// The impersonating admin and the API key are recorded as well.
+// Failures are logged and do not affect the request.
+func Record(c *gin.Context, action, userID string) {
+	entry := db.AuditEntry{
+		ID:             uuid.NewString(),
+		UserID:         userID,
+		Action:         action,
+		ActorID:        c.GetString(helper.ContextUserID),
+		ImpersonatorID: c.GetString(helper.ContextImpersonatorID),
+		APIKeyID:       c.GetString(helper.ContextAPIKeyID),
+		IPAddress:      c.ClientIP(),
+		CreatedAt:      time.Now().UTC(),
+	}
+
+	if len(entry.ImpersonatorID) > 0 {
+		log.Printf(
+			"audit: '%s' on user '%s' by '%s' impersonated by '%s'\n",
+			entry.Action, entry.UserID, entry.ActorID, entry.ImpersonatorID,
+		)
+	} else {
+		log.Printf("audit: '%s' on user '%s' by '%s'\n", entry.Action, entry.UserID, entry.ActorID)
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	if err := database.CreateAuditEntry(&entry); err != nil {
+		log.Printf("failed to create audit entry '%s' for user '%s': %s\n", action, userID, err.Error())
+	}
+}
+
+// HandleGetAuditLog returns the audit log of the user from 'userid' path parameter.
+func HandleGetAuditLog(c *gin.Context) {
+	userID := c.Param("userid")
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	entries, err := database.GetAuditEntries(userID)
+	if err != nil {
+		log.Printf("failed to get audit entries of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
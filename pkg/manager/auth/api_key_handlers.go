@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	apiKeyPrefix = "bbk_"
+	// apiKeyDisplayLength is the length of the beginning of the key stored as the key prefix.
+	apiKeyDisplayLength = len(apiKeyPrefix) + 8
+	// apiKeyLastUsedPrecision limits how often the last usage time is written to the database.
+	apiKeyLastUsedPrecision = time.Minute
+)
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name" binding:"required,max=100"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// apiKeyResponse is the API key without the hash.
+type apiKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	// Key is only returned once when the key is created.
+	Key string `json:"key,omitempty"`
+}
+
+// HandleAPIKeys returns the API keys of the authenticated user.
+func HandleAPIKeys(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	keys, err := database.GetAPIKeys(userID)
+	if err != nil {
+		log.Printf("failed to get API keys of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]apiKeyResponse, len(keys))
+	for i := range keys {
+		response[i] = newAPIKeyResponse(keys[i])
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// HandleCreateAPIKey creates a new API key for the authenticated user.
+// The key is only returned in this response.
+func HandleCreateAPIKey(c *gin.Context) {
+	// Keys can only be managed from an interactive session.
+	if _, ok := c.Get(helper.ContextAPIKeyID); ok {
+		c.AbortWithStatusJSON(http.StatusForbidden, helper.HTTPMessage{
+			Message: "API keys cannot be created with an API key",
+		})
+		return
+	}
+
+	var req createAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "'expiresAt' must be in the future",
+		})
+		return
+	}
+	// Keys cannot have more privileges than the session that creates them.
+	scopes := c.GetStringSlice(helper.ContextScopes)
+	if len(req.Scopes) > 0 {
+		var err error
+		if scopes, err = restrictScopes(scopes, req.Scopes); err != nil {
+			abortInvalidScope(c, err)
+			return
+		}
+	}
+
+	rawKey, err := generateAPIKey()
+	if err != nil {
+		log.Println("failed to generate API key:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	key := db.APIKey{
+		ID:        uuid.NewString(),
+		UserID:    c.MustGet(helper.ContextUserID).(string),
+		Name:      req.Name,
+		Prefix:    rawKey[:apiKeyDisplayLength],
+		Hash:      helper.HashToken(rawKey),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: req.ExpiresAt,
+	}
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	if err = database.CreateAPIKey(&key); err != nil {
+		log.Printf("failed to create API key for user '%s': %s\n", key.UserID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := newAPIKeyResponse(key)
+	response.Key = rawKey
+	c.JSON(http.StatusCreated, response)
+}
+
+// HandleDeleteAPIKey revokes an API key of the authenticated user.
+func HandleDeleteAPIKey(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	err := database.DeleteAPIKey(userID, c.Param("keyid"))
+	if err != nil {
+		if err == db.ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{Message: "API key not found"})
+			return
+		}
+		log.Printf("failed to delete API key of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// checkAPIKeyAuthentication authenticates the request with the API key
+// from 'Authorization: Bearer <key>' header.
+func checkAPIKeyAuthentication(c *gin.Context, authorization string) {
+	scheme, rawKey, _ := strings.Cut(authorization, " ")
+	if !strings.EqualFold(scheme, "Bearer") || !strings.HasPrefix(rawKey, apiKeyPrefix) {
+		c.AbortWithStatusJSON(
+			http.StatusUnauthorized,
+			helper.HTTPMessage{Message: "invalid 'Authorization' header"},
+		)
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	key, err := database.GetAPIKeyByHash(helper.HashToken(rawKey))
+	if err != nil {
+		if err != db.ErrNotFound {
+			log.Println("failed to get API key by hash:", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			helper.HTTPMessage{Message: "no access"},
+		)
+		return
+	}
+	now := time.Now().UTC()
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(now) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			helper.HTTPMessage{Message: "API key has expired"},
+		)
+		return
+	}
+
+	// The access level is read from the database, so the changes apply immediately.
+	user, err := database.GetUserByID(key.UserID)
+	if err != nil {
+		// The keys of the deleted users are no longer valid.
+		if err == db.ErrNotFound {
+			c.AbortWithStatusJSON(
+				http.StatusUnauthorized,
+				helper.HTTPMessage{Message: "invalid API key"},
+			)
+			return
+		}
+		log.Printf("failed to get user by ID '%s': %s\n", key.UserID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err = userStatusError(user.Status); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			helper.HTTPMessage{Message: err.Error()},
+		)
+		return
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyLastUsedPrecision {
+		if err = database.UpdateAPIKeyLastUsedAt(key.ID, now); err != nil {
+			log.Printf("failed to update API key '%s' last usage: %s\n", key.ID, err.Error())
+		}
+	}
+
+	// The scopes of the key are limited to the current access level of the user.
+	// Keys created before the scopes were introduced have no scopes and get all of them.
+	allowedScopes := c.MustGet(helper.ContextScopesConfig).(ScopesConfig)[user.AccessLevel]
+	scopes := allowedScopes
+	if len(key.Scopes) > 0 {
+		scopes = intersectScopes(key.Scopes, allowedScopes)
+	}
+
+	// Store the relevant information in the context for other handlers to use.
+	c.Set(helper.ContextAPIKeyID, key.ID)
+	c.Set(helper.ContextUserID, user.ID)
+	c.Set(helper.ContextUserAccessLevel, user.AccessLevel)
+	c.Set(helper.ContextScopes, scopes)
+
+	c.Next()
+}
+
+func generateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func newAPIKeyResponse(key db.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
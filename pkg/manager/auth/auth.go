@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -9,100 +11,418 @@ import (
 	"github.com/akyoto/cache"
 	"github.com/bazuker/backend-bootstrap/pkg/db"
 	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/orgs"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
-// HandleAuthGoogleInitiation handles the initiation of Google authentication.
+const (
+	sessionTTL = time.Hour * 24
+	// restrictedSessionTTL is the TTL of the sessions awaiting the second factor.
+	restrictedSessionTTL = time.Minute * 15
+	// impersonationSessionTTL is the TTL of the sessions of admins impersonating users.
+	impersonationSessionTTL = time.Minute * 15
+)
+
+// HandleAuthInitiation handles the initiation of authentication with the provider from the path.
 // "redirect_url" must be passed via query to redirect users after authentication is complete.
-func HandleAuthGoogleInitiation(c *gin.Context) {
-	redirectURL := c.Query("redirect_url")
-	if len(redirectURL) == 0 {
-		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
-			Message: "'redirect_url' is missing in the request",
-		})
+// It must match the allow-list of RedirectConfig.
+// "scope" may be passed via query to request a session with reduced privileges.
+// "code_challenge" may be passed via query to receive a one-time code protected by PKCE instead of the access token.
+func HandleAuthInitiation(c *gin.Context) {
+	redirectURL, ok := redirectURLOrAbort(c)
+	if !ok {
+		return
+	}
+	scopes, ok := requestedScopesOrAbort(c, ParseScopes(c.Query("scope")))
+	if !ok {
+		return
+	}
+	codeChallenge, ok := codeChallengeOrAbort(c)
+	if !ok {
 		return
 	}
 
-	state := oauthGoogleLogin(c.Writer, c.Request)
+	providers := c.MustGet(helper.ContextAuthProviders).(Providers)
+	provider, err := providers.Get(c.Param("provider"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{
+			Message: err.Error(),
+		})
+		return
+	}
 
-	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
-	sessionCache.Set(state, redirectURL, time.Hour)
+	u := oauthLogin(c, provider, oauthState{
+		Provider:      provider.Name(),
+		RedirectURL:   redirectURL,
+		Scopes:        scopes,
+		CodeChallenge: codeChallenge,
+	})
+	http.Redirect(c.Writer, c.Request, u, http.StatusTemporaryRedirect)
 }
 
-// HandleAuthGoogleCallback handles the callback from Google and if successful, redirects the user to 'redirect_url'
+// HandleAuthCallback handles the callback from the provider and if successful, redirects the user to 'redirect_url'
+// The state must match the cookie set at the initiation and can only be used once within ten minutes.
 // An 'access_token' will be added to the query of the 'redirect_url'.
-func HandleAuthGoogleCallback(c *gin.Context) {
-	googleUser, state, err := oauthGoogleCallback(c.Writer, c.Request)
+// Users that are not active are rejected.
+func HandleAuthCallback(c *gin.Context) {
+	oauthStateData, err := consumeOAuthState(c)
+	if err != nil {
+		log.Println("failed to process auth callback:", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: ErrInvalidOAuthState.Error()})
+		return
+	}
+
+	if oauthStateData.Provider != c.Param("provider") {
+		log.Println("auth callback provider does not match the state provider", oauthStateData.Provider)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	providers := c.MustGet(helper.ContextAuthProviders).(Providers)
+	provider, err := providers.Get(oauthStateData.Provider)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	userInfo, err := oauthCallback(c.Request, provider, oauthStateData)
 	if err != nil {
-		log.Println("failed to process google auth callback:", err)
+		log.Printf("failed to process %s auth callback: %s\n", provider.Name(), err.Error())
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	if len(oauthStateData.LinkUserID) > 0 {
+		linkUserIdentity(c, provider.Name(), userInfo, oauthStateData)
+		return
+	}
+	// Users are matched by email, so it must be confirmed by the provider.
+	if !userInfo.VerifiedEmail {
+		c.AbortWithStatusJSON(http.StatusForbidden, helper.HTTPMessage{
+			Message: "email is not verified by the identity provider",
+		})
+		return
+	}
 
 	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
-	// Try to find the user by email/
-	user, err := database.GetUserByEmail(googleUser.Email)
+	user, err := findOrCreateProviderUser(database, provider.Name(), userInfo)
 	if err != nil {
-		if err != db.ErrNotFound {
-			// Something went wrong.
-			log.Println("failed to get user by email:", err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+		if errors.Is(err, ErrUnverifiedAccount) {
+			abortUnverifiedAccount(c)
 			return
 		}
+		log.Println("failed to find or create user:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if user.IsActive() {
+		user = syncProfile(c, user, userInfo)
+	}
+	acceptInvitations(database, user)
 
-		user = db.User{
-			ID:            uuid.NewString(),
-			FirstName:     googleUser.GivenName,
-			LastName:      googleUser.FamilyName,
-			Email:         googleUser.Email,
-			VerifiedEmail: true, // Verified because this is Google SSO.
-			AccessLevel:   db.AccessLevelBasic,
-		}
+	redirectWithSession(c, user, oauthStateData.RedirectURL, oauthStateData.Scopes, oauthStateData.CodeChallenge)
+}
 
-		err = database.CreateUser(&user)
+// findOrCreateProviderUser finds the user by the provider's subject, then by email, or creates a new one.
+// The identity is linked to the user found by email or created, so the email is only matched once.
+// The email must already be verified.
+func findOrCreateProviderUser(database db.Adapter, provider string, userInfo UserInfo) (db.User, error) {
+	if len(userInfo.Subject) == 0 {
+		return db.User{}, errors.New("subject is missing in the user info")
+	}
+	identity, err := database.GetUserIdentity(provider, userInfo.Subject)
+	if err == nil {
+		user, err := database.GetUserByID(identity.UserID)
 		if err != nil {
-			log.Println("failed to create user:", err)
-			return
+			return db.User{}, fmt.Errorf("failed to get user of identity '%s': %w", identity.ID, err)
 		}
+		return user, nil
+	}
+	if err != db.ErrNotFound {
+		return db.User{}, fmt.Errorf("failed to get identity: %w", err)
+	}
 
-		log.Printf("created a new user with ID '%s'\n", user.ID)
+	user, err := findOrCreateUser(database, userInfo)
+	if err != nil {
+		return db.User{}, err
+	}
+	err = database.CreateUserIdentity(&db.UserIdentity{
+		ID:        db.UserIdentityID(provider, userInfo.Subject),
+		UserID:    user.ID,
+		Provider:  provider,
+		Subject:   userInfo.Subject,
+		Email:     userInfo.Email,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil && err != db.ErrAlreadyExists {
+		return db.User{}, fmt.Errorf("failed to create identity: %w", err)
 	}
 
-	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
-	redirectURL, ok := sessionCache.Get(state)
-	if !ok {
-		log.Println("failed to get state from the cache", state, "is missing")
-		c.AbortWithStatus(http.StatusInternalServerError)
+	log.Printf("linked %s identity to user '%s'\n", provider, user.ID)
+
+	return user, nil
+}
+
+// ErrUnverifiedAccount is returned when a sign in matches an account by email
+// that has not verified the email yet.
+var ErrUnverifiedAccount = errors.New("an account with the email exists, but the email is not verified")
+
+// findOrCreateUser finds the user by email or creates a new one.
+// The email must already be verified.
+// Accounts that have not verified the email are never matched, so that an account registered
+// with somebody else's email cannot take over their later sign ins. ErrUnverifiedAccount is returned instead.
+func findOrCreateUser(database db.Adapter, userInfo UserInfo) (db.User, error) {
+	// Try to find the user by email.
+	user, err := database.GetUserByEmail(userInfo.Email)
+	if err == nil {
+		if !user.VerifiedEmail {
+			return db.User{}, ErrUnverifiedAccount
+		}
+		return user, nil
+	}
+	if err != db.ErrNotFound {
+		// Something went wrong.
+		return db.User{}, fmt.Errorf("failed to get user by email: %w", err)
+	}
+
+	user = db.User{
+		ID:            uuid.NewString(),
+		FirstName:     userInfo.GivenName,
+		LastName:      userInfo.FamilyName,
+		Email:         userInfo.Email,
+		VerifiedEmail: true, // Verified by the identity provider or the email link.
+		AccessLevel:   db.AccessLevelBasic,
+		Status:        db.UserStatusActive,
+	}
+	if err = database.CreateUser(&user); err != nil {
+		return db.User{}, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	log.Printf("created a new user with ID '%s'\n", user.ID)
+
+	return user, nil
+}
+
+// acceptInvitations joins the organizations the verified email of the signed in user is invited to.
+// The sign in goes on even if the invitations cannot be accepted.
+func acceptInvitations(database db.Adapter, user db.User) {
+	if !user.VerifiedEmail || !user.IsActive() {
 		return
 	}
-	sessionCache.Delete(state)
+	if err := orgs.AcceptInvitationsByEmail(database, user); err != nil {
+		log.Printf("failed to accept invitations of user '%s': %s\n", user.ID, err.Error())
+	}
+}
 
-	redirectURLStr := redirectURL.(string)
-	u, err := url.Parse(redirectURLStr)
+// redirectStatus returns the status of the redirect after authentication.
+// The redirects after POST are followed with GET.
+func redirectStatus(c *gin.Context) int {
+	if c.Request.Method == http.MethodPost {
+		return http.StatusSeeOther
+	}
+	return http.StatusTemporaryRedirect
+}
+
+func abortUnverifiedAccount(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusConflict, helper.HTTPMessage{
+		Message: "an account with this email already exists, but its email is not verified. " +
+			"Sign in with the password and verify the email or link the account first",
+	})
+}
+
+// redirectWithSession creates a user session with the requested scopes and redirects the user to 'redirectURL'.
+// An 'access_token' will be added to the query or the fragment of the 'redirectURL' depending on RedirectConfig,
+// or set in the session cookie if cookie sessions are enabled.
+// If the session awaits the second factor, 'two_factor' will be added as well.
+// A one-time 'code' will be added to the query instead if RedirectConfig requires it or 'codeChallenge' is set.
+func redirectWithSession(c *gin.Context, user db.User, redirectURL string, scopes []string, codeChallenge string) {
+	u, err := url.Parse(redirectURL)
 	if err != nil {
 		log.Println("failed to parse redirect_url:", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	// Generate an access token.
-	accessToken := helper.GenerateRandomString(32)
-	query := u.Query()
-	query.Set("access_token", accessToken)
-	u.RawQuery = query.Encode()
+	redirectConfig := c.MustGet(helper.ContextRedirectConfig).(RedirectConfig)
+	if len(codeChallenge) > 0 || redirectConfig.TokenDelivery == TokenDeliveryCode {
+		// The session is created when the code is exchanged.
+		if err = userStatusError(user.Status); err != nil {
+			abortCreateSession(c, user.ID, err)
+			return
+		}
+		sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+		query := u.Query()
+		query.Set("code", storeAuthCode(sessionCache, authCode{
+			UserID:        user.ID,
+			Scopes:        scopes,
+			CodeChallenge: codeChallenge,
+		}))
+		u.RawQuery = query.Encode()
+		http.Redirect(c.Writer, c.Request, u.String(), redirectStatus(c))
+		return
+	}
+
 	// Create a user session.
+	accessToken, sessionData, err := createSession(c, user, scopes)
+	if err != nil {
+		abortCreateSession(c, user.ID, err)
+		return
+	}
+	values := url.Values{}
+	sessionCookieConfig := c.MustGet(helper.ContextSessionCookieConfig).(SessionCookieConfig)
+	if sessionCookieConfig.Enabled {
+		// The access token is only delivered in the cookie.
+		setSessionCookies(c, accessToken, sessionData)
+	} else {
+		values.Set("access_token", accessToken)
+	}
+	if twoFactor := twoFactorStatus(sessionData); len(twoFactor) > 0 {
+		values.Set("two_factor", twoFactor)
+	}
+	switch {
+	case len(values) == 0:
+	case redirectConfig.TokenDelivery == TokenDeliveryFragment:
+		// The fragment is already encoded.
+		u.RawFragment = values.Encode()
+		u.Fragment, _ = url.PathUnescape(u.RawFragment)
+	default:
+		query := u.Query()
+		for key := range values {
+			query.Set(key, values.Get(key))
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	http.Redirect(c.Writer, c.Request, u.String(), redirectStatus(c))
+}
+
+// respondWithSession creates a user session with the requested scopes and responds with its access token.
+func respondWithSession(c *gin.Context, status int, user db.User, scopes []string) {
+	accessToken, sessionData, err := createSession(c, user, scopes)
+	if err != nil {
+		abortCreateSession(c, user.ID, err)
+		return
+	}
+	setSessionCookies(c, accessToken, sessionData)
+	c.JSON(status, accessTokenResponse{
+		AccessToken: accessToken,
+		TwoFactor:   twoFactorStatus(sessionData),
+	})
+}
+
+// createSession generates an access token and creates a user session for it.
+// Users that are not active cannot create sessions.
+// The session is restricted until the second factor is verified if the user has enabled one,
+// or until one is enrolled if it is required for the user's access level.
+// All scopes of the user's access level are granted if none are requested.
+func createSession(c *gin.Context, user db.User, scopes []string) (string, helper.SessionData, error) {
+	if err := userStatusError(user.Status); err != nil {
+		return "", helper.SessionData{}, err
+	}
+	scopesConfig := c.MustGet(helper.ContextScopesConfig).(ScopesConfig)
+	scopes, err := scopesConfig.Grant(user.AccessLevel, scopes)
+	if err != nil {
+		return "", helper.SessionData{}, err
+	}
 	sessionData := helper.SessionData{
 		UserID:      user.ID,
 		AccessLevel: user.AccessLevel,
+		Scopes:      scopes,
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	twoFactorConfig := c.MustGet(helper.ContextTwoFactorConfig).(TwoFactorConfig)
+	credential, err := database.GetTOTPCredential(user.ID)
+	switch {
+	case err == nil && credential.Enabled:
+		sessionData.TwoFactorPending = true
+	case err != nil && err != db.ErrNotFound:
+		return "", helper.SessionData{}, fmt.Errorf("failed to get TOTP credential: %w", err)
+	case twoFactorConfig.IsRequired(user.AccessLevel):
+		sessionData.TwoFactorEnrollmentRequired = true
 	}
-	sessionCache.Set(accessToken, sessionData, time.Hour*24)
 
-	http.Redirect(c.Writer, c.Request, u.String(), http.StatusTemporaryRedirect)
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	accessToken := storeSession(sessionCache, &sessionData)
+	return accessToken, sessionData, nil
+}
+
+// CreateImpersonationSession creates a short-lived session of the user for the impersonating admin
+// and returns its access token and expiration time.
+// The session has all scopes of the user's access level and skips the second factor.
+func CreateImpersonationSession(c *gin.Context, user db.User, impersonatorID string) (string, time.Time) {
+	scopesConfig := c.MustGet(helper.ContextScopesConfig).(ScopesConfig)
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	accessToken := storeSession(sessionCache, &helper.SessionData{
+		UserID:         user.ID,
+		AccessLevel:    user.AccessLevel,
+		Scopes:         append([]string{}, scopesConfig[user.AccessLevel]...),
+		ImpersonatorID: impersonatorID,
+	})
+	return accessToken, time.Now().Add(impersonationSessionTTL)
+}
+
+// abortCreateSession aborts the request with the status matching the session creation error.
+func abortCreateSession(c *gin.Context, userID string, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidScope):
+		abortInvalidScope(c, err)
+	case errors.Is(err, ErrUserNotActive):
+		c.AbortWithStatusJSON(http.StatusForbidden, helper.HTTPMessage{Message: err.Error()})
+	default:
+		log.Printf("failed to create session for user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
 }
 
+// storeSession generates an access token and a CSRF token and stores the session data for them.
+func storeSession(sessionCache *cache.Cache, sessionData *helper.SessionData) string {
+	accessToken := helper.GenerateRandomString(32)
+	sessionData.CSRFToken = helper.GenerateRandomString(32)
+	sessionCache.Set(accessToken, *sessionData, sessionDataTTL(*sessionData))
+	return accessToken
+}
+
+// sessionDataTTL returns the TTL of the session.
+func sessionDataTTL(sessionData helper.SessionData) time.Duration {
+	if len(sessionData.ImpersonatorID) > 0 {
+		return impersonationSessionTTL
+	}
+	if sessionData.TwoFactorPending || sessionData.TwoFactorEnrollmentRequired {
+		return restrictedSessionTTL
+	}
+	return sessionTTL
+}
+
+// RevokeUserSessions deletes all sessions of the user from the session cache.
+func RevokeUserSessions(sessionCache *cache.Cache, userID string) {
+	for accessToken := range helper.UserSessions(sessionCache, userID) {
+		sessionCache.Delete(accessToken)
+	}
+}
+
+// CheckAuthenticationMiddleware verifies that the user is authenticated
+// with either a session in 'Access-Token' header or an API key in 'Authorization' header.
+// The session cookie is accepted instead of 'Access-Token' header if cookie sessions are enabled.
 func CheckAuthenticationMiddleware(c *gin.Context) {
-	accessToken := c.GetHeader("Access-Token")
+	checkAuthentication(c, false)
+}
+
+// CheckTwoFactorEnrollmentMiddleware verifies that the user is authenticated
+// and also accepts the sessions restricted to the second factor enrollment.
+func CheckTwoFactorEnrollmentMiddleware(c *gin.Context) {
+	checkAuthentication(c, true)
+}
+
+func checkAuthentication(c *gin.Context, allowEnrollment bool) {
+	// Machine access with a personal API key.
+	if authorization := c.GetHeader("Authorization"); len(authorization) > 0 {
+		checkAPIKeyAuthentication(c, authorization)
+		return
+	}
+
+	accessToken, _ := requestAccessToken(c)
 	if len(accessToken) == 0 {
 		c.AbortWithStatusJSON(
 			http.StatusUnauthorized,
@@ -123,9 +443,69 @@ func CheckAuthenticationMiddleware(c *gin.Context) {
 	}
 	sessionData := session.(helper.SessionData)
 
+	// Suspended users are locked out even if their session is still cached.
+	if err := checkUserStatus(c, sessionData.UserID); err != nil {
+		if !errors.Is(err, ErrUserNotActive) {
+			log.Printf("failed to check status of user '%s': %s\n", sessionData.UserID, err.Error())
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		sessionCache.Delete(accessToken)
+		c.AbortWithStatusJSON(http.StatusForbidden, helper.HTTPMessage{Message: err.Error()})
+		return
+	}
+
+	if sessionData.TwoFactorPending {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			helper.HTTPMessage{Message: "two-factor authentication is required"},
+		)
+		return
+	}
+	if sessionData.TwoFactorEnrollmentRequired && !allowEnrollment {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			helper.HTTPMessage{Message: "two-factor authentication enrollment is required"},
+		)
+		return
+	}
+
 	// Store the relevant information in the context for other handlers to use.
+	c.Set(helper.ContextAccessToken, accessToken)
 	c.Set(helper.ContextUserID, sessionData.UserID)
 	c.Set(helper.ContextUserAccessLevel, sessionData.AccessLevel)
+	c.Set(helper.ContextScopes, sessionData.Scopes)
+	if len(sessionData.ImpersonatorID) > 0 {
+		c.Set(helper.ContextImpersonatorID, sessionData.ImpersonatorID)
+	}
 
 	c.Next()
 }
+
+// RejectImpersonationMiddleware blocks the sensitive actions, e.g. managing credentials,
+// for the sessions of admins impersonating users.
+// It must be used after the authentication check.
+func RejectImpersonationMiddleware(c *gin.Context) {
+	if _, ok := c.Get(helper.ContextImpersonatorID); ok {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			helper.HTTPMessage{Message: "the action is not allowed while impersonating a user"},
+		)
+		return
+	}
+	c.Next()
+}
+
+// requestedScopesOrAbort validates the requested scopes and aborts the request if any of them is unknown.
+func requestedScopesOrAbort(c *gin.Context, scopes []string) ([]string, bool) {
+	scopesConfig := c.MustGet(helper.ContextScopesConfig).(ScopesConfig)
+	if err := scopesConfig.Validate(scopes); err != nil {
+		abortInvalidScope(c, err)
+		return nil, false
+	}
+	return scopes, true
+}
+
+func abortInvalidScope(c *gin.Context, err error) {
+	c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: err.Error()})
+}
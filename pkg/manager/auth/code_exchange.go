@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// authCodeTTL is how long the one-time code can be exchanged for a session.
+	authCodeTTL = time.Minute
+	// authCodeCacheKeyPrefix prefixes the codes in the session cache.
+	authCodeCacheKeyPrefix = "auth-code:"
+	// codeChallengeMethodS256 is the only supported PKCE method.
+	codeChallengeMethodS256 = "S256"
+)
+
+// codeChallengePattern matches base64url encoded SHA-256 hashes.
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// authCodesMx makes sure that a code is exchanged only once.
+var authCodesMx sync.Mutex
+
+// authCode is the information stored in the session cache
+// between the redirect with the code and the exchange.
+type authCode struct {
+	UserID string
+	Scopes []string
+	// CodeChallenge is the PKCE challenge the code verifier must match.
+	CodeChallenge string
+}
+
+type tokenExchangeRequest struct {
+	Code         string `json:"code" binding:"required"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+// HandleTokenExchange exchanges a one-time code from the redirect after authentication for a session.
+// The 'code_verifier' is required if 'code_challenge' was passed at the initiation.
+func HandleTokenExchange(c *gin.Context) {
+	var req tokenExchangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	code, ok := consumeAuthCode(sessionCache, req.Code)
+	if !ok || !verifyCodeChallenge(code.CodeChallenge, req.CodeVerifier) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: "invalid code"})
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	user, err := database.GetUserByID(code.UserID)
+	if err != nil {
+		log.Printf("failed to get user by ID '%s': %s\n", code.UserID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithSession(c, http.StatusOK, user, code.Scopes)
+}
+
+// storeAuthCode generates a one-time code and stores the information for it.
+func storeAuthCode(sessionCache *cache.Cache, code authCode) string {
+	rawCode := helper.GenerateRandomString(32)
+	sessionCache.Set(authCodeCacheKeyPrefix+rawCode, code, authCodeTTL)
+	return rawCode
+}
+
+// consumeAuthCode finds the code and deletes it, so it cannot be used again.
+func consumeAuthCode(sessionCache *cache.Cache, rawCode string) (authCode, bool) {
+	authCodesMx.Lock()
+	defer authCodesMx.Unlock()
+
+	code, ok := sessionCache.Get(authCodeCacheKeyPrefix + rawCode)
+	if !ok {
+		return authCode{}, false
+	}
+	sessionCache.Delete(authCodeCacheKeyPrefix + rawCode)
+	return code.(authCode), true
+}
+
+// verifyCodeChallenge returns true if there is no challenge
+// or the verifier matches the S256 challenge.
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if len(challenge) == 0 {
+		return true
+	}
+	hash := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// codeChallengeOrAbort returns the optional PKCE 'code_challenge' from the query
+// and aborts the request if it is invalid.
+// Only 'S256' method is supported and it is assumed if 'code_challenge_method' is omitted.
+func codeChallengeOrAbort(c *gin.Context) (string, bool) {
+	challenge := c.Query("code_challenge")
+	if len(challenge) == 0 {
+		return "", true
+	}
+	if method := c.Query("code_challenge_method"); len(method) > 0 && method != codeChallengeMethodS256 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "'code_challenge_method' must be 'S256'",
+		})
+		return "", false
+	}
+	if !codeChallengePattern.MatchString(challenge) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "'code_challenge' must be a base64url encoded SHA-256 hash",
+		})
+		return "", false
+	}
+	return challenge, true
+}
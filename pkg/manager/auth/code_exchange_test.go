@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// testCodeChallenge returns the S256 challenge of the verifier.
+func testCodeChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func newCodeExchangeTestRouter(database db.Adapter, sessionCache *cache.Cache) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set(helper.ContextDatabase, database)
+		c.Set(helper.ContextCache, sessionCache)
+		c.Set(helper.ContextSessionCookieConfig, SessionCookieConfig{Path: "/"})
+		c.Set(helper.ContextScopesConfig, DefaultScopes)
+		c.Set(helper.ContextTwoFactorConfig, TwoFactorConfig{})
+	})
+	r.POST("/token", HandleTokenExchange)
+	r.GET("/challenge", func(c *gin.Context) {
+		if challenge, ok := codeChallengeOrAbort(c); ok {
+			c.String(http.StatusOK, challenge)
+		}
+	})
+	return r
+}
+
+func TestHandleTokenExchange(t *testing.T) {
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	tests := []struct {
+		name      string
+		challenge string
+		verifier  string
+		status    int
+	}{
+		{
+			name:     "no challenge",
+			verifier: verifier,
+			status:   http.StatusOK,
+		},
+		{
+			name:      "matching verifier",
+			challenge: testCodeChallenge(verifier),
+			verifier:  verifier,
+			status:    http.StatusOK,
+		},
+		{
+			name:      "RFC 7636 test vector",
+			challenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+			verifier:  verifier,
+			status:    http.StatusOK,
+		},
+		{
+			name:      "wrong verifier",
+			challenge: testCodeChallenge(verifier),
+			verifier:  verifier + "x",
+			status:    http.StatusBadRequest,
+		},
+		{
+			name:      "missing verifier",
+			challenge: testCodeChallenge(verifier),
+			status:    http.StatusBadRequest,
+		},
+		{
+			name:      "challenge as the verifier",
+			challenge: testCodeChallenge(verifier),
+			verifier:  testCodeChallenge(verifier),
+			status:    http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database := newTestDB(t)
+			user := createTestUser(t, database)
+			sessionCache := cache.New(time.Minute)
+			r := newCodeExchangeTestRouter(database, sessionCache)
+			code := storeAuthCode(sessionCache, authCode{UserID: user.ID, CodeChallenge: test.challenge})
+
+			req := map[string]string{"code": code, "code_verifier": test.verifier}
+			w := postJSON(r, "/token", req)
+			if w.Code != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, w.Code, w.Body)
+			}
+
+			// The code is single-use, even if the verifier was wrong.
+			if w = postJSON(r, "/token", req); w.Code != http.StatusBadRequest {
+				t.Errorf("expected 400 on reuse, got %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestHandleTokenExchangeUnknownCode(t *testing.T) {
+	r := newCodeExchangeTestRouter(newTestDB(t), cache.New(time.Minute))
+	if w := postJSON(r, "/token", map[string]string{"code": "unknown"}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCodeChallengeOrAbort(t *testing.T) {
+	challenge := testCodeChallenge("verifier")
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		body   string
+	}{
+		{
+			name:   "no challenge",
+			status: http.StatusOK,
+		},
+		{
+			name:   "S256 challenge",
+			query:  "code_challenge=" + challenge + "&code_challenge_method=S256",
+			status: http.StatusOK,
+			body:   challenge,
+		},
+		{
+			name:   "method omitted",
+			query:  "code_challenge=" + challenge,
+			status: http.StatusOK,
+			body:   challenge,
+		},
+		{
+			name:   "plain method",
+			query:  "code_challenge=" + challenge + "&code_challenge_method=plain",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "too short",
+			query:  "code_challenge=" + challenge[:42],
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "not base64url",
+			query:  "code_challenge=" + strings.Repeat("+", 43),
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newCodeExchangeTestRouter(newTestDB(t), cache.New(time.Minute))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/challenge?"+test.query, nil))
+			if w.Code != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, w.Code, w.Body)
+			}
+			if test.status == http.StatusOK && w.Body.String() != test.body {
+				t.Errorf("expected '%s', got '%s'", test.body, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/mailer"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// emailCooldown is how long an address waits for the next link of the same purpose,
+	// so that the sign-in and the password reset links cannot be used to flood the inbox.
+	emailCooldown = time.Minute
+
+	emailCooldownCacheKeyPrefix = "email-cooldown:"
+)
+
+// EmailConfig is the configuration of the links sent by email.
+// The token is added to the query of the URLs as 'token'.
+type EmailConfig struct {
+	// VerifyEmailURL is the URL of the frontend page that confirms the email,
+	// e.g. https://example.com/verify-email
+	VerifyEmailURL string
+	// ResetPasswordURL is the URL of the frontend page that sets a new password,
+	// e.g. https://example.com/reset-password
+	ResetPasswordURL string
+	// VerifyEmailTTL is how long an email verification link is valid.
+	VerifyEmailTTL time.Duration
+	// ResetPasswordTTL is how long a password reset link is valid.
+	ResetPasswordTTL time.Duration
+	// MagicLinkURL is the URL of the magic link confirmation page,
+	// e.g. https://example.com/api/v1/auth/magic-link/callback
+	// The token is only used up when the page is submitted with POST.
+	MagicLinkURL string
+	// MagicLinkTTL is how long a magic link is valid.
+	MagicLinkTTL time.Duration
+}
+
+type tokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// HandleSendEmailVerification sends an email verification link to the authenticated user.
+func HandleSendEmailVerification(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("failed to get user by ID '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			helper.HTTPMessage{Message: "failed to get user"},
+		)
+		return
+	}
+	if user.VerifiedEmail {
+		c.JSON(http.StatusOK, helper.HTTPMessage{Message: "email is already verified"})
+		return
+	}
+
+	emailConfig := c.MustGet(helper.ContextEmailConfig).(EmailConfig)
+	err = sendTokenEmail(
+		c,
+		db.Token{
+			Purpose: db.TokenPurposeEmailVerification,
+			UserID:  user.ID,
+			Email:   user.Email,
+		},
+		emailConfig.VerifyEmailURL,
+		emailConfig.VerifyEmailTTL,
+		"Verify your email",
+		"Follow the link to verify your email:\n\n%s\n\nThe link expires in %s.\n",
+	)
+	if err != nil {
+		log.Printf("failed to send email verification to user '%s': %s\n", user.ID, err.Error())
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			helper.HTTPMessage{Message: "failed to send email verification"},
+		)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// HandleConfirmEmailVerification verifies user's email with the token from the verification link.
+func HandleConfirmEmailVerification(c *gin.Context) {
+	var req tokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	token, ok := consumeTokenOrAbort(c, database, db.TokenPurposeEmailVerification, req.Token)
+	if !ok {
+		return
+	}
+
+	// The email could have changed since the link was sent.
+	user, err := database.GetUserByID(token.UserID)
+	if err != nil {
+		log.Printf("failed to get user by ID '%s': %s\n", token.UserID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if db.NormalizeEmail(user.Email) != db.NormalizeEmail(token.Email) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: ErrInvalidToken.Error()})
+		return
+	}
+
+	if err = database.UpdateUserVerifiedEmail(user.ID, true); err != nil {
+		log.Printf("failed to update user '%s' verified email: %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// HandleForgotPassword sends a password reset link to the email.
+// The response is the same whether the user exists or not.
+func HandleForgotPassword(c *gin.Context) {
+	var req forgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+	req.Email = db.NormalizeEmail(req.Email)
+	// The unknown emails are counted as well, so that the response does not reveal whether the user exists.
+	if !countEmail(c, db.TokenPurposePasswordReset, req.Email) {
+		abortEmailCooldown(c)
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	user, err := database.GetUserByEmail(req.Email)
+	if err != nil {
+		if err != db.ErrNotFound {
+			log.Println("failed to get user by email:", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+		return
+	}
+
+	emailConfig := c.MustGet(helper.ContextEmailConfig).(EmailConfig)
+	err = sendTokenEmail(
+		c,
+		db.Token{
+			Purpose: db.TokenPurposePasswordReset,
+			UserID:  user.ID,
+			Email:   user.Email,
+		},
+		emailConfig.ResetPasswordURL,
+		emailConfig.ResetPasswordTTL,
+		"Reset your password",
+		"Follow the link to set a new password:\n\n%s\n\nThe link expires in %s. "+
+			"If you did not request a password reset, you can ignore this email.\n",
+	)
+	if err != nil {
+		log.Printf("failed to send password reset to user '%s': %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// HandleResetPassword sets a new password with the token from the password reset link.
+// The token is only used up once the new password is accepted. All sessions of the user are revoked.
+func HandleResetPassword(c *gin.Context) {
+	var req resetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	passwordConfig := c.MustGet(helper.ContextPasswordConfig).(PasswordConfig)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	token, ok := findTokenOrAbort(c, database, db.TokenPurposePasswordReset, req.Token)
+	if !ok {
+		return
+	}
+
+	// The link is only valid for the email it was sent to.
+	user, err := database.GetUserByID(token.UserID)
+	if err != nil {
+		if err == db.ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: ErrInvalidToken.Error()})
+			return
+		}
+		log.Printf("failed to get user by ID '%s': %s\n", token.UserID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if db.NormalizeEmail(user.Email) != db.NormalizeEmail(token.Email) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: ErrInvalidToken.Error()})
+		return
+	}
+	if err = passwordConfig.Policy.Validate(req.Password, token.Email); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	hash, err := HashPassword(req.Password, passwordConfig.Hashing)
+	if err != nil {
+		log.Println("failed to hash password:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, ok = consumeTokenOrAbort(c, database, db.TokenPurposePasswordReset, req.Token); !ok {
+		return
+	}
+	err = database.PutPasswordCredential(&db.PasswordCredential{
+		UserID:    token.UserID,
+		Hash:      hash,
+		UpdatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("failed to update password credential of user '%s': %s\n", token.UserID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	RevokeUserSessions(sessionCache, token.UserID)
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// sendTokenEmail issues a token out of the template and emails the link with the token to the token email.
+// The body format receives the link and the TTL.
+func sendTokenEmail(
+	c *gin.Context,
+	token db.Token,
+	linkURL string,
+	ttl time.Duration,
+	subject, bodyFormat string,
+) error {
+	u, err := url.Parse(linkURL)
+	if err != nil {
+		return fmt.Errorf("invalid link URL: %w", err)
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	rawToken, err := issueToken(database, token, ttl)
+	if err != nil {
+		return fmt.Errorf("failed to issue token: %w", err)
+	}
+	query := u.Query()
+	query.Set("token", rawToken)
+	u.RawQuery = query.Encode()
+
+	m := c.MustGet(helper.ContextMailer).(mailer.Mailer)
+	return m.Send(mailer.Message{
+		To:      token.Email,
+		Subject: subject,
+		Body:    fmt.Sprintf(bodyFormat, u.String(), ttl),
+	})
+}
+
+// countEmail counts the link of the purpose sent to the email
+// and returns false if one was sent within emailCooldown.
+func countEmail(c *gin.Context, purpose, email string) bool {
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	return helper.CountAttempt(sessionCache, emailCooldownCacheKeyPrefix+purpose+":"+email, 1, emailCooldown)
+}
+
+func abortEmailCooldown(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, helper.HTTPMessage{
+		Message: "an email was sent recently, try again later",
+	})
+}
+
+func findTokenOrAbort(c *gin.Context, database db.Adapter, purpose, rawToken string) (db.Token, bool) {
+	token, err := findToken(database, purpose, rawToken)
+	return tokenOrAbort(c, token, err)
+}
+
+func consumeTokenOrAbort(c *gin.Context, database db.Adapter, purpose, rawToken string) (db.Token, bool) {
+	token, err := consumeToken(database, purpose, rawToken)
+	return tokenOrAbort(c, token, err)
+}
+
+// tokenOrAbort responds with '400 Bad Request' if the token is invalid or expired.
+func tokenOrAbort(c *gin.Context, token db.Token, err error) (db.Token, bool) {
+	if err != nil {
+		if err == ErrInvalidToken {
+			c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: err.Error()})
+			return db.Token{}, false
+		}
+		log.Println("failed to get token:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return db.Token{}, false
+	}
+	return token, true
+}
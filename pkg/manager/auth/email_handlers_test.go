@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/mailer"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// recordingMailer keeps the sent messages instead of sending them.
+type recordingMailer struct {
+	messages []mailer.Message
+}
+
+func (m *recordingMailer) Send(message mailer.Message) error {
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+// testArgon2Params make the password hashing fast in the tests.
+var testArgon2Params = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+var linkRegexp = regexp.MustCompile(`https://\S+`)
+
+// token returns the token from the link of the last message.
+func (m *recordingMailer) token(t *testing.T) string {
+	t.Helper()
+	if len(m.messages) == 0 {
+		t.Fatal("no message was sent")
+	}
+	link, err := url.Parse(linkRegexp.FindString(m.messages[len(m.messages)-1].Body))
+	if err != nil {
+		t.Fatalf("failed to parse the link: %s", err)
+	}
+	return link.Query().Get("token")
+}
+
+// newEmailTestRouter returns a router with the email and the password handlers
+// and the authenticated user set to the user ID, if it is not empty.
+func newEmailTestRouter(database db.Adapter, m mailer.Mailer, userID string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	sessionCache := cache.New(time.Minute)
+	r.Use(func(c *gin.Context) {
+		c.Set(helper.ContextDatabase, database)
+		c.Set(helper.ContextMailer, m)
+		c.Set(helper.ContextCache, sessionCache)
+		c.Set(helper.ContextOAuthStateKey, []byte("test-key"))
+		c.Set(helper.ContextSessionCookieConfig, SessionCookieConfig{Path: "/"})
+		c.Set(helper.ContextRedirectConfig, RedirectConfig{AllowedOrigins: []string{"https://example.com"}})
+		c.Set(helper.ContextScopesConfig, DefaultScopes)
+		c.Set(helper.ContextTwoFactorConfig, TwoFactorConfig{})
+		c.Set(helper.ContextPasswordConfig, PasswordConfig{
+			Hashing: testArgon2Params,
+			Policy:  DefaultPasswordPolicy,
+		})
+		c.Set(helper.ContextEmailConfig, EmailConfig{
+			VerifyEmailURL:   "https://example.com/verify-email",
+			ResetPasswordURL: "https://example.com/reset-password",
+			MagicLinkURL:     "https://example.com/magic-link",
+			VerifyEmailTTL:   time.Hour,
+			ResetPasswordTTL: time.Hour,
+			MagicLinkTTL:     time.Hour,
+		})
+		if len(userID) > 0 {
+			c.Set(helper.ContextUserID, userID)
+		}
+	})
+	r.POST("/register", HandleAuthRegister)
+	r.POST("/login", HandleAuthLogin)
+	r.POST("/email/verification", HandleSendEmailVerification)
+	r.POST("/email/verify", HandleConfirmEmailVerification)
+	r.POST("/password/forgot", HandleForgotPassword)
+	r.POST("/password/reset", HandleResetPassword)
+	r.POST("/magic-link", HandleMagicLinkInitiation)
+	r.POST("/magic-link/callback", HandleMagicLinkCallback)
+	return r
+}
+
+func postJSON(r http.Handler, path string, body any) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data)))
+	return w
+}
+
+func createTestUser(t *testing.T, database db.Adapter) db.User {
+	t.Helper()
+	user := db.User{ID: "user", Email: "User@Example.com", Status: db.UserStatusActive}
+	if err := database.CreateUser(&user); err != nil {
+		t.Fatalf("failed to create user: %s", err)
+	}
+	return user
+}
+
+func TestPasswordReset(t *testing.T) {
+	database := newTestDB(t)
+	user := createTestUser(t, database)
+	m := &recordingMailer{}
+	r := newEmailTestRouter(database, m, "")
+
+	if w := postJSON(r, "/password/forgot", map[string]string{"email": "USER@example.COM"}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if len(m.messages) != 1 || m.messages[0].To != "user@example.com" {
+		t.Fatalf("unexpected messages %+v", m.messages)
+	}
+
+	resetRequest := map[string]string{"token": m.token(t), "password": "N3w-Str0ng-Passw0rd!"}
+	if w := postJSON(r, "/password/reset", resetRequest); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := database.GetPasswordCredential(user.ID); err != nil {
+		t.Errorf("expected the password to be set, got %v", err)
+	}
+
+	// The link is single-use.
+	if w := postJSON(r, "/password/reset", resetRequest); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 on reuse, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestPasswordResetUnknownEmail(t *testing.T) {
+	m := &recordingMailer{}
+	r := newEmailTestRouter(newTestDB(t), m, "")
+
+	// The response does not reveal whether the user exists.
+	if w := postJSON(r, "/password/forgot", map[string]string{"email": "nobody@example.com"}); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if len(m.messages) > 0 {
+		t.Errorf("expected no messages, got %+v", m.messages)
+	}
+}
+
+func TestPasswordResetWithVerificationToken(t *testing.T) {
+	database := newTestDB(t)
+	user := createTestUser(t, database)
+	m := &recordingMailer{}
+
+	if w := postJSON(newEmailTestRouter(database, m, user.ID), "/email/verification", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	// The email verification token cannot reset the password.
+	resetRequest := map[string]string{"token": m.token(t), "password": "N3w-Str0ng-Passw0rd!"}
+	if w := postJSON(newEmailTestRouter(database, m, ""), "/password/reset", resetRequest); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	database := newTestDB(t)
+	user := createTestUser(t, database)
+	m := &recordingMailer{}
+
+	if w := postJSON(newEmailTestRouter(database, m, user.ID), "/email/verification", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	r := newEmailTestRouter(database, m, "")
+	verifyRequest := map[string]string{"token": m.token(t)}
+	if w := postJSON(r, "/email/verify", verifyRequest); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	user, err := database.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatalf("failed to get user: %s", err)
+	}
+	if !user.VerifiedEmail {
+		t.Error("expected the email to be verified")
+	}
+
+	// The link is single-use.
+	if w := postJSON(r, "/email/verify", verifyRequest); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 on reuse, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestPasswordResetRejectedPassword(t *testing.T) {
+	database := newTestDB(t)
+	user := createTestUser(t, database)
+	m := &recordingMailer{}
+	r := newEmailTestRouter(database, m, "")
+
+	if w := postJSON(r, "/password/forgot", map[string]string{"email": user.Email}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	token := m.token(t)
+
+	// The password rejected by the policy does not use up the link.
+	if w := postJSON(r, "/password/reset", map[string]string{"token": token, "password": "weak"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body)
+	}
+	resetRequest := map[string]string{"token": token, "password": "N3w-Str0ng-Passw0rd!"}
+	if w := postJSON(r, "/password/reset", resetRequest); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestEmailVerificationEmailCase(t *testing.T) {
+	database := newTestDB(t)
+	user := createTestUser(t, database)
+
+	// The emails stored before the normalization may differ in case from the token.
+	rawToken, err := issueToken(database, db.Token{
+		Purpose: db.TokenPurposeEmailVerification,
+		UserID:  user.ID,
+		Email:   "USER@example.com",
+	}, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue token: %s", err)
+	}
+	r := newEmailTestRouter(database, &recordingMailer{}, "")
+	if w := postJSON(r, "/email/verify", map[string]string{"token": rawToken}); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestEmailCooldown(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		email string
+	}{
+		{
+			name:  "password reset",
+			path:  "/password/forgot",
+			email: "user@example.com",
+		},
+		{
+			name:  "password reset of unknown email",
+			path:  "/password/forgot",
+			email: "nobody@example.com",
+		},
+		{
+			name:  "magic link",
+			path:  "/magic-link?redirect_url=https://example.com/signed-in",
+			email: "user@example.com",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database := newTestDB(t)
+			createTestUser(t, database)
+			m := &recordingMailer{}
+			r := newEmailTestRouter(database, m, "")
+
+			if w := postJSON(r, test.path, map[string]string{"email": test.email}); w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+			}
+			// The case of the email does not matter.
+			w := postJSON(r, test.path, map[string]string{"email": strings.ToUpper(test.email)})
+			if w.Code != http.StatusTooManyRequests {
+				t.Errorf("expected 429, got %d: %s", w.Code, w.Body)
+			}
+			if len(m.messages) > 1 {
+				t.Errorf("expected at most one message, got %d", len(m.messages))
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	githubDefaultBaseURL    = "https://github.com"
+	githubDefaultAPIBaseURL = "https://api.github.com"
+)
+
+type GitHubConfig struct {
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback URL, e.g. https://example.com/api/v1/auth/github/callback
+	RedirectURL string
+	// BaseURL is the URL of the OAuth endpoints.
+	// Defaults to https://github.com
+	BaseURL string
+	// APIBaseURL is the URL of the REST API.
+	// Defaults to https://api.github.com
+	APIBaseURL string
+	// HTTPClient is used for the token exchange and the API calls.
+	HTTPClient *http.Client
+}
+
+// GitHubConfigFromEnv reads the configuration of the provider from
+// GITHUB_OAUTH_CLIENT_ID, GITHUB_OAUTH_CLIENT_SECRET, GITHUB_OAUTH_REDIRECT_URL,
+// GITHUB_OAUTH_BASE_URL and GITHUB_OAUTH_API_BASE_URL environment variables.
+func GitHubConfigFromEnv() GitHubConfig {
+	return GitHubConfig{
+		ClientID:     os.Getenv("GITHUB_OAUTH_CLIENT_ID"),
+		ClientSecret: os.Getenv("GITHUB_OAUTH_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("GITHUB_OAUTH_REDIRECT_URL"),
+		BaseURL:      os.Getenv("GITHUB_OAUTH_BASE_URL"),
+		APIBaseURL:   os.Getenv("GITHUB_OAUTH_API_BASE_URL"),
+	}
+}
+
+type githubUser struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+	Name  string `json:"name"`
+	// AvatarURL is the URL of the profile picture.
+	AvatarURL string `json:"avatar_url"`
+}
+
+type githubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+// GitHubProvider authenticates users with GitHub OAuth apps.
+// GitHub does not support OpenID Connect for users, so the profile
+// is fetched from the REST API instead of an ID token.
+type GitHubProvider struct {
+	cfg    GitHubConfig
+	oauth2 *oauth2.Config
+}
+
+func NewGitHubProvider(cfg GitHubConfig) *GitHubProvider {
+	if len(cfg.BaseURL) == 0 {
+		cfg.BaseURL = githubDefaultBaseURL
+	}
+	if len(cfg.APIBaseURL) == 0 {
+		cfg.APIBaseURL = githubDefaultAPIBaseURL
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	cfg.APIBaseURL = strings.TrimSuffix(cfg.APIBaseURL, "/")
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = httpClient
+	}
+	return &GitHubProvider{
+		cfg: cfg,
+		oauth2: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  cfg.BaseURL + "/login/oauth/authorize",
+				TokenURL: cfg.BaseURL + "/login/oauth/access_token",
+			},
+			Scopes: []string{"read:user", "user:email"},
+		},
+	}
+}
+
+func (p *GitHubProvider) Name() string {
+	return "github"
+}
+
+// AuthCodeURL returns the URL of the consent page.
+// The nonce is not supported by GitHub and is ignored.
+func (p *GitHubProvider) AuthCodeURL(state, _, codeVerifier string) string {
+	return p.oauth2.AuthCodeURL(state, oauth2.S256ChallengeOption(codeVerifier))
+}
+
+func (p *GitHubProvider) Exchange(ctx context.Context, code, _, codeVerifier string) (UserInfo, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.cfg.HTTPClient)
+
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return UserInfo{}, fmt.Errorf("code exchange wrong: %w", err)
+	}
+	client := p.oauth2.Client(ctx, token)
+
+	var user githubUser
+	if err = p.getJSON(ctx, client, "/user", &user); err != nil {
+		return UserInfo{}, fmt.Errorf("failed getting user info: %w", err)
+	}
+
+	// The email on the profile may be private or unverified,
+	// so the primary verified email is used instead.
+	var emails []githubEmail
+	if err = p.getJSON(ctx, client, "/user/emails", &emails); err != nil {
+		return UserInfo{}, fmt.Errorf("failed getting user emails: %w", err)
+	}
+	userInfo := UserInfo{
+		Subject: strconv.FormatInt(user.ID, 10),
+		Name:    user.Name,
+		Picture: user.AvatarURL,
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			userInfo.Email = e.Email
+			userInfo.VerifiedEmail = true
+			break
+		}
+	}
+	if len(userInfo.Email) == 0 {
+		return UserInfo{}, errors.New("user has no primary verified email")
+	}
+
+	// GitHub only has a single name field.
+	if len(userInfo.Name) == 0 {
+		userInfo.Name = user.Login
+	}
+	userInfo.GivenName, userInfo.FamilyName, _ = strings.Cut(strings.TrimSpace(userInfo.Name), " ")
+	userInfo.FamilyName = strings.TrimSpace(userInfo.FamilyName)
+
+	return userInfo, nil
+}
+
+func (p *GitHubProvider) getJSON(ctx context.Context, client *http.Client, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.APIBaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
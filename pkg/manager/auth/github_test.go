@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestGitHub returns a mock of the GitHub OAuth endpoints and the REST API
+// responding with the user and the emails.
+func newTestGitHub(t *testing.T, user githubUser, emails []githubEmail) *httptest.Server {
+	t.Helper()
+	writeJSON := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code" || r.FormValue("code_verifier") != "verifier" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "bad_verification_code"})
+			return
+		}
+		writeJSON(w, map[string]string{"access_token": "access-token", "token_type": "bearer"})
+	})
+	authorized := func(next func(w http.ResponseWriter)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer access-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next(w)
+		}
+	}
+	mux.HandleFunc("/api/user", authorized(func(w http.ResponseWriter) {
+		writeJSON(w, user)
+	}))
+	mux.HandleFunc("/api/user/emails", authorized(func(w http.ResponseWriter) {
+		writeJSON(w, emails)
+	}))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestGitHubProvider(server *httptest.Server) *GitHubProvider {
+	return NewGitHubProvider(GitHubConfig{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://example.com/api/v1/auth/github/callback",
+		BaseURL:      server.URL,
+		APIBaseURL:   server.URL + "/api/",
+		HTTPClient:   server.Client(),
+	})
+}
+
+func TestGitHubProviderExchange(t *testing.T) {
+	server := newTestGitHub(
+		t,
+		githubUser{ID: 42, Login: "jdoe", Name: "Jane Van Doe", AvatarURL: "https://example.com/avatar.png"},
+		[]githubEmail{
+			{Email: "unverified@example.com", Primary: false, Verified: false},
+			{Email: "secondary@example.com", Primary: false, Verified: true},
+			{Email: "primary@example.com", Primary: true, Verified: true},
+		},
+	)
+	provider := newTestGitHubProvider(server)
+
+	authURL := provider.AuthCodeURL("state", "nonce", "verifier")
+	if !strings.HasPrefix(authURL, server.URL+"/login/oauth/authorize?") ||
+		!strings.Contains(authURL, "code_challenge_method=S256") {
+		t.Errorf("unexpected auth code URL '%s'", authURL)
+	}
+
+	userInfo, err := provider.Exchange(context.Background(), "code", "", "verifier")
+	if err != nil {
+		t.Fatalf("failed to exchange code: %s", err)
+	}
+	expected := UserInfo{
+		Subject:       "42",
+		Email:         "primary@example.com",
+		VerifiedEmail: true,
+		Name:          "Jane Van Doe",
+		GivenName:     "Jane",
+		FamilyName:    "Van Doe",
+		Picture:       "https://example.com/avatar.png",
+	}
+	if userInfo != expected {
+		t.Errorf("expected %+v, got %+v", expected, userInfo)
+	}
+}
+
+func TestGitHubProviderExchangeLogin(t *testing.T) {
+	server := newTestGitHub(
+		t,
+		githubUser{ID: 42, Login: "jdoe"},
+		[]githubEmail{{Email: "primary@example.com", Primary: true, Verified: true}},
+	)
+
+	// The login is used as the name if the user has not set one.
+	userInfo, err := newTestGitHubProvider(server).Exchange(context.Background(), "code", "", "verifier")
+	if err != nil {
+		t.Fatalf("failed to exchange code: %s", err)
+	}
+	if userInfo.Name != "jdoe" || userInfo.GivenName != "jdoe" || userInfo.FamilyName != "" {
+		t.Errorf("unexpected user info %+v", userInfo)
+	}
+}
+
+func TestGitHubProviderExchangeRejected(t *testing.T) {
+	tests := []struct {
+		name         string
+		emails       []githubEmail
+		codeVerifier string
+	}{
+		{
+			name:         "unverified primary email",
+			emails:       []githubEmail{{Email: "primary@example.com", Primary: true, Verified: false}},
+			codeVerifier: "verifier",
+		},
+		{
+			name:         "no emails",
+			emails:       []githubEmail{},
+			codeVerifier: "verifier",
+		},
+		{
+			name:         "code verifier mismatch",
+			emails:       []githubEmail{{Email: "primary@example.com", Primary: true, Verified: true}},
+			codeVerifier: "other",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestGitHub(t, githubUser{ID: 42, Login: "jdoe"}, test.emails)
+
+			_, err := newTestGitHubProvider(server).Exchange(context.Background(), "code", "", test.codeVerifier)
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
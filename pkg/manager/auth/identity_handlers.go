@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/audit"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// unlinkIdentityMx makes sure that the concurrent unlinks cannot remove the last sign-in method of the user.
+var unlinkIdentityMx sync.Mutex
+
+type linkIdentityResponse struct {
+	// URL is the consent page of the provider the user must be sent to.
+	URL string `json:"url"`
+}
+
+// HandleUserIdentities returns the identities linked to the authenticated user.
+func HandleUserIdentities(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	identities, err := database.GetUserIdentities(userID)
+	if err != nil {
+		log.Printf("failed to get identities of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, identities)
+}
+
+// HandleLinkUserIdentity initiates linking of the provider from the path to the authenticated user
+// and responds with the URL of the provider's consent page.
+// The identity is linked on the callback and the user is redirected to "redirect_url" from the query.
+// It must match the allow-list of RedirectConfig.
+func HandleLinkUserIdentity(c *gin.Context) {
+	redirectURL, ok := redirectURLOrAbort(c)
+	if !ok {
+		return
+	}
+	providers := c.MustGet(helper.ContextAuthProviders).(Providers)
+	provider, err := providers.Get(c.Param("provider"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, linkIdentityResponse{
+		URL: oauthLogin(c, provider, oauthState{
+			Provider:    provider.Name(),
+			RedirectURL: redirectURL,
+			LinkUserID:  c.MustGet(helper.ContextUserID).(string),
+		}),
+	})
+}
+
+// HandleUnlinkUserIdentity unlinks the identity from the path from the authenticated user.
+// The identity cannot be unlinked if it is the only way for the user to sign in,
+// i.e. the user has no password, no passkeys and no other identities.
+func HandleUnlinkUserIdentity(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	identityID := c.Param("identityid")
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+
+	unlinkIdentityMx.Lock()
+	defer unlinkIdentityMx.Unlock()
+
+	ok, err := hasOtherSignInMethod(database, userID, identityID)
+	if err != nil {
+		log.Printf("failed to get sign-in methods of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusConflict, helper.HTTPMessage{
+			Message: "the identity is the only way to sign in, set a password or link another identity first",
+		})
+		return
+	}
+	if err = database.DeleteUserIdentity(userID, identityID); err != nil {
+		if err == db.ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{Message: "identity not found"})
+			return
+		}
+		log.Printf("failed to delete identity '%s' of user '%s': %s\n", identityID, userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// hasOtherSignInMethod returns true if the user can sign in without the identity,
+// i.e. with the password, a passkey or another identity.
+// Unknown identities are not counted, so that unlinking them responds with '404 Not Found'.
+func hasOtherSignInMethod(database db.Adapter, userID, identityID string) (bool, error) {
+	identities, err := database.GetUserIdentities(userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get identities: %w", err)
+	}
+	linked := false
+	for _, identity := range identities {
+		if identity.ID != identityID {
+			return true, nil
+		}
+		linked = true
+	}
+	if !linked {
+		return true, nil
+	}
+
+	if _, err = database.GetPasswordCredential(userID); err == nil {
+		return true, nil
+	} else if err != db.ErrNotFound {
+		return false, fmt.Errorf("failed to get password credential: %w", err)
+	}
+	credentials, err := database.GetWebAuthnCredentials(userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get WebAuthn credentials: %w", err)
+	}
+	return len(credentials) > 0, nil
+}
+
+// linkUserIdentity completes linking of the identity on the callback
+// and redirects the user to the redirect URL of the state.
+// An identity can only be linked to a single user.
+func linkUserIdentity(c *gin.Context, provider string, userInfo UserInfo, state oauthState) {
+	if len(userInfo.Subject) == 0 {
+		log.Printf("failed to link %s identity: subject is missing in the user info\n", provider)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := checkUserStatus(c, state.LinkUserID); err != nil {
+		abortCreateSession(c, state.LinkUserID, err)
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	identity, err := database.GetUserIdentity(provider, userInfo.Subject)
+	switch {
+	case err == nil && identity.UserID != state.LinkUserID:
+		c.AbortWithStatusJSON(http.StatusConflict, helper.HTTPMessage{
+			Message: "the identity is already linked to another account",
+		})
+		return
+	case err == nil:
+		// Already linked to the user.
+	case err == db.ErrNotFound:
+		identity = db.UserIdentity{
+			ID:        db.UserIdentityID(provider, userInfo.Subject),
+			UserID:    state.LinkUserID,
+			Provider:  provider,
+			Subject:   userInfo.Subject,
+			Email:     userInfo.Email,
+			CreatedAt: time.Now().UTC(),
+		}
+		if err = database.CreateUserIdentity(&identity); err != nil {
+			if err == db.ErrAlreadyExists {
+				c.AbortWithStatusJSON(http.StatusConflict, helper.HTTPMessage{
+					Message: "the identity is already linked to another account",
+				})
+				return
+			}
+			log.Printf("failed to link %s identity to user '%s': %s\n", provider, state.LinkUserID, err.Error())
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		// The user is authenticated by the state, so they are the actor.
+		c.Set(helper.ContextUserID, state.LinkUserID)
+		audit.Record(c, audit.ActionIdentityLink, state.LinkUserID)
+	default:
+		log.Printf("failed to get %s identity: %s\n", provider, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(c.Writer, c.Request, state.RedirectURL, http.StatusTemporaryRedirect)
+}
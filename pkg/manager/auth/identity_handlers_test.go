@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+func TestUnlinkUserIdentity(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   bool
+		passkey    bool
+		identities []string
+		unlink     string
+		status     int
+	}{
+		{
+			name:       "only identity",
+			identities: []string{"google"},
+			unlink:     "google",
+			status:     http.StatusConflict,
+		},
+		{
+			name:       "password",
+			password:   true,
+			identities: []string{"google"},
+			unlink:     "google",
+			status:     http.StatusOK,
+		},
+		{
+			name:       "passkey",
+			passkey:    true,
+			identities: []string{"google"},
+			unlink:     "google",
+			status:     http.StatusOK,
+		},
+		{
+			name:       "another identity",
+			identities: []string{"google", "github"},
+			unlink:     "google",
+			status:     http.StatusOK,
+		},
+		{
+			name:       "unknown identity",
+			identities: []string{"google"},
+			unlink:     "github",
+			status:     http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database := newTestDB(t)
+			user := createTestUser(t, database)
+			if test.password {
+				hash, err := HashPassword("Str0ng-Passw0rd!", testArgon2Params)
+				if err != nil {
+					t.Fatalf("failed to hash password: %s", err)
+				}
+				if err = database.PutPasswordCredential(&db.PasswordCredential{UserID: user.ID, Hash: hash}); err != nil {
+					t.Fatalf("failed to put password credential: %s", err)
+				}
+			}
+			if test.passkey {
+				if err := database.CreateWebAuthnCredential(&db.WebAuthnCredential{ID: "passkey", UserID: user.ID}); err != nil {
+					t.Fatalf("failed to create WebAuthn credential: %s", err)
+				}
+			}
+			for _, provider := range test.identities {
+				err := database.CreateUserIdentity(&db.UserIdentity{
+					ID:       provider,
+					UserID:   user.ID,
+					Provider: provider,
+					Subject:  "subject",
+				})
+				if err != nil {
+					t.Fatalf("failed to create identity: %s", err)
+				}
+			}
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(func(c *gin.Context) {
+				c.Set(helper.ContextDatabase, database)
+				c.Set(helper.ContextUserID, user.ID)
+			})
+			r.DELETE("/identities/:identityid", HandleUnlinkUserIdentity)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/identities/"+test.unlink, nil))
+
+			if w.Code != test.status {
+				t.Errorf("expected %d, got %d: %s", test.status, w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// magicLinkConfirmationPage asks the user to confirm the sign in,
+// so that the link is not used up by the mail scanners and the prefetchers following it.
+var magicLinkConfirmationPage = template.Must(template.New("confirmation").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Sign in</title></head>
+<body>
+<form method="post">
+<input type="hidden" name="token" value="{{.}}">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// magicLinkCookieName is the name of the cookie binding the magic link to the browser.
+const magicLinkCookieName = "magiclink"
+
+type magicLinkRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// HandleMagicLinkInitiation emails a single-use sign-in link.
+// "redirect_url" must be passed via query to redirect users after authentication is complete.
+// It must match the allow-list of RedirectConfig.
+// "scope" may be passed via query to request a session with reduced privileges.
+// "code_challenge" may be passed via query to receive a one-time code protected by PKCE instead of the access token.
+// The link is bound to the browser with a cookie, so it only signs in the browser that requested it.
+func HandleMagicLinkInitiation(c *gin.Context) {
+	redirectURL, ok := redirectURLOrAbort(c)
+	if !ok {
+		return
+	}
+	scopes, ok := requestedScopesOrAbort(c, ParseScopes(c.Query("scope")))
+	if !ok {
+		return
+	}
+	codeChallenge, ok := codeChallengeOrAbort(c)
+	if !ok {
+		return
+	}
+
+	var req magicLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+	req.Email = db.NormalizeEmail(req.Email)
+	if !countEmail(c, db.TokenPurposeMagicLink, req.Email) {
+		abortEmailCooldown(c)
+		return
+	}
+
+	// The nonce protects the user from login CSRF, i.e. being signed in with the link of somebody else.
+	nonce := helper.GenerateRandomString(32)
+	emailConfig := c.MustGet(helper.ContextEmailConfig).(EmailConfig)
+	err := sendTokenEmail(
+		c,
+		db.Token{
+			Purpose:       db.TokenPurposeMagicLink,
+			Email:         req.Email,
+			RedirectURL:   redirectURL,
+			Scopes:        scopes,
+			CodeChallenge: codeChallenge,
+			Nonce:         nonce,
+		},
+		emailConfig.MagicLinkURL,
+		emailConfig.MagicLinkTTL,
+		"Your sign-in link",
+		"Follow the link to sign in:\n\n%s\n\nThe link expires in %s. "+
+			"If you did not request to sign in, you can ignore this email.\n",
+	)
+	if err != nil {
+		log.Println("failed to send magic link:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	setBindingCookie(c, magicLinkCookieName, oauthStateMAC(c, nonce), int(emailConfig.MagicLinkTTL.Seconds()))
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// HandleMagicLinkConfirmation serves the page the magic link opens.
+// The page submits the token to HandleMagicLinkCallback, so that following the link does not use it up.
+func HandleMagicLinkConfirmation(c *gin.Context) {
+	token := c.Query("token")
+	if len(token) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: ErrInvalidToken.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := magicLinkConfirmationPage.Execute(c.Writer, token); err != nil {
+		log.Println("failed to render magic link confirmation:", err)
+	}
+}
+
+// HandleMagicLinkCallback handles the token of the magic link submitted with POST
+// in the form or the query and if successful, redirects the user to 'redirect_url'
+// An 'access_token' will be added to the query of the 'redirect_url'.
+// The link must be submitted from the browser it was requested from.
+// New users are created with the verified email.
+// Existing accounts that have not verified the email get it verified by the link.
+func HandleMagicLinkCallback(c *gin.Context) {
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	rawToken := c.PostForm("token")
+	if len(rawToken) == 0 {
+		rawToken = c.Query("token")
+	}
+	token, ok := findTokenOrAbort(c, database, db.TokenPurposeMagicLink, rawToken)
+	if !ok {
+		return
+	}
+	// The link opened in another browser is not used up, so the user can still open it in the right one.
+	cookie, err := c.Request.Cookie(magicLinkCookieName)
+	if err != nil || len(token.Nonce) == 0 ||
+		!hmac.Equal([]byte(cookie.Value), []byte(oauthStateMAC(c, token.Nonce))) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "the sign-in link must be opened in the browser it was requested from",
+		})
+		return
+	}
+	if token, ok = consumeTokenOrAbort(c, database, db.TokenPurposeMagicLink, rawToken); !ok {
+		return
+	}
+	setBindingCookie(c, magicLinkCookieName, "", -1)
+
+	user, err := findOrCreateUser(database, UserInfo{Email: token.Email})
+	if errors.Is(err, ErrUnverifiedAccount) {
+		// The link proves that the user owns the email.
+		user, err = verifyUserEmail(database, token.Email)
+	}
+	if err != nil {
+		log.Println("failed to find or create user:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	acceptInvitations(database, user)
+
+	redirectWithSession(c, user, token.RedirectURL, token.Scopes, token.CodeChallenge)
+}
+
+// verifyUserEmail marks the email of the user found by it as verified.
+func verifyUserEmail(database db.Adapter, email string) (db.User, error) {
+	user, err := database.GetUserByEmail(email)
+	if err != nil {
+		return db.User{}, fmt.Errorf("failed to get user by email: %w", err)
+	}
+	if err = database.UpdateUserVerifiedEmail(user.ID, true); err != nil {
+		return db.User{}, fmt.Errorf("failed to verify email of user '%s': %w", user.ID, err)
+	}
+	user.VerifiedEmail = true
+	return user, nil
+}
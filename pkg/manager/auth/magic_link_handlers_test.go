@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+)
+
+// requestMagicLink requests the magic link of the email and returns the cookie binding it to the browser.
+func requestMagicLink(t *testing.T, r http.Handler, email string) *http.Cookie {
+	t.Helper()
+	w := postJSON(r, "/magic-link?redirect_url=https://example.com/signed-in", map[string]string{"email": email})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == magicLinkCookieName {
+			return cookie
+		}
+	}
+	t.Fatal("the magic link cookie is not set")
+	return nil
+}
+
+// submitMagicLink submits the token of the magic link with the cookie, if it is not nil.
+func submitMagicLink(r http.Handler, token string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(
+		http.MethodPost,
+		"/magic-link/callback",
+		strings.NewReader(url.Values{"token": {token}}.Encode()),
+	)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestMagicLink(t *testing.T) {
+	database := newTestDB(t)
+	m := &recordingMailer{}
+	r := newEmailTestRouter(database, m, "")
+
+	cookie := requestMagicLink(t, r, "New.User@example.com")
+	token := m.token(t)
+
+	w := submitMagicLink(r, token, cookie)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected 303, got %d: %s", w.Code, w.Body)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || location.Host != "example.com" || len(location.Query().Get("access_token")) == 0 {
+		t.Errorf("unexpected redirect '%s'", w.Header().Get("Location"))
+	}
+	user, err := database.GetUserByEmail("new.user@example.com")
+	if err != nil {
+		t.Fatalf("failed to get user: %s", err)
+	}
+	if !user.VerifiedEmail {
+		t.Error("expected the email to be verified")
+	}
+
+	// The link is single-use.
+	if w = submitMagicLink(r, token, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 on reuse, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestMagicLinkOtherBrowser(t *testing.T) {
+	database := newTestDB(t)
+	m := &recordingMailer{}
+	r := newEmailTestRouter(database, m, "")
+
+	victimCookie := requestMagicLink(t, r, "victim@example.com")
+	requestMagicLink(t, r, "attacker@example.com")
+	attackerToken := m.token(t)
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+	}{
+		{
+			name: "no cookie",
+		},
+		{
+			name:   "cookie of another link",
+			cookie: victimCookie,
+		},
+		{
+			name:   "forged cookie",
+			cookie: &http.Cookie{Name: magicLinkCookieName, Value: "forged"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if w := submitMagicLink(r, attackerToken, test.cookie); w.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+
+	// The rejected attempts do not use up the link.
+	if _, err := findToken(database, db.TokenPurposeMagicLink, attackerToken); err != nil {
+		t.Errorf("expected the link to stay valid, got %v", err)
+	}
+}
+
+func TestMagicLinkUnverifiedAccount(t *testing.T) {
+	database := newTestDB(t)
+	user := createTestUser(t, database)
+	m := &recordingMailer{}
+	r := newEmailTestRouter(database, m, "")
+
+	// The link proves the ownership of the email, so the existing account is signed in.
+	cookie := requestMagicLink(t, r, user.Email)
+	if w := submitMagicLink(r, m.token(t), cookie); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected 303, got %d: %s", w.Code, w.Body)
+	}
+	user, err := database.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatalf("failed to get user: %s", err)
+	}
+	if !user.VerifiedEmail {
+		t.Error("expected the email to be verified")
+	}
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oauthStateTTL is how long the user has to complete the authentication with the provider.
+	oauthStateTTL = time.Minute * 10
+	// oauthStateCacheKeyPrefix prefixes the states in the session cache.
+	oauthStateCacheKeyPrefix = "oauth-state:"
+	// oauthStateCookieName is the name of the cookie binding the state to the browser.
+	oauthStateCookieName = "oauthstate"
+)
+
+var ErrInvalidOAuthState = errors.New("invalid oauth state")
+
+// oauthStatesMx makes sure that a state is consumed only once.
+var oauthStatesMx sync.Mutex
+
+// oauthState is the information stored in the session cache
+// between the initiation and the callback.
+type oauthState struct {
+	Provider    string
+	RedirectURL string
+	Nonce       string
+	// CodeVerifier is the PKCE verifier of the authorization code of the provider.
+	CodeVerifier string
+	// Scopes are the scopes requested for the session.
+	Scopes []string
+	// CodeChallenge is the PKCE challenge of the one-time code.
+	CodeChallenge string
+	// LinkUserID is the user the identity is linked to instead of signing in.
+	LinkUserID string
+}
+
+// oauthLogin stores the state, binds it to the browser with a cookie
+// and returns the URL of the provider's consent page to redirect the user to.
+func oauthLogin(c *gin.Context, provider Provider, state oauthState) string {
+	// The nonce is bound to the ID token to prevent replay attacks.
+	state.Nonce = helper.GenerateRandomString(16)
+	state.CodeVerifier = oauth2.GenerateVerifier()
+	// The state protects the user from CSRF attacks. It is validated on the callback.
+	rawState := helper.GenerateRandomString(32)
+
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	sessionCache.Set(oauthStateCacheKeyPrefix+rawState, state, oauthStateTTL)
+	setBindingCookie(c, oauthStateCookieName, oauthStateMAC(c, rawState), int(oauthStateTTL.Seconds()))
+
+	return provider.AuthCodeURL(rawState, state.Nonce, state.CodeVerifier)
+}
+
+// consumeOAuthState validates the state from the query or the posted form against the cookie
+// and deletes it, so it cannot be used again.
+func consumeOAuthState(c *gin.Context) (oauthState, error) {
+	cookie, err := c.Request.Cookie(oauthStateCookieName)
+	if err != nil {
+		return oauthState{}, fmt.Errorf("user is missing oauthState cookie: %w", err)
+	}
+	setBindingCookie(c, oauthStateCookieName, "", -1)
+
+	rawState := c.Request.FormValue("state")
+	if len(rawState) == 0 || !hmac.Equal([]byte(cookie.Value), []byte(oauthStateMAC(c, rawState))) {
+		return oauthState{}, ErrInvalidOAuthState
+	}
+
+	oauthStatesMx.Lock()
+	defer oauthStatesMx.Unlock()
+
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	state, ok := sessionCache.Get(oauthStateCacheKeyPrefix + rawState)
+	if !ok {
+		return oauthState{}, fmt.Errorf("%w: state is expired or already used", ErrInvalidOAuthState)
+	}
+	sessionCache.Delete(oauthStateCacheKeyPrefix + rawState)
+	return state.(oauthState), nil
+}
+
+func oauthCallback(r *http.Request, provider Provider, state oauthState) (UserInfo, error) {
+	userInfo, err := provider.Exchange(r.Context(), r.FormValue("code"), state.Nonce, state.CodeVerifier)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	if len(userInfo.Email) == 0 {
+		return UserInfo{}, errors.New("email is missing in the user info")
+	}
+	return userInfo, nil
+}
+
+// oauthStateMAC returns the MAC of the state, so that the cookie
+// cannot be forged for a state without the key.
+// It also binds the magic links to the browser they are requested from.
+func oauthStateMAC(c *gin.Context, rawState string) string {
+	mac := hmac.New(sha256.New, c.MustGet(helper.ContextOAuthStateKey).([]byte))
+	mac.Write([]byte(rawState))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setBindingCookie sets the cookie binding the OAuth state or the magic link to the browser.
+func setBindingCookie(c *gin.Context, name, value string, maxAge int) {
+	cfg := c.MustGet(helper.ContextSessionCookieConfig).(SessionCookieConfig)
+	// The callback is a top-level navigation from the provider, so Strict would drop the cookie.
+	// The providers posting the callback with 'response_mode=form_post' need None, which requires Secure,
+	// and so do the magic links requested with cross-site requests of the frontend.
+	// The cookie only holds the MAC, so it is safe to send it with cross-site requests.
+	sameSite := http.SameSiteNoneMode
+	if cfg.Insecure {
+		sameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     cfg.Path,
+		Domain:   cfg.Domain,
+		MaxAge:   maxAge,
+		Secure:   !cfg.Insecure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	})
+}
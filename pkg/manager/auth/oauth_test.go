@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// newOAuthStateContext returns the context of the callback with the state in the query
+// and the state cookie, if it is not empty.
+func newOAuthStateContext(sessionCache *cache.Cache, rawState, cookie string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/auth/test/callback?state="+rawState, nil)
+	if len(cookie) > 0 {
+		c.Request.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: cookie})
+	}
+	c.Set(helper.ContextCache, sessionCache)
+	c.Set(helper.ContextOAuthStateKey, []byte("test-key"))
+	c.Set(helper.ContextSessionCookieConfig, SessionCookieConfig{Path: "/"})
+	return c
+}
+
+func TestConsumeOAuthState(t *testing.T) {
+	sessionCache := cache.New(time.Minute)
+	rawState := "state"
+	sessionCache.Set(oauthStateCacheKeyPrefix+rawState, oauthState{Provider: "test", Nonce: "nonce"}, oauthStateTTL)
+	mac := oauthStateMAC(newOAuthStateContext(sessionCache, rawState, ""), rawState)
+
+	state, err := consumeOAuthState(newOAuthStateContext(sessionCache, rawState, mac))
+	if err != nil {
+		t.Fatalf("failed to consume state: %s", err)
+	}
+	if state.Provider != "test" || state.Nonce != "nonce" {
+		t.Errorf("unexpected state %+v", state)
+	}
+
+	// The state is single-use.
+	_, err = consumeOAuthState(newOAuthStateContext(sessionCache, rawState, mac))
+	if !errors.Is(err, ErrInvalidOAuthState) {
+		t.Errorf("expected ErrInvalidOAuthState on reuse, got %v", err)
+	}
+}
+
+func TestConsumeOAuthStateExpired(t *testing.T) {
+	sessionCache := cache.New(time.Minute)
+	rawState := "state"
+	sessionCache.Set(oauthStateCacheKeyPrefix+rawState, oauthState{Provider: "test"}, time.Millisecond)
+	mac := oauthStateMAC(newOAuthStateContext(sessionCache, rawState, ""), rawState)
+	time.Sleep(time.Millisecond * 5)
+
+	_, err := consumeOAuthState(newOAuthStateContext(sessionCache, rawState, mac))
+	if !errors.Is(err, ErrInvalidOAuthState) {
+		t.Errorf("expected ErrInvalidOAuthState, got %v", err)
+	}
+}
+
+func TestConsumeOAuthStateCookie(t *testing.T) {
+	sessionCache := cache.New(time.Minute)
+	rawState := "state"
+	sessionCache.Set(oauthStateCacheKeyPrefix+rawState, oauthState{Provider: "test"}, oauthStateTTL)
+
+	// The state must be bound to the browser by the cookie.
+	if _, err := consumeOAuthState(newOAuthStateContext(sessionCache, rawState, "")); err == nil {
+		t.Error("expected an error without the cookie")
+	}
+	_, err := consumeOAuthState(newOAuthStateContext(sessionCache, rawState, "forged"))
+	if !errors.Is(err, ErrInvalidOAuthState) {
+		t.Errorf("expected ErrInvalidOAuthState with a forged cookie, got %v", err)
+	}
+
+	// The rejected attempts do not use up the state.
+	mac := oauthStateMAC(newOAuthStateContext(sessionCache, rawState, ""), rawState)
+	if _, err = consumeOAuthState(newOAuthStateContext(sessionCache, rawState, mac)); err != nil {
+		t.Errorf("expected the state to stay valid, got %v", err)
+	}
+}
+
+func TestConsumeOAuthStateFormPost(t *testing.T) {
+	sessionCache := cache.New(time.Minute)
+	rawState := "state"
+	sessionCache.Set(oauthStateCacheKeyPrefix+rawState, oauthState{Provider: "test"}, oauthStateTTL)
+	mac := oauthStateMAC(newOAuthStateContext(sessionCache, rawState, ""), rawState)
+
+	// With 'response_mode=form_post' the state arrives in the body.
+	c := newOAuthStateContext(sessionCache, "", mac)
+	c.Request = httptest.NewRequest(
+		http.MethodPost,
+		"/api/v1/auth/test/callback",
+		strings.NewReader(url.Values{"state": {rawState}, "code": {"code"}}.Encode()),
+	)
+	c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	c.Request.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: mac})
+	if _, err := consumeOAuthState(c); err != nil {
+		t.Errorf("failed to consume state: %s", err)
+	}
+}
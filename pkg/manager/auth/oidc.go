@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// GoogleIssuerURL is the OpenID Connect issuer of Google accounts.
+	GoogleIssuerURL = "https://accounts.google.com"
+)
+
+var (
+	httpClient = &http.Client{
+		Timeout: time.Second * 15,
+	}
+)
+
+type OIDCConfig struct {
+	// Name is the name of the provider used in the routes, e.g. 'okta'.
+	Name string
+	// IssuerURL is the URL of the issuer used for the discovery
+	// of the provider metadata, e.g. https://accounts.google.com
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback URL, e.g. https://example.com/api/v1/auth/okta/callback
+	RedirectURL string
+	// Scopes are additional scopes to request. 'openid', 'email' and 'profile'
+	// are requested by default.
+	Scopes []string
+	// HTTPClient is used for the discovery, token exchange and key retrieval.
+	HTTPClient *http.Client
+}
+
+// OIDCConfigFromEnv reads the configuration of the provider from the environment
+// variables prefixed with the provider name, e.g. for 'google':
+// GOOGLE_OAUTH_ISSUER_URL, GOOGLE_OAUTH_CLIENT_ID,
+// GOOGLE_OAUTH_CLIENT_SECRET and GOOGLE_OAUTH_REDIRECT_URL.
+func OIDCConfigFromEnv(name string) OIDCConfig {
+	prefix := strings.ToUpper(name) + "_OAUTH_"
+	cfg := OIDCConfig{
+		Name:         name,
+		IssuerURL:    os.Getenv(prefix + "ISSUER_URL"),
+		ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+		ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+	}
+	if len(cfg.IssuerURL) == 0 && name == "google" {
+		cfg.IssuerURL = GoogleIssuerURL
+	}
+	return cfg
+}
+
+// OIDCProvider is a generic OpenID Connect provider
+// such as Google, Okta, Keycloak or Auth0.
+type OIDCProvider struct {
+	cfg      OIDCConfig
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+	oauth2   *oauth2.Config
+}
+
+// NewOIDCProvider discovers the issuer metadata and creates a new provider.
+func NewOIDCProvider(ctx context.Context, cfg OIDCConfig) (*OIDCProvider, error) {
+	if len(cfg.Name) == 0 {
+		return nil, errors.New("missing provider name")
+	}
+	if len(cfg.IssuerURL) == 0 {
+		return nil, errors.New("missing issuer URL")
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = httpClient
+	}
+
+	// The client from the context is also used to fetch the keys later on.
+	ctx = oidc.ClientContext(ctx, cfg.HTTPClient)
+	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover provider '%s': %w", cfg.Name, err)
+	}
+
+	return &OIDCProvider{
+		cfg:      cfg,
+		provider: provider,
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		oauth2: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID, "email", "profile"}, cfg.Scopes...),
+		},
+	}, nil
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.cfg.Name
+}
+
+func (p *OIDCProvider) AuthCodeURL(state, nonce, codeVerifier string) string {
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(codeVerifier))
+}
+
+func (p *OIDCProvider) Exchange(ctx context.Context, code, nonce, codeVerifier string) (UserInfo, error) {
+	ctx = oidc.ClientContext(ctx, p.cfg.HTTPClient)
+
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return UserInfo{}, fmt.Errorf("code exchange wrong: %w", err)
+	}
+
+	// Verify the ID token signature against the issuer's keys.
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return UserInfo{}, errors.New("id_token is missing in the token response")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return UserInfo{}, fmt.Errorf("failed to verify id_token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return UserInfo{}, errors.New("invalid id_token nonce")
+	}
+
+	var userInfo UserInfo
+	if err = idToken.Claims(&userInfo); err != nil {
+		return UserInfo{}, fmt.Errorf("failed to parse id_token claims: %w", err)
+	}
+
+	// Some providers only include the profile in the userinfo response.
+	if len(userInfo.Email) == 0 && len(p.provider.UserInfoEndpoint()) > 0 {
+		info, err := p.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+		if err != nil {
+			return UserInfo{}, fmt.Errorf("failed getting user info: %w", err)
+		}
+		if err = info.Claims(&userInfo); err != nil {
+			return UserInfo{}, fmt.Errorf("failed to parse user info: %w", err)
+		}
+		if info.Subject != idToken.Subject {
+			return UserInfo{}, errors.New("user info subject does not match id_token")
+		}
+	}
+	userInfo.Subject = idToken.Subject
+
+	return userInfo, nil
+}
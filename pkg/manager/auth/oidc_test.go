@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIssuer is a mock OpenID Connect issuer that signs the ID tokens with its own key.
+type testIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// claims are the claims of the issued ID token on top of the registered ones.
+	claims map[string]any
+	// userInfo is the response of the userinfo endpoint.
+	userInfo map[string]any
+	// code and codeVerifier are expected in the token request.
+	code         string
+	codeVerifier string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	issuer := &testIssuer{t: t, key: key, code: "code", codeVerifier: "verifier"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer.writeJSON(w, map[string]any{
+			"issuer":                                issuer.server.URL,
+			"authorization_endpoint":                issuer.server.URL + "/authorize",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"userinfo_endpoint":                     issuer.server.URL + "/userinfo",
+			"jwks_uri":                              issuer.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		issuer.writeJSON(w, map[string]any{
+			"keys": []map[string]any{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != issuer.code || r.FormValue("code_verifier") != issuer.codeVerifier {
+			w.WriteHeader(http.StatusBadRequest)
+			issuer.writeJSON(w, map[string]any{"error": "invalid_grant"})
+			return
+		}
+		issuer.writeJSON(w, map[string]any{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.idToken(),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		issuer.writeJSON(w, issuer.userInfo)
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (i *testIssuer) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		i.t.Errorf("failed to write response: %s", err)
+	}
+}
+
+// idToken returns the ID token for the client signed with RS256.
+func (i *testIssuer) idToken() string {
+	now := time.Now()
+	claims := map[string]any{
+		"iss": i.server.URL,
+		"aud": "client",
+		"sub": "subject",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for name, value := range i.claims {
+		claims[name] = value
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		i.t.Fatalf("failed to sign id_token: %s", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (i *testIssuer) provider(t *testing.T) *OIDCProvider {
+	t.Helper()
+	provider, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Name:         "test",
+		IssuerURL:    i.server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://example.com/api/v1/auth/test/callback",
+		HTTPClient:   i.server.Client(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create provider: %s", err)
+	}
+	return provider
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.claims = map[string]any{
+		"nonce":          "nonce",
+		"email":          "user@example.com",
+		"email_verified": true,
+		"given_name":     "Jane",
+		"family_name":    "Doe",
+	}
+	provider := issuer.provider(t)
+
+	authURL := provider.AuthCodeURL("state", "nonce", issuer.codeVerifier)
+	if !strings.HasPrefix(authURL, issuer.server.URL+"/authorize?") ||
+		!strings.Contains(authURL, "code_challenge_method=S256") ||
+		!strings.Contains(authURL, "nonce=nonce") {
+		t.Errorf("unexpected auth code URL '%s'", authURL)
+	}
+
+	userInfo, err := provider.Exchange(context.Background(), issuer.code, "nonce", issuer.codeVerifier)
+	if err != nil {
+		t.Fatalf("failed to exchange code: %s", err)
+	}
+	expected := UserInfo{
+		Subject:       "subject",
+		Email:         "user@example.com",
+		VerifiedEmail: true,
+		GivenName:     "Jane",
+		FamilyName:    "Doe",
+	}
+	if userInfo != expected {
+		t.Errorf("expected %+v, got %+v", expected, userInfo)
+	}
+}
+
+func TestOIDCProviderExchangeUserInfo(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.claims = map[string]any{"nonce": "nonce"}
+	issuer.userInfo = map[string]any{
+		"sub":            "subject",
+		"email":          "user@example.com",
+		"email_verified": true,
+	}
+	provider := issuer.provider(t)
+
+	// The email missing in the ID token is fetched from the userinfo endpoint.
+	userInfo, err := provider.Exchange(context.Background(), issuer.code, "nonce", issuer.codeVerifier)
+	if err != nil {
+		t.Fatalf("failed to exchange code: %s", err)
+	}
+	if userInfo.Email != "user@example.com" || !userInfo.VerifiedEmail {
+		t.Errorf("unexpected user info %+v", userInfo)
+	}
+
+	// The userinfo of another subject is rejected.
+	issuer.userInfo["sub"] = "other"
+	if _, err = provider.Exchange(context.Background(), issuer.code, "nonce", issuer.codeVerifier); err == nil {
+		t.Error("expected an error for the userinfo of another subject")
+	}
+}
+
+func TestOIDCProviderExchangeRejected(t *testing.T) {
+	tests := []struct {
+		name         string
+		claims       map[string]any
+		nonce        string
+		codeVerifier string
+	}{
+		{
+			name:         "nonce mismatch",
+			claims:       map[string]any{"nonce": "other", "email": "user@example.com"},
+			nonce:        "nonce",
+			codeVerifier: "verifier",
+		},
+		{
+			name:         "another audience",
+			claims:       map[string]any{"nonce": "nonce", "email": "user@example.com", "aud": "other"},
+			nonce:        "nonce",
+			codeVerifier: "verifier",
+		},
+		{
+			name:         "expired",
+			claims:       map[string]any{"nonce": "nonce", "email": "user@example.com", "exp": time.Now().Add(-time.Hour).Unix()},
+			nonce:        "nonce",
+			codeVerifier: "verifier",
+		},
+		{
+			name:         "code verifier mismatch",
+			claims:       map[string]any{"nonce": "nonce", "email": "user@example.com"},
+			nonce:        "nonce",
+			codeVerifier: "other",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := newTestIssuer(t)
+			issuer.claims = test.claims
+			provider := issuer.provider(t)
+
+			if _, err := provider.Exchange(context.Background(), issuer.code, test.nonce, test.codeVerifier); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestOIDCProviderExchangeForgedSignature(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.claims = map[string]any{"nonce": "nonce", "email": "user@example.com"}
+	provider := issuer.provider(t)
+
+	// The ID token signed with another key than the one published by the issuer is rejected.
+	forgedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	issuer.key = forgedKey
+	if _, err = provider.Exchange(context.Background(), issuer.code, "nonce", issuer.codeVerifier); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Params are the parameters of the Argon2id password hashing.
+// See https://datatracker.ietf.org/doc/html/rfc9106#section-4
+type Argon2Params struct {
+	// Memory is the amount of memory in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follows the second recommended option of RFC 9106.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// PasswordPolicy defines the password strength rules.
+type PasswordPolicy struct {
+	MinLength int
+	// MaxLength limits the amount of work spent on hashing.
+	MaxLength int
+	// MinCharClasses is the minimum number of character classes
+	// (lowercase, uppercase, digits and symbols) the password must contain.
+	MinCharClasses int
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:      10,
+	MaxLength:      128,
+	MinCharClasses: 3,
+}
+
+// PasswordConfig is the configuration of the password authentication.
+type PasswordConfig struct {
+	Hashing Argon2Params
+	Policy  PasswordPolicy
+}
+
+var (
+	ErrInvalidPasswordHash = errors.New("invalid password hash")
+)
+
+// hashingSlots bounds the number of passwords hashed at once.
+// Every hash takes Argon2Params.Memory, so the concurrent sign ins could run the server out of memory otherwise.
+var hashingSlots = make(chan struct{}, runtime.NumCPU())
+
+// Validate checks the password against the policy.
+// The email is used to reject passwords that contain the email name.
+func (p PasswordPolicy) Validate(password, email string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("password must be at most %d characters long", p.MaxLength)
+	}
+
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if lower+upper+digit+symbol < p.MinCharClasses {
+		return fmt.Errorf(
+			"password must contain at least %d of: lowercase letters, uppercase letters, digits, symbols",
+			p.MinCharClasses,
+		)
+	}
+
+	name, _, _ := strings.Cut(email, "@")
+	if len(name) >= 3 && strings.Contains(strings.ToLower(password), strings.ToLower(name)) {
+		return errors.New("password must not contain the email")
+	}
+
+	return nil
+}
+
+// HashPassword hashes the password with Argon2id and encodes it in the PHC string format
+// e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func HashPassword(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := idKey(password, salt, params)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.Memory,
+		params.Iterations,
+		params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// VerifyPassword compares the password with the encoded hash.
+// needsRehash is true when the hash was created with parameters different from the given ones.
+func VerifyPassword(password, encodedHash string, params Argon2Params) (match, needsRehash bool, err error) {
+	hashParams, salt, key, err := decodePasswordHash(encodedHash)
+	if err != nil {
+		return false, false, err
+	}
+
+	otherKey := idKey(password, salt, hashParams)
+	if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+		return false, false, nil
+	}
+
+	return true, hashParams != params, nil
+}
+
+// idKey derives the Argon2id key of the password once one of hashingSlots is free.
+func idKey(password string, salt []byte, params Argon2Params) []byte {
+	hashingSlots <- struct{}{}
+	defer func() { <-hashingSlots }()
+
+	return argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+}
+
+func decodePasswordHash(encodedHash string) (params Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return Argon2Params{}, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, ErrInvalidPasswordHash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrInvalidPasswordHash
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrInvalidPasswordHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrInvalidPasswordHash
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxLoginAttempts is the number of passwords that can be tried for an account within passwordAttemptsWindow.
+	maxLoginAttempts = 10
+	// maxClientPasswordAttempts is the number of logins and registrations a client IP can make
+	// within passwordAttemptsWindow. It is higher than maxLoginAttempts, since many users may share the IP.
+	maxClientPasswordAttempts = 100
+	// passwordAttemptsWindow starts with the first attempt.
+	passwordAttemptsWindow = time.Minute * 15
+
+	loginAttemptsCacheKeyPrefix          = "login-attempts:"
+	clientPasswordAttemptsCacheKeyPrefix = "password-attempts-ip:"
+)
+
+type registerRequest struct {
+	Email     string `json:"email" binding:"required,email"`
+	Password  string `json:"password" binding:"required"`
+	FirstName string `json:"firstName" binding:"max=100"`
+	LastName  string `json:"lastName" binding:"max=100"`
+}
+
+type loginRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+	// Scopes may be requested for a session with reduced privileges.
+	Scopes []string `json:"scopes"`
+}
+
+type accessTokenResponse struct {
+	AccessToken string `json:"accessToken"`
+	// TwoFactor is set if the session awaits the second factor.
+	TwoFactor string `json:"twoFactor,omitempty"`
+}
+
+// HandleAuthRegister creates a new user with email and password credentials
+// and returns an access token of the new session.
+func HandleAuthRegister(c *gin.Context) {
+	var req registerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+	req.Email = db.NormalizeEmail(req.Email)
+
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	if !countClientPasswordAttempt(c, sessionCache) {
+		abortTooManyPasswordAttempts(c)
+		return
+	}
+
+	passwordConfig := c.MustGet(helper.ContextPasswordConfig).(PasswordConfig)
+	if err := passwordConfig.Policy.Validate(req.Password, req.Email); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	_, err := database.GetUserByEmail(req.Email)
+	if err == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, helper.HTTPMessage{
+			Message: "user with this email already exists",
+		})
+		return
+	}
+	if err != db.ErrNotFound {
+		log.Println("failed to get user by email:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	hash, err := HashPassword(req.Password, passwordConfig.Hashing)
+	if err != nil {
+		log.Println("failed to hash password:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	user := db.User{
+		ID:          uuid.NewString(),
+		FirstName:   req.FirstName,
+		LastName:    req.LastName,
+		Email:       req.Email,
+		AccessLevel: db.AccessLevelBasic,
+		Status:      db.UserStatusActive,
+	}
+	if err = database.CreateUser(&user); err != nil {
+		log.Println("failed to create user:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	err = database.PutPasswordCredential(&db.PasswordCredential{
+		UserID:    user.ID,
+		Hash:      hash,
+		UpdatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("failed to create password credential for user '%s': %s\n", user.ID, err.Error())
+		// The user without the credential is deleted, so that the email can be registered again.
+		if err = database.DeleteUser(user.ID); err != nil {
+			log.Printf("failed to delete user '%s': %s\n", user.ID, err.Error())
+		}
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("created a new user with ID '%s'\n", user.ID)
+
+	respondWithSession(c, http.StatusCreated, user, nil)
+}
+
+// HandleAuthLogin authenticates the user with email and password
+// and returns an access token of the new session.
+func HandleAuthLogin(c *gin.Context) {
+	var req loginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+	req.Email = db.NormalizeEmail(req.Email)
+	if _, ok := requestedScopesOrAbort(c, req.Scopes); !ok {
+		return
+	}
+
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	// The unknown emails are counted as well, so that the response does not reveal whether the user exists.
+	if !countClientPasswordAttempt(c, sessionCache) ||
+		!helper.CountAttempt(sessionCache, loginAttemptsCacheKeyPrefix+req.Email, maxLoginAttempts, passwordAttemptsWindow) {
+		abortTooManyPasswordAttempts(c)
+		return
+	}
+
+	passwordConfig := c.MustGet(helper.ContextPasswordConfig).(PasswordConfig)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+
+	user, credential, err := findPasswordCredential(database, req.Email)
+	if err != nil {
+		if err != db.ErrNotFound {
+			log.Println("failed to find password credential:", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		// Hash anyway, so the response time does not reveal whether the user exists.
+		_, _ = HashPassword(req.Password, passwordConfig.Hashing)
+		abortInvalidCredentials(c)
+		return
+	}
+
+	match, needsRehash, err := VerifyPassword(req.Password, credential.Hash, passwordConfig.Hashing)
+	if err != nil {
+		log.Printf("failed to verify password of user '%s': %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !match {
+		abortInvalidCredentials(c)
+		return
+	}
+	helper.ResetAttempts(sessionCache, loginAttemptsCacheKeyPrefix+req.Email)
+
+	// Upgrade the hash if the hashing parameters have changed since it was created.
+	if needsRehash {
+		rehashPassword(database, user.ID, req.Password, passwordConfig.Hashing)
+	}
+
+	respondWithSession(c, http.StatusOK, user, req.Scopes)
+}
+
+func findPasswordCredential(database db.Adapter, email string) (db.User, db.PasswordCredential, error) {
+	user, err := database.GetUserByEmail(email)
+	if err != nil {
+		return db.User{}, db.PasswordCredential{}, err
+	}
+	credential, err := database.GetPasswordCredential(user.ID)
+	if err != nil {
+		return db.User{}, db.PasswordCredential{}, err
+	}
+	return user, credential, nil
+}
+
+func rehashPassword(database db.Adapter, userID, password string, params Argon2Params) {
+	hash, err := HashPassword(password, params)
+	if err != nil {
+		log.Printf("failed to rehash password of user '%s': %s\n", userID, err.Error())
+		return
+	}
+	err = database.PutPasswordCredential(&db.PasswordCredential{
+		UserID:    userID,
+		Hash:      hash,
+		UpdatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("failed to update password credential of user '%s': %s\n", userID, err.Error())
+	}
+}
+
+// countClientPasswordAttempt counts the password attempt of the client IP
+// and returns false if the IP has no attempts left within the window.
+// The IP is only reliable if the trusted proxies of the engine are configured.
+func countClientPasswordAttempt(c *gin.Context, sessionCache *cache.Cache) bool {
+	return helper.CountAttempt(
+		sessionCache,
+		clientPasswordAttemptsCacheKeyPrefix+c.ClientIP(),
+		maxClientPasswordAttempts,
+		passwordAttemptsWindow,
+	)
+}
+
+func abortTooManyPasswordAttempts(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, helper.HTTPMessage{
+		Message: "too many attempts, try again later",
+	})
+}
+
+func abortInvalidCredentials(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusUnauthorized, helper.HTTPMessage{
+		Message: "invalid email or password",
+	})
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestLoginAttempts(t *testing.T) {
+	database := newTestDB(t)
+	r := newEmailTestRouter(database, &recordingMailer{}, "")
+	password := "Str0ng-Passw0rd!"
+	if w := postJSON(r, "/register", map[string]string{"email": "user@example.com", "password": password}); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	// The successful login resets the attempts of the account.
+	for i := 0; i < maxLoginAttempts-1; i++ {
+		postJSON(r, "/login", map[string]string{"email": "user@example.com", "password": "wrong"})
+	}
+	if w := postJSON(r, "/login", map[string]string{"email": "user@example.com", "password": password}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+	}{
+		{
+			name:     "wrong password",
+			email:    "user@example.com",
+			password: "wrong",
+		},
+		{
+			name:     "unknown email",
+			email:    "nobody@example.com",
+			password: "wrong",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < maxLoginAttempts; i++ {
+				w := postJSON(r, "/login", map[string]string{"email": test.email, "password": test.password})
+				if w.Code != http.StatusUnauthorized {
+					t.Fatalf("expected 401, got %d: %s", w.Code, w.Body)
+				}
+			}
+			// The right password is rejected as well once the attempts are used up.
+			w := postJSON(r, "/login", map[string]string{"email": test.email, "password": password})
+			if w.Code != http.StatusTooManyRequests {
+				t.Errorf("expected 429, got %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestClientPasswordAttempts(t *testing.T) {
+	r := newEmailTestRouter(newTestDB(t), &recordingMailer{}, "")
+
+	// The logins and the registrations share the limit of the client IP.
+	for i := 0; i < maxClientPasswordAttempts; i++ {
+		email := fmt.Sprintf("user%d@example.com", i)
+		w := postJSON(r, "/login", map[string]string{"email": email, "password": "wrong"})
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d: %s", w.Code, w.Body)
+		}
+	}
+	w := postJSON(r, "/register", map[string]string{"email": "new@example.com", "password": "Str0ng-Passw0rd!"})
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %d: %s", w.Code, w.Body)
+	}
+}
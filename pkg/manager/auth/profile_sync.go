@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/users"
+	"github.com/gin-gonic/gin"
+)
+
+// ProfileSyncConfig configures the sync of the user profile from the identity providers on sign in.
+// The fields the user has edited are never overwritten.
+type ProfileSyncConfig struct {
+	// Enabled refreshes the name and the locale of the user on every sign in with a provider.
+	Enabled bool
+	// Photo downloads the provider's picture into the file store
+	// unless the user has uploaded or deleted a photo.
+	Photo bool
+	// MaxPhotoSize is the maximum size of the downloaded picture in bytes.
+	// Defaults to the maximum upload size of the server.
+	MaxPhotoSize int64
+}
+
+var (
+	ErrPrivateAddress = errors.New("private addresses are not allowed")
+	// sharedAddressSpace is used by carrier-grade NATs, see RFC 6598.
+	sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+// photoHTTPClient downloads the pictures of the providers.
+// Some providers let users set the picture URL, so the client refuses to connect to the internal network.
+// The addresses are checked after the DNS resolution, so that the hostnames resolving to them are refused as well.
+var photoHTTPClient = &http.Client{
+	Timeout: time.Second * 15,
+	Transport: &http.Transport{
+		// A proxy would connect on behalf of the client, so the addresses could not be checked.
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: time.Second * 10,
+			Control: refusePrivateAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: time.Second * 10,
+	},
+}
+
+// refusePrivateAddress returns ErrPrivateAddress unless the address to connect to is a public unicast address.
+func refusePrivateAddress(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	addr := addrPort.Addr().Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || sharedAddressSpace.Contains(addr) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, addr)
+	}
+	return nil
+}
+
+// syncProfile updates the profile of the user from the provider's user information.
+// Failures are logged and do not prevent the user from signing in.
+func syncProfile(c *gin.Context, user db.User, userInfo UserInfo) db.User {
+	cfg := c.MustGet(helper.ContextProfileSyncConfig).(ProfileSyncConfig)
+	if !cfg.Enabled {
+		return user
+	}
+
+	var update db.UserUpdate
+	if len(userInfo.GivenName) > 0 && userInfo.GivenName != user.FirstName && !user.IsEdited(db.UserFieldFirstName) {
+		update.FirstName = &userInfo.GivenName
+	}
+	if len(userInfo.FamilyName) > 0 && userInfo.FamilyName != user.LastName && !user.IsEdited(db.UserFieldLastName) {
+		update.LastName = &userInfo.FamilyName
+	}
+	if len(userInfo.Locale) > 0 && userInfo.Locale != user.Locale && !user.IsEdited(db.UserFieldLocale) {
+		update.Locale = &userInfo.Locale
+	}
+	if update != (db.UserUpdate{}) {
+		database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+		updatedUser, err := database.UpdateUser(user.ID, update)
+		if err != nil {
+			log.Printf("failed to sync profile of user '%s': %s\n", user.ID, err.Error())
+			return user
+		}
+		user = updatedUser
+	}
+
+	if cfg.Photo && len(userInfo.Picture) > 0 && userInfo.Picture != user.PhotoSourceURL && !user.IsEdited(db.UserFieldPhoto) {
+		photo, err := downloadPhoto(c, userInfo.Picture, cfg.MaxPhotoSize)
+		if err != nil {
+			log.Printf("failed to download photo of user '%s': %s\n", user.ID, err.Error())
+			return user
+		}
+		ext := users.PhotoExtension(photo)
+		if len(ext) == 0 {
+			log.Printf("failed to sync photo of user '%s': unsupported image format\n", user.ID)
+			return user
+		}
+		updatedUser, err := users.SavePhoto(c, user, photo, ext, userInfo.Picture)
+		if err != nil {
+			log.Printf("failed to save photo of user '%s': %s\n", user.ID, err.Error())
+			return user
+		}
+		user = updatedUser
+	}
+
+	return user
+}
+
+// downloadPhoto downloads the picture from the provider.
+func downloadPhoto(c *gin.Context, pictureURL string, maxSize int64) ([]byte, error) {
+	u, err := url.Parse(pictureURL)
+	if err != nil || u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid picture URL '%s'", pictureURL)
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := photoHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+
+	photo, err := io.ReadAll(io.LimitReader(response.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(photo)) > maxSize {
+		return nil, fmt.Errorf("picture is larger than %d bytes", maxSize)
+	}
+	return photo, nil
+}
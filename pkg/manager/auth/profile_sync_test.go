@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRefusePrivateAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{address: "93.184.216.34:443", allowed: true},
+		{address: "[2606:2800:220:1:248:1893:25c8:1946]:443", allowed: true},
+		{address: "127.0.0.1:443"},
+		{address: "[::1]:443"},
+		{address: "10.0.0.1:443"},
+		{address: "172.16.0.1:443"},
+		{address: "192.168.1.1:443"},
+		{address: "169.254.169.254:80"},
+		{address: "100.64.0.1:443"},
+		{address: "0.0.0.0:443"},
+		{address: "[fd00::1]:443"},
+		{address: "[fe80::1]:443"},
+		{address: "[::ffff:127.0.0.1]:443"},
+		{address: "224.0.0.1:443"},
+	}
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			err := refusePrivateAddress("tcp", test.address, nil)
+			if test.allowed && err != nil {
+				t.Errorf("expected the address to be allowed, got %v", err)
+			}
+			if !test.allowed && !errors.Is(err, ErrPrivateAddress) {
+				t.Errorf("expected ErrPrivateAddress, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDownloadPhotoPrivateAddress(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request must not reach the server")
+	}))
+	t.Cleanup(server.Close)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, err := downloadPhoto(c, server.URL+"/photo.png", 1024); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("expected ErrPrivateAddress, got %v", err)
+	}
+}
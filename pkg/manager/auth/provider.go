@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"errors"
+)
+
+// UserInfo is the identity information returned by an authentication provider.
+type UserInfo struct {
+	// Subject is the unique user identifier assigned by the provider.
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	VerifiedEmail bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+	Picture       string `json:"picture"`
+	Locale        string `json:"locale"`
+}
+
+// Provider is an OAuth 2.0 based authentication provider.
+type Provider interface {
+	// Name returns the name of the provider as used in the routes,
+	// e.g. 'google' for /api/v1/auth/google.
+	Name() string
+	// AuthCodeURL returns the URL of the provider's consent page.
+	// The S256 PKCE challenge of the code verifier is added to the URL.
+	AuthCodeURL(state, nonce, codeVerifier string) string
+	// Exchange converts the authorization code into the user information.
+	// The nonce and the code verifier must match the ones passed to AuthCodeURL.
+	Exchange(ctx context.Context, code, nonce, codeVerifier string) (UserInfo, error)
+}
+
+// Providers is a registry of authentication providers by name.
+type Providers map[string]Provider
+
+var (
+	ErrUnknownProvider = errors.New("unknown authentication provider")
+)
+
+// NewProviders creates a registry out of the given providers.
+func NewProviders(providers ...Provider) Providers {
+	registry := make(Providers, len(providers))
+	for _, p := range providers {
+		registry[p.Name()] = p
+	}
+	return registry
+}
+
+// Get finds a provider by name.
+func (p Providers) Get(name string) (Provider, error) {
+	provider, ok := p[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return provider, nil
+}
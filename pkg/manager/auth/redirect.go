@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// Token delivery modes of the redirect after authentication.
+const (
+	// TokenDeliveryQuery adds 'access_token' to the query of the redirect URL.
+	TokenDeliveryQuery = "query"
+	// TokenDeliveryFragment adds 'access_token' to the fragment of the redirect URL,
+	// so it is not sent to servers or leaked in Referer headers.
+	TokenDeliveryFragment = "fragment"
+	// TokenDeliveryCode adds a single-use 'code' to the query of the redirect URL
+	// that is exchanged for the access token via HandleTokenExchange.
+	TokenDeliveryCode = "code"
+)
+
+var ErrRedirectURLNotAllowed = errors.New("'redirect_url' is not allowed")
+
+// RedirectConfig restricts where users are redirected after authentication
+// and how the access token is delivered.
+type RedirectConfig struct {
+	// AllowedOrigins are the allowed schemes and hosts of redirect URLs, e.g. 'https://example.com'.
+	// A host starting with '*.' allows any subdomain, e.g. 'https://*.example.com'.
+	// No redirects are allowed if it is empty.
+	AllowedOrigins []string
+	// AllowedPaths are the allowed path patterns of redirect URLs in path.Match syntax, e.g. '/auth/*'.
+	// Any path is allowed if it is empty.
+	AllowedPaths []string
+	// TokenDelivery is TokenDeliveryQuery, TokenDeliveryFragment or TokenDeliveryCode.
+	// The code is always used if the client passes a PKCE 'code_challenge'.
+	TokenDelivery string
+}
+
+// Validate returns ErrRedirectURLNotAllowed if the redirect URL does not match the allow-list.
+func (r RedirectConfig) Validate(redirectURL string) error {
+	u, err := url.Parse(redirectURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 || u.User != nil {
+		return ErrRedirectURLNotAllowed
+	}
+	if !r.originAllowed(u) || !r.pathAllowed(u) {
+		return ErrRedirectURLNotAllowed
+	}
+	return nil
+}
+
+func (r RedirectConfig) originAllowed(u *url.URL) bool {
+	for _, origin := range r.AllowedOrigins {
+		allowed, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(allowed.Scheme, u.Scheme) {
+			continue
+		}
+		host := strings.ToLower(u.Host)
+		allowedHost := strings.ToLower(allowed.Host)
+		if suffix, ok := strings.CutPrefix(allowedHost, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+			continue
+		}
+		if host == allowedHost {
+			return true
+		}
+	}
+	return false
+}
+
+func (r RedirectConfig) pathAllowed(u *url.URL) bool {
+	if len(r.AllowedPaths) == 0 {
+		return true
+	}
+	// Browsers resolve dot segments, so the patterns are matched against the resolved path.
+	p := path.Clean("/" + u.Path)
+	for _, pattern := range r.AllowedPaths {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectURLOrAbort returns 'redirect_url' from the query
+// and aborts the request if it is missing or not allowed.
+func redirectURLOrAbort(c *gin.Context) (string, bool) {
+	redirectURL := c.Query("redirect_url")
+	if len(redirectURL) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "'redirect_url' is missing in the request",
+		})
+		return "", false
+	}
+	redirectConfig := c.MustGet(helper.ContextRedirectConfig).(RedirectConfig)
+	if err := redirectConfig.Validate(redirectURL); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: err.Error(),
+		})
+		return "", false
+	}
+	return redirectURL, true
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRedirectConfigValidate(t *testing.T) {
+	config := RedirectConfig{
+		AllowedOrigins: []string{"https://example.com", "https://*.apps.example.com", "http://localhost:3000"},
+		AllowedPaths:   []string{"/", "/auth/*"},
+	}
+	tests := []struct {
+		name        string
+		redirectURL string
+		allowed     bool
+	}{
+		{
+			name:        "allowed origin",
+			redirectURL: "https://example.com/",
+			allowed:     true,
+		},
+		{
+			name:        "allowed path",
+			redirectURL: "https://example.com/auth/callback?next=/home",
+			allowed:     true,
+		},
+		{
+			name:        "host in another case",
+			redirectURL: "https://EXAMPLE.com/",
+			allowed:     true,
+		},
+		{
+			name:        "subdomain",
+			redirectURL: "https://app.apps.example.com/",
+			allowed:     true,
+		},
+		{
+			name:        "origin with port",
+			redirectURL: "http://localhost:3000/",
+			allowed:     true,
+		},
+		{
+			name:        "parent of the wildcard",
+			redirectURL: "https://apps.example.com/",
+		},
+		{
+			name:        "host with the allowed suffix",
+			redirectURL: "https://evilapps.example.com/",
+		},
+		{
+			name:        "allowed host as a subdomain",
+			redirectURL: "https://example.com.evil.com/",
+		},
+		{
+			name:        "another scheme",
+			redirectURL: "http://example.com/",
+		},
+		{
+			name:        "another port",
+			redirectURL: "http://localhost:8080/",
+		},
+		{
+			name:        "user info",
+			redirectURL: "https://example.com@evil.com/",
+		},
+		{
+			name:        "backslash",
+			redirectURL: "https://example.com\\@evil.com/",
+		},
+		{
+			name:        "protocol-relative",
+			redirectURL: "//evil.com/",
+		},
+		{
+			name:        "relative",
+			redirectURL: "/auth/callback",
+		},
+		{
+			name:        "javascript",
+			redirectURL: "javascript:alert(1)",
+		},
+		{
+			name:        "path not allowed",
+			redirectURL: "https://example.com/admin",
+		},
+		{
+			name:        "dot segments",
+			redirectURL: "https://example.com/auth/../admin",
+		},
+		{
+			name:        "invalid URL",
+			redirectURL: "https://example.com/%zz",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := config.Validate(test.redirectURL)
+			if test.allowed && err != nil {
+				t.Errorf("expected the redirect URL to be allowed, got %v", err)
+			}
+			if !test.allowed && !errors.Is(err, ErrRedirectURLNotAllowed) {
+				t.Errorf("expected %v, got %v", ErrRedirectURLNotAllowed, err)
+			}
+		})
+	}
+
+	if err := (RedirectConfig{}).Validate("https://example.com/"); !errors.Is(err, ErrRedirectURLNotAllowed) {
+		t.Errorf("expected no redirects to be allowed by default, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes limit what a session or an API key can do on behalf of the user,
+// so that third-party clients can receive reduced privileges.
+const (
+	ScopeProfileRead      = "profile:read"
+	ScopeProfileWrite     = "profile:write"
+	ScopePhotoWrite       = "photo:write"
+	ScopeCredentialsRead  = "credentials:read"
+	ScopeCredentialsWrite = "credentials:write"
+	ScopeOrgsRead         = "orgs:read"
+	ScopeOrgsWrite        = "orgs:write"
+	ScopeFilesRead        = "files:read"
+	ScopeFilesWrite       = "files:write"
+	ScopeAdminUsers       = "admin:users"
+)
+
+var ErrInvalidScope = errors.New("invalid scope")
+
+// ScopesConfig maps access levels to the scopes their sessions and API keys may receive.
+type ScopesConfig map[string][]string
+
+var DefaultScopes = ScopesConfig{
+	db.AccessLevelBasic: {
+		ScopeProfileRead,
+		ScopeProfileWrite,
+		ScopePhotoWrite,
+		ScopeCredentialsRead,
+		ScopeCredentialsWrite,
+		ScopeOrgsRead,
+		ScopeOrgsWrite,
+		ScopeFilesRead,
+		ScopeFilesWrite,
+	},
+	db.AccessLevelAdmin: {
+		ScopeProfileRead,
+		ScopeProfileWrite,
+		ScopePhotoWrite,
+		ScopeCredentialsRead,
+		ScopeCredentialsWrite,
+		ScopeOrgsRead,
+		ScopeOrgsWrite,
+		ScopeFilesRead,
+		ScopeFilesWrite,
+		ScopeAdminUsers,
+	},
+}
+
+// Validate returns an error if any of the scopes is not known to any access level.
+func (s ScopesConfig) Validate(scopes []string) error {
+	for _, scope := range scopes {
+		known := false
+		for _, allowed := range s {
+			if containsScope(allowed, scope) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("%w '%s'", ErrInvalidScope, scope)
+		}
+	}
+	return nil
+}
+
+// Grant returns the requested scopes if the access level may receive all of them.
+// All scopes of the access level are granted if none are requested.
+func (s ScopesConfig) Grant(accessLevel string, requested []string) ([]string, error) {
+	allowed := s[accessLevel]
+	if len(requested) == 0 {
+		return append([]string{}, allowed...), nil
+	}
+	return restrictScopes(allowed, requested)
+}
+
+// ParseScopes parses the space-delimited scopes of 'scope' query parameter.
+func ParseScopes(scope string) []string {
+	return strings.Fields(scope)
+}
+
+// RequireScope returns a middleware that verifies that the session or the API key
+// of the authenticated user has all the scopes.
+func RequireScope(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted := c.GetStringSlice(helper.ContextScopes)
+		for _, scope := range scopes {
+			if !containsScope(granted, scope) {
+				c.AbortWithStatusJSON(
+					http.StatusForbidden,
+					helper.HTTPMessage{Message: "insufficient scope, '" + scope + "' is required"},
+				)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// restrictScopes returns the requested scopes if all of them are allowed.
+func restrictScopes(allowed, requested []string) ([]string, error) {
+	scopes := make([]string, 0, len(requested))
+	for _, scope := range requested {
+		if !containsScope(allowed, scope) {
+			return nil, fmt.Errorf("%w '%s'", ErrInvalidScope, scope)
+		}
+		if !containsScope(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// intersectScopes returns the scopes that are both granted and allowed.
+func intersectScopes(granted, allowed []string) []string {
+	scopes := make([]string, 0, len(granted))
+	for _, scope := range granted {
+		if containsScope(allowed, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
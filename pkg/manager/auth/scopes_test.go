@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+func TestScopesConfigGrant(t *testing.T) {
+	tests := []struct {
+		name        string
+		accessLevel string
+		requested   []string
+		scopes      []string
+		err         error
+	}{
+		{
+			name:        "all scopes of the access level",
+			accessLevel: db.AccessLevelBasic,
+			scopes:      DefaultScopes[db.AccessLevelBasic],
+		},
+		{
+			name:        "requested scopes",
+			accessLevel: db.AccessLevelBasic,
+			requested:   []string{ScopeProfileRead, ScopeFilesRead},
+			scopes:      []string{ScopeProfileRead, ScopeFilesRead},
+		},
+		{
+			name:        "duplicate scopes",
+			accessLevel: db.AccessLevelBasic,
+			requested:   []string{ScopeProfileRead, ScopeProfileRead},
+			scopes:      []string{ScopeProfileRead},
+		},
+		{
+			name:        "scope of another access level",
+			accessLevel: db.AccessLevelBasic,
+			requested:   []string{ScopeProfileRead, ScopeAdminUsers},
+			err:         ErrInvalidScope,
+		},
+		{
+			name:        "unknown scope",
+			accessLevel: db.AccessLevelAdmin,
+			requested:   []string{"everything"},
+			err:         ErrInvalidScope,
+		},
+		{
+			name:        "unknown access level",
+			accessLevel: "unknown",
+			requested:   []string{ScopeProfileRead},
+			err:         ErrInvalidScope,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scopes, err := DefaultScopes.Grant(test.accessLevel, test.requested)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if test.err == nil && !reflect.DeepEqual(scopes, test.scopes) {
+				t.Errorf("expected %v, got %v", test.scopes, scopes)
+			}
+		})
+	}
+}
+
+func TestScopesConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		err    error
+	}{
+		{
+			name: "no scopes",
+		},
+		{
+			name:   "known scopes",
+			scopes: []string{ScopeProfileRead, ScopeAdminUsers},
+		},
+		{
+			name:   "unknown scope",
+			scopes: []string{ScopeProfileRead, "everything"},
+			err:    ErrInvalidScope,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := DefaultScopes.Validate(test.scopes); !errors.Is(err, test.err) {
+				t.Errorf("expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestIntersectScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		granted []string
+		allowed []string
+		scopes  []string
+	}{
+		{
+			name:    "all allowed",
+			granted: []string{ScopeProfileRead, ScopeFilesRead},
+			allowed: DefaultScopes[db.AccessLevelBasic],
+			scopes:  []string{ScopeProfileRead, ScopeFilesRead},
+		},
+		{
+			name:    "access level was lowered",
+			granted: []string{ScopeProfileRead, ScopeAdminUsers},
+			allowed: DefaultScopes[db.AccessLevelBasic],
+			scopes:  []string{ScopeProfileRead},
+		},
+		{
+			name:    "nothing allowed",
+			granted: []string{ScopeProfileRead},
+			scopes:  []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if scopes := intersectScopes(test.granted, test.allowed); !reflect.DeepEqual(scopes, test.scopes) {
+				t.Errorf("expected %v, got %v", test.scopes, scopes)
+			}
+		})
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		granted []string
+		status  int
+	}{
+		{
+			name:    "all scopes granted",
+			granted: []string{ScopeProfileRead, ScopeProfileWrite},
+			status:  http.StatusOK,
+		},
+		{
+			name:    "scope missing",
+			granted: []string{ScopeProfileRead},
+			status:  http.StatusForbidden,
+		},
+		{
+			name:   "no scopes",
+			status: http.StatusForbidden,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(func(c *gin.Context) {
+				c.Set(helper.ContextScopes, test.granted)
+			})
+			r.GET("/", RequireScope(ScopeProfileRead, ScopeProfileWrite), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != test.status {
+				t.Errorf("expected %d, got %d", test.status, w.Code)
+			}
+		})
+	}
+}
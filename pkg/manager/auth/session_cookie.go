@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// SessionCookieConfig is the configuration of the cookie sessions for browsers.
+// The session is kept in an HttpOnly cookie and the unsafe requests must echo
+// the CSRF token from a readable cookie in a header.
+type SessionCookieConfig struct {
+	// Enabled sets the session cookie when a session is created
+	// and accepts it instead of 'Access-Token' header.
+	Enabled bool
+	// Name is the name of the HttpOnly session cookie.
+	Name string
+	// CSRFName is the name of the cookie with the CSRF token readable by the frontend.
+	CSRFName string
+	// CSRFHeader is the header that must contain the CSRF token in unsafe requests.
+	CSRFHeader string
+	// Domain of the cookies. Defaults to the host of the request.
+	Domain string
+	// Path of the cookies.
+	Path string
+	// Insecure allows the cookies over plain HTTP, e.g. for local development.
+	Insecure bool
+	// SameSite of the cookies.
+	SameSite http.SameSite
+}
+
+// HandleLogout deletes the session of the request and the session cookies.
+func HandleLogout(c *gin.Context) {
+	if accessToken, _ := requestAccessToken(c); len(accessToken) > 0 {
+		sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+		sessionCache.Delete(accessToken)
+	}
+	clearSessionCookies(c)
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// CSRFMiddleware verifies that the unsafe requests authenticated with the session cookie
+// have the CSRF token of the session in the CSRF header.
+// Requests authenticated with headers are not affected, as browsers do not add them on their own.
+func CSRFMiddleware(c *gin.Context) {
+	cfg := c.MustGet(helper.ContextSessionCookieConfig).(SessionCookieConfig)
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+	accessToken, fromCookie := requestAccessToken(c)
+	if !cfg.Enabled || !fromCookie || len(c.GetHeader("Authorization")) > 0 {
+		c.Next()
+		return
+	}
+
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	session, ok := sessionCache.Get(accessToken)
+	if !ok {
+		// There is no session to protect.
+		c.Next()
+		return
+	}
+	csrfToken := session.(helper.SessionData).CSRFToken
+	if len(csrfToken) == 0 || subtle.ConstantTimeCompare([]byte(c.GetHeader(cfg.CSRFHeader)), []byte(csrfToken)) != 1 {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			helper.HTTPMessage{Message: "invalid CSRF token"},
+		)
+		return
+	}
+	c.Next()
+}
+
+// requestAccessToken returns the access token from 'Access-Token' header
+// or from the session cookie if cookie sessions are enabled.
+func requestAccessToken(c *gin.Context) (accessToken string, fromCookie bool) {
+	if accessToken = c.GetHeader("Access-Token"); len(accessToken) > 0 {
+		return accessToken, false
+	}
+	cfg := c.MustGet(helper.ContextSessionCookieConfig).(SessionCookieConfig)
+	if !cfg.Enabled {
+		return "", false
+	}
+	accessToken, err := c.Cookie(cfg.Name)
+	if err != nil {
+		return "", false
+	}
+	return accessToken, true
+}
+
+// setSessionCookies sets the session and the CSRF cookies if cookie sessions are enabled.
+func setSessionCookies(c *gin.Context, accessToken string, sessionData helper.SessionData) {
+	cfg := c.MustGet(helper.ContextSessionCookieConfig).(SessionCookieConfig)
+	if !cfg.Enabled {
+		return
+	}
+	maxAge := int(sessionDataTTL(sessionData).Seconds())
+	http.SetCookie(c.Writer, cfg.cookie(cfg.Name, accessToken, maxAge, true))
+	http.SetCookie(c.Writer, cfg.cookie(cfg.CSRFName, sessionData.CSRFToken, maxAge, false))
+}
+
+// clearSessionCookies deletes the session and the CSRF cookies if cookie sessions are enabled.
+func clearSessionCookies(c *gin.Context) {
+	cfg := c.MustGet(helper.ContextSessionCookieConfig).(SessionCookieConfig)
+	if !cfg.Enabled {
+		return
+	}
+	http.SetCookie(c.Writer, cfg.cookie(cfg.Name, "", -1, true))
+	http.SetCookie(c.Writer, cfg.cookie(cfg.CSRFName, "", -1, false))
+}
+
+func (cfg SessionCookieConfig) cookie(name, value string, maxAge int, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     cfg.Path,
+		Domain:   cfg.Domain,
+		MaxAge:   maxAge,
+		Secure:   !cfg.Insecure,
+		HttpOnly: httpOnly,
+		SameSite: cfg.SameSite,
+	}
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	sessionCache := cache.New(time.Minute)
+	sessionData := helper.SessionData{UserID: "user"}
+	accessToken := storeSession(sessionCache, &sessionData)
+	cfg := SessionCookieConfig{
+		Enabled:    true,
+		Name:       "session",
+		CSRFName:   "csrf_token",
+		CSRFHeader: "X-CSRF-Token",
+		Path:       "/",
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		cookie  string
+		headers map[string]string
+		enabled bool
+		status  int
+	}{
+		{
+			name:    "matching CSRF token",
+			method:  http.MethodPost,
+			cookie:  accessToken,
+			headers: map[string]string{"X-CSRF-Token": sessionData.CSRFToken},
+			enabled: true,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "missing CSRF token",
+			method:  http.MethodPost,
+			cookie:  accessToken,
+			enabled: true,
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "wrong CSRF token",
+			method:  http.MethodDelete,
+			cookie:  accessToken,
+			headers: map[string]string{"X-CSRF-Token": "wrong"},
+			enabled: true,
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "CSRF token in another header",
+			method:  http.MethodPut,
+			cookie:  accessToken,
+			headers: map[string]string{"X-Other": sessionData.CSRFToken},
+			enabled: true,
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "safe method",
+			method:  http.MethodGet,
+			cookie:  accessToken,
+			enabled: true,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "access token header",
+			method:  http.MethodPost,
+			cookie:  accessToken,
+			headers: map[string]string{"Access-Token": accessToken},
+			enabled: true,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "unknown session",
+			method:  http.MethodPost,
+			cookie:  "unknown",
+			enabled: true,
+			status:  http.StatusOK,
+		},
+		{
+			name:   "cookie sessions disabled",
+			method: http.MethodPost,
+			cookie: accessToken,
+			status: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testCfg := cfg
+			testCfg.Enabled = test.enabled
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(func(c *gin.Context) {
+				c.Set(helper.ContextCache, sessionCache)
+				c.Set(helper.ContextSessionCookieConfig, testCfg)
+			})
+			r.Use(CSRFMiddleware)
+			r.Handle(test.method, "/", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(test.method, "/", nil)
+			req.AddCookie(&http.Cookie{Name: cfg.Name, Value: test.cookie})
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != test.status {
+				t.Errorf("expected %d, got %d: %s", test.status, w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid or expired token")
+)
+
+// issueToken creates a new single-use token out of the template and returns its raw value.
+// Only the hash of the token is stored in the database.
+func issueToken(database db.Adapter, token db.Token, ttl time.Duration) (string, error) {
+	rawToken := helper.GenerateRandomString(32)
+	now := time.Now().UTC()
+	token.Hash = helper.HashToken(rawToken)
+	token.CreatedAt = now
+	token.ExpiresAt = now.Add(ttl)
+	err := database.CreateToken(&token)
+	if err != nil {
+		return "", err
+	}
+	return rawToken, nil
+}
+
+// findToken finds the token that is not expired without invalidating it.
+func findToken(database db.Adapter, purpose, rawToken string) (db.Token, error) {
+	if len(rawToken) == 0 {
+		return db.Token{}, ErrInvalidToken
+	}
+	token, err := database.GetToken(purpose, helper.HashToken(rawToken))
+	if err != nil {
+		if err == db.ErrNotFound {
+			return db.Token{}, ErrInvalidToken
+		}
+		return db.Token{}, err
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return db.Token{}, ErrInvalidToken
+	}
+	return token, nil
+}
+
+// consumeToken finds the token and invalidates it, so it cannot be used again.
+func consumeToken(database db.Adapter, purpose, rawToken string) (db.Token, error) {
+	if len(rawToken) == 0 {
+		return db.Token{}, ErrInvalidToken
+	}
+	token, err := database.ConsumeToken(purpose, helper.HashToken(rawToken))
+	if err != nil {
+		if err == db.ErrNotFound {
+			return db.Token{}, ErrInvalidToken
+		}
+		return db.Token{}, err
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return db.Token{}, ErrInvalidToken
+	}
+	return token, nil
+}
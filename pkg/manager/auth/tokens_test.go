@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	localDB "github.com/bazuker/backend-bootstrap/pkg/db/local"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+)
+
+func newTestDB(t *testing.T) db.Adapter {
+	t.Helper()
+	database, err := localDB.New(localDB.Config{Filename: filepath.Join(t.TempDir(), "db.json")})
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	return database
+}
+
+func TestConsumeToken(t *testing.T) {
+	database := newTestDB(t)
+	rawToken, err := issueToken(database, db.Token{
+		Purpose: db.TokenPurposePasswordReset,
+		UserID:  "user",
+		Email:   "user@example.com",
+	}, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue token: %s", err)
+	}
+
+	token, err := consumeToken(database, db.TokenPurposePasswordReset, rawToken)
+	if err != nil {
+		t.Fatalf("failed to consume token: %s", err)
+	}
+	if token.UserID != "user" || token.Email != "user@example.com" {
+		t.Errorf("unexpected token %+v", token)
+	}
+
+	// The token is single-use.
+	if _, err = consumeToken(database, db.TokenPurposePasswordReset, rawToken); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken on reuse, got %v", err)
+	}
+}
+
+func TestConsumeTokenExpired(t *testing.T) {
+	database := newTestDB(t)
+	rawToken, err := issueToken(database, db.Token{Purpose: db.TokenPurposeMagicLink}, -time.Second)
+	if err != nil {
+		t.Fatalf("failed to issue token: %s", err)
+	}
+
+	if _, err = consumeToken(database, db.TokenPurposeMagicLink, rawToken); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+	// The expired token is used up as well.
+	if _, err = database.ConsumeToken(db.TokenPurposeMagicLink, helper.HashToken(rawToken)); err != db.ErrNotFound {
+		t.Errorf("expected the expired token to be deleted, got %v", err)
+	}
+}
+
+func TestConsumeTokenPurpose(t *testing.T) {
+	database := newTestDB(t)
+	rawToken, err := issueToken(database, db.Token{Purpose: db.TokenPurposeEmailVerification}, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue token: %s", err)
+	}
+
+	// A token is only valid for the purpose it was issued for.
+	if _, err = consumeToken(database, db.TokenPurposePasswordReset, rawToken); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken for another purpose, got %v", err)
+	}
+	if _, err = consumeToken(database, db.TokenPurposeEmailVerification, rawToken); err != nil {
+		t.Errorf("expected the token to stay valid for its purpose, got %v", err)
+	}
+}
+
+func TestConsumeTokenInvalid(t *testing.T) {
+	database := newTestDB(t)
+	for _, rawToken := range []string{"", "unknown"} {
+		if _, err := consumeToken(database, db.TokenPurposeMagicLink, rawToken); err != ErrInvalidToken {
+			t.Errorf("expected ErrInvalidToken for '%s', got %v", rawToken, err)
+		}
+	}
+}
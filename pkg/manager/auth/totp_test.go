@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+)
+
+// testTOTPSecret is the secret of the RFC 6238 test vectors, i.e. "12345678901234567890".
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// testTOTPCode returns the code of the secret at the given time.
+func testTOTPCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("failed to decode secret: %s", err)
+	}
+	return totpCode(key, at.Unix()/totpPeriod)
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		ok     bool
+		step   int64
+	}{
+		{
+			name:   "RFC 6238 test vector",
+			secret: testTOTPSecret,
+			code:   "081804",
+			ok:     true,
+			step:   now.Unix() / totpPeriod,
+		},
+		{
+			name:   "lower case secret",
+			secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq",
+			code:   "081804",
+			ok:     true,
+			step:   now.Unix() / totpPeriod,
+		},
+		{
+			name:   "previous period",
+			secret: testTOTPSecret,
+			code:   testTOTPCode(t, testTOTPSecret, now.Add(-time.Second*totpPeriod)),
+			ok:     true,
+			step:   now.Unix()/totpPeriod - 1,
+		},
+		{
+			name:   "next period",
+			secret: testTOTPSecret,
+			code:   testTOTPCode(t, testTOTPSecret, now.Add(time.Second*totpPeriod)),
+			ok:     true,
+			step:   now.Unix()/totpPeriod + 1,
+		},
+		{
+			name:   "outside of the skew",
+			secret: testTOTPSecret,
+			code:   testTOTPCode(t, testTOTPSecret, now.Add(-time.Second*totpPeriod*2)),
+		},
+		{
+			name:   "wrong code",
+			secret: testTOTPSecret,
+			code:   "000000",
+		},
+		{
+			name:   "wrong length",
+			secret: testTOTPSecret,
+			code:   "81804",
+		},
+		{
+			name:   "invalid secret",
+			secret: "not base32!",
+			code:   "081804",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(test.secret, test.code, now)
+			if ok != test.ok || step != test.step {
+				t.Errorf("expected (%d, %t), got (%d, %t)", test.step, test.ok, step, ok)
+			}
+		})
+	}
+}
+
+// createTestTOTPCredential stores an enabled credential of the user with the recovery code.
+func createTestTOTPCredential(t *testing.T, database db.Adapter, userID, recoveryCode string) {
+	t.Helper()
+	err := database.PutTOTPCredential(&db.TOTPCredential{
+		UserID:             userID,
+		Secret:             testTOTPSecret,
+		Enabled:            true,
+		RecoveryCodeHashes: []string{helper.HashToken(recoveryCode)},
+		CreatedAt:          time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("failed to put TOTP credential: %s", err)
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	tests := []struct {
+		name string
+		req  twoFactorCodeRequest
+	}{
+		{
+			name: "code",
+			req:  twoFactorCodeRequest{Code: testTOTPCode(t, testTOTPSecret, time.Now())},
+		},
+		{
+			name: "recovery code",
+			req:  twoFactorCodeRequest{RecoveryCode: " ABCDE-fghij "},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database := newTestDB(t)
+			createTestTOTPCredential(t, database, "user", "abcde-fghij")
+
+			ok, err := verifySecondFactor(database, "user", test.req)
+			if err != nil || !ok {
+				t.Fatalf("expected the code to be accepted, got (%t, %v)", ok, err)
+			}
+
+			// The code cannot be used again.
+			ok, err = verifySecondFactor(database, "user", test.req)
+			if err != nil || ok {
+				t.Errorf("expected the code to be rejected on reuse, got (%t, %v)", ok, err)
+			}
+		})
+	}
+}
+
+func TestVerifySecondFactorConcurrentReplay(t *testing.T) {
+	database := newTestDB(t)
+	createTestTOTPCredential(t, database, "user", "abcde-fghij")
+	req := twoFactorCodeRequest{Code: testTOTPCode(t, testTOTPSecret, time.Now())}
+
+	var (
+		wg       sync.WaitGroup
+		mx       sync.Mutex
+		accepted int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := verifySecondFactor(database, "user", req)
+			if err != nil {
+				t.Errorf("failed to verify second factor: %s", err)
+			}
+			if ok {
+				mx.Lock()
+				accepted++
+				mx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted != 1 {
+		t.Errorf("expected the code to be accepted once, got %d", accepted)
+	}
+}
@@ -0,0 +1,362 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// totpCredentialsMx makes sure that a code or a recovery code is used only once.
+var totpCredentialsMx sync.Mutex
+
+const (
+	twoFactorStatusRequired           = "required"
+	twoFactorStatusEnrollmentRequired = "enrollment_required"
+
+	recoveryCodesCount = 10
+	// maxTwoFactorAttempts is the number of codes a user can try within twoFactorLockoutWindow.
+	// The pending session is revoked once they are used up.
+	maxTwoFactorAttempts = 5
+	// twoFactorLockoutWindow starts with the first invalid code of the user.
+	twoFactorLockoutWindow = time.Minute * 15
+
+	twoFactorAttemptsCacheKeyPrefix = "2fa-attempts:"
+)
+
+// TwoFactorConfig is the configuration of the two-factor authentication.
+type TwoFactorConfig struct {
+	// Issuer is the name displayed in authenticator apps, e.g. 'Example'.
+	Issuer string
+	// RequiredAccessLevels are the access levels that must use two-factor authentication,
+	// e.g. db.AccessLevelAdmin.
+	RequiredAccessLevels []string
+}
+
+// IsRequired returns true if the access level must use two-factor authentication.
+func (t TwoFactorConfig) IsRequired(accessLevel string) bool {
+	return slices.Contains(t.RequiredAccessLevels, accessLevel)
+}
+
+type totpEnrollmentResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioningURI"`
+}
+
+type totpConfirmResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+	// AccessToken is set if the session was restricted to the enrollment
+	// and has been replaced by an unrestricted one.
+	AccessToken string `json:"accessToken,omitempty"`
+}
+
+type twoFactorCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// HandleTOTPEnrollment starts the TOTP enrollment of the authenticated user.
+// The returned provisioning URI is meant to be displayed as a QR code.
+func HandleTOTPEnrollment(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("failed to get user by ID '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			helper.HTTPMessage{Message: "failed to get user"},
+		)
+		return
+	}
+	credential, err := database.GetTOTPCredential(userID)
+	if err != nil && err != db.ErrNotFound {
+		log.Printf("failed to get TOTP credential of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err == nil && credential.Enabled {
+		c.AbortWithStatusJSON(http.StatusConflict, helper.HTTPMessage{
+			Message: "two-factor authentication is already enabled",
+		})
+		return
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		log.Println("failed to generate TOTP secret:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	err = database.PutTOTPCredential(&db.TOTPCredential{
+		UserID:    userID,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("failed to create TOTP credential for user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	twoFactorConfig := c.MustGet(helper.ContextTwoFactorConfig).(TwoFactorConfig)
+	c.JSON(http.StatusOK, totpEnrollmentResponse{
+		Secret:          secret,
+		ProvisioningURI: TOTPProvisioningURI(twoFactorConfig.Issuer, user.Email, secret),
+	})
+}
+
+// HandleTOTPConfirm completes the TOTP enrollment with a code from the authenticator app
+// and returns the recovery codes. The recovery codes are only shown once.
+func HandleTOTPConfirm(c *gin.Context) {
+	var req twoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Code) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "'code' is missing in the request",
+		})
+		return
+	}
+
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	credential, err := database.GetTOTPCredential(userID)
+	if err != nil {
+		if err == db.ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{
+				Message: "two-factor authentication enrollment is not started",
+			})
+			return
+		}
+		log.Printf("failed to get TOTP credential of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if credential.Enabled {
+		c.AbortWithStatusJSON(http.StatusConflict, helper.HTTPMessage{
+			Message: "two-factor authentication is already enabled",
+		})
+		return
+	}
+
+	step, ok := ValidateTOTP(credential.Secret, req.Code, time.Now())
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: "invalid code"})
+		return
+	}
+	recoveryCodes, err := generateRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		log.Println("failed to generate recovery codes:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	credential.Enabled = true
+	credential.LastUsedStep = step
+	credential.RecoveryCodeHashes = make([]string, len(recoveryCodes))
+	for i := range recoveryCodes {
+		credential.RecoveryCodeHashes[i] = helper.HashToken(recoveryCodes[i])
+	}
+	if err = database.PutTOTPCredential(&credential); err != nil {
+		log.Printf("failed to update TOTP credential of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := totpConfirmResponse{RecoveryCodes: recoveryCodes}
+
+	// Lift the enrollment restriction by replacing the session.
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	accessToken := c.MustGet(helper.ContextAccessToken).(string)
+	if session, ok := sessionCache.Get(accessToken); ok {
+		sessionData := session.(helper.SessionData)
+		if sessionData.TwoFactorEnrollmentRequired {
+			sessionCache.Delete(accessToken)
+			sessionData.TwoFactorEnrollmentRequired = false
+			response.AccessToken = storeSession(sessionCache, &sessionData)
+			setSessionCookies(c, response.AccessToken, sessionData)
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// HandleTOTPDisable disables TOTP of the authenticated user.
+// A valid code or a recovery code is required and the codes are limited the same way as the verification.
+func HandleTOTPDisable(c *gin.Context) {
+	var req twoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	twoFactorConfig := c.MustGet(helper.ContextTwoFactorConfig).(TwoFactorConfig)
+	if twoFactorConfig.IsRequired(c.MustGet(helper.ContextUserAccessLevel).(string)) {
+		c.AbortWithStatusJSON(http.StatusForbidden, helper.HTTPMessage{
+			Message: "two-factor authentication is required for your access level",
+		})
+		return
+	}
+
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	credential, err := database.GetTOTPCredential(userID)
+	if err != nil {
+		if err == db.ErrNotFound {
+			c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+			return
+		}
+		log.Printf("failed to get TOTP credential of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if credential.Enabled {
+		sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+		if !countTwoFactorAttempt(sessionCache, userID) {
+			abortTooManyTwoFactorAttempts(c)
+			return
+		}
+		ok, err := verifySecondFactor(database, userID, req)
+		if err != nil {
+			log.Printf("failed to verify second factor of user '%s': %s\n", userID, err.Error())
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: "invalid code"})
+			return
+		}
+	}
+
+	if err = database.DeleteTOTPCredential(userID); err != nil {
+		log.Printf("failed to delete TOTP credential of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	helper.ResetAttempts(c.MustGet(helper.ContextCache).(*cache.Cache), twoFactorAttemptsCacheKeyPrefix+userID)
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// HandleTwoFactorVerify verifies the second factor of a pending session
+// and returns an access token of a new unrestricted session.
+// The pending session must be passed in 'Access-Token' header or the session cookie.
+func HandleTwoFactorVerify(c *gin.Context) {
+	var req twoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (len(req.Code) == 0 && len(req.RecoveryCode) == 0) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "'code' or 'recoveryCode' is missing in the request",
+		})
+		return
+	}
+
+	accessToken, _ := requestAccessToken(c)
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	session, ok := sessionCache.Get(accessToken)
+	if len(accessToken) == 0 || !ok || !session.(helper.SessionData).TwoFactorPending {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			helper.HTTPMessage{Message: "no pending two-factor authentication"},
+		)
+		return
+	}
+	sessionData := session.(helper.SessionData)
+	if !countTwoFactorAttempt(sessionCache, sessionData.UserID) {
+		sessionCache.Delete(accessToken)
+		abortTooManyTwoFactorAttempts(c)
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	ok, err := verifySecondFactor(database, sessionData.UserID, req)
+	if err != nil {
+		log.Printf("failed to verify second factor of user '%s': %s\n", sessionData.UserID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: "invalid code"})
+		return
+	}
+
+	sessionCache.Delete(accessToken)
+	helper.ResetAttempts(sessionCache, twoFactorAttemptsCacheKeyPrefix+sessionData.UserID)
+	sessionData.TwoFactorPending = false
+	accessToken = storeSession(sessionCache, &sessionData)
+	setSessionCookies(c, accessToken, sessionData)
+
+	c.JSON(http.StatusOK, accessTokenResponse{AccessToken: accessToken})
+}
+
+// countTwoFactorAttempt counts the attempt of the user before the code is checked
+// and returns false if the user has no attempts left within the window.
+// The codes are counted by user rather than by session, so that signing in again does not give more guesses
+// and the codes tried to verify a pending session and to disable the second factor share the limit.
+func countTwoFactorAttempt(sessionCache *cache.Cache, userID string) bool {
+	return helper.CountAttempt(
+		sessionCache,
+		twoFactorAttemptsCacheKeyPrefix+userID,
+		maxTwoFactorAttempts,
+		twoFactorLockoutWindow,
+	)
+}
+
+// abortTooManyTwoFactorAttempts responds with '429 Too Many Requests'.
+func abortTooManyTwoFactorAttempts(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, helper.HTTPMessage{
+		Message: "too many invalid codes, try again later",
+	})
+}
+
+// verifySecondFactor checks the code or the recovery code of the user and stores the credential
+// so that neither of them can be used again.
+func verifySecondFactor(database db.Adapter, userID string, req twoFactorCodeRequest) (bool, error) {
+	totpCredentialsMx.Lock()
+	defer totpCredentialsMx.Unlock()
+
+	// The credential is read under the lock, so that concurrent requests see the code used by each other.
+	credential, err := database.GetTOTPCredential(userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get TOTP credential: %w", err)
+	}
+	if len(req.Code) > 0 {
+		step, ok := ValidateTOTP(credential.Secret, req.Code, time.Now())
+		if !ok || step <= credential.LastUsedStep {
+			return false, nil
+		}
+		credential.LastUsedStep = step
+	} else {
+		hash := helper.HashToken(strings.ToLower(strings.TrimSpace(req.RecoveryCode)))
+		i := slices.Index(credential.RecoveryCodeHashes, hash)
+		if i < 0 {
+			return false, nil
+		}
+		credential.RecoveryCodeHashes = slices.Delete(credential.RecoveryCodeHashes, i, i+1)
+	}
+
+	if err = database.PutTOTPCredential(&credential); err != nil {
+		return false, fmt.Errorf("failed to update TOTP credential: %w", err)
+	}
+	return true, nil
+}
+
+// twoFactorStatus returns what the session is awaiting, if anything.
+func twoFactorStatus(sessionData helper.SessionData) string {
+	switch {
+	case sessionData.TwoFactorPending:
+		return twoFactorStatusRequired
+	case sessionData.TwoFactorEnrollmentRequired:
+		return twoFactorStatusEnrollmentRequired
+	}
+	return ""
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+var ErrUserNotActive = errors.New("account is not active")
+
+// UpdateUserStatus updates the status of the user.
+// All sessions of the user are revoked immediately unless the user is active.
+func UpdateUserStatus(c *gin.Context, userID, status string) error {
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	if err := database.UpdateUserStatus(userID, status); err != nil {
+		return err
+	}
+
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	helper.CacheUserStatus(sessionCache, userID, status)
+	if status != db.UserStatusActive {
+		RevokeUserSessions(sessionCache, userID)
+	}
+	return nil
+}
+
+// checkUserStatus returns ErrUserNotActive if the user is not active.
+// Users that no longer exist are considered deleted.
+func checkUserStatus(c *gin.Context, userID string) error {
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	if status, ok := helper.CachedUserStatus(sessionCache, userID); ok {
+		return userStatusError(status)
+	}
+
+	status := db.UserStatusDeleted
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	user, err := database.GetUserByID(userID)
+	if err == nil {
+		status = db.UserStatusActive
+		if !user.IsActive() {
+			status = user.Status
+		}
+	} else if err != db.ErrNotFound {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+	helper.CacheUserStatus(sessionCache, userID, status)
+
+	return userStatusError(status)
+}
+
+// userStatusError returns ErrUserNotActive with the status unless the status is active.
+func userStatusError(status string) error {
+	if status == db.UserStatusActive || status == "" {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUserNotActive, status)
+}
+
+// RevokeSessionsMiddleware revokes all sessions of the authenticated user and deletes the session cookies
+// once the handler succeeds, e.g. after the user deleted the account.
+// It must be used after the authentication check.
+func RevokeSessionsMiddleware(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	// The cookies can only be deleted before the handler writes the response.
+	c.Writer = &statusHookWriter{ResponseWriter: c.Writer, hook: func(status int) {
+		if status < http.StatusBadRequest {
+			clearSessionCookies(c)
+		}
+	}}
+	c.Next()
+
+	if c.IsAborted() || c.Writer.Status() >= http.StatusBadRequest {
+		return
+	}
+	RevokeUserSessions(c.MustGet(helper.ContextCache).(*cache.Cache), userID)
+}
+
+// statusHookWriter calls the hook with the status of the response before the headers are written.
+type statusHookWriter struct {
+	gin.ResponseWriter
+	hook   func(status int)
+	called bool
+}
+
+func (w *statusHookWriter) WriteHeader(status int) {
+	if !w.called {
+		w.called = true
+		w.hook(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRevokeSessionsMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		revoked bool
+	}{
+		{
+			name:    "handler succeeded",
+			status:  http.StatusAccepted,
+			revoked: true,
+		},
+		{
+			name:   "handler failed",
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sessionCache := cache.New(time.Minute)
+			accessToken := storeSession(sessionCache, &helper.SessionData{UserID: "user"})
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(func(c *gin.Context) {
+				c.Set(helper.ContextCache, sessionCache)
+				c.Set(helper.ContextSessionCookieConfig, SessionCookieConfig{
+					Enabled:  true,
+					Name:     "session",
+					CSRFName: "csrf_token",
+					Path:     "/",
+				})
+				c.Set(helper.ContextUserID, "user")
+			})
+			r.DELETE("/me", RevokeSessionsMiddleware, func(c *gin.Context) {
+				c.JSON(test.status, helper.HTTPMessage{Message: "done"})
+			})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/me", nil))
+
+			if w.Code != test.status {
+				t.Errorf("expected %d, got %d", test.status, w.Code)
+			}
+			if _, ok := sessionCache.Get(accessToken); ok == test.revoked {
+				t.Errorf("expected the session to be revoked: %t", test.revoked)
+			}
+			cleared := len(w.Result().Cookies()) > 0
+			if cleared != test.revoked {
+				t.Errorf("expected the cookies to be deleted: %t, got %v", test.revoked, w.Result().Cookies())
+			}
+		})
+	}
+}
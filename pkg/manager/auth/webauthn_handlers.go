@@ -0,0 +1,336 @@
+package auth
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	// webAuthnCeremonyTTL is how long a registration or login challenge is valid.
+	webAuthnCeremonyTTL = time.Minute * 5
+	// webAuthnCacheKeyPrefix prefixes ceremony IDs in the session cache.
+	webAuthnCacheKeyPrefix = "webauthn:"
+)
+
+// webAuthnCeremoniesMx makes sure that a ceremony is consumed only once.
+var webAuthnCeremoniesMx sync.Mutex
+
+// webAuthnUser adapts the user and their credentials to webauthn.User.
+type webAuthnUser struct {
+	user        db.User
+	credentials []db.WebAuthnCredential
+}
+
+func (u webAuthnUser) WebAuthnID() []byte {
+	return []byte(u.user.ID)
+}
+
+func (u webAuthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	if len(u.user.FirstName) == 0 {
+		return u.user.Email
+	}
+	return u.user.FirstName + " " + u.user.LastName
+}
+
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, c := range u.credentials {
+		id, err := base64.RawURLEncoding.DecodeString(c.ID)
+		if err != nil {
+			continue
+		}
+		transports := make([]protocol.AuthenticatorTransport, len(c.Transports))
+		for i := range c.Transports {
+			transports[i] = protocol.AuthenticatorTransport(c.Transports[i])
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              id,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				UserPresent:    c.UserPresent,
+				UserVerified:   c.UserVerified,
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+func (u webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+// webAuthnCeremony is the state of a ceremony stored in the session cache
+// between the beginning and the end of the ceremony.
+type webAuthnCeremony struct {
+	UserID string
+	// Name is the name of the credential being registered.
+	Name    string
+	Session webauthn.SessionData
+}
+
+type webAuthnBeginResponse struct {
+	// CeremonyID must be passed as 'ceremony_id' query to finish the ceremony.
+	CeremonyID string `json:"ceremonyID"`
+	Options    any    `json:"options"`
+}
+
+// HandleWebAuthnRegistrationBegin starts the registration of a new passkey for the authenticated user.
+// An optional 'name' can be passed via query to name the passkey.
+func HandleWebAuthnRegistrationBegin(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	user, ok := loadWebAuthnUser(c, userID)
+	if !ok {
+		return
+	}
+
+	w := c.MustGet(helper.ContextWebAuthn).(*webauthn.WebAuthn)
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.credentials))
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	options, session, err := w.BeginRegistration(
+		user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		log.Printf("failed to begin WebAuthn registration for user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, webAuthnBeginResponse{
+		CeremonyID: beginWebAuthnCeremony(c, webAuthnCeremony{
+			UserID:  userID,
+			Name:    c.Query("name"),
+			Session: *session,
+		}),
+		Options: options,
+	})
+}
+
+// HandleWebAuthnRegistrationFinish verifies the attestation and stores the new passkey.
+func HandleWebAuthnRegistrationFinish(c *gin.Context) {
+	ceremony, ok := finishWebAuthnCeremony(c)
+	if !ok {
+		return
+	}
+	userID := c.MustGet(helper.ContextUserID).(string)
+	if ceremony.UserID != userID {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: "invalid ceremony"})
+		return
+	}
+	user, ok := loadWebAuthnUser(c, userID)
+	if !ok {
+		return
+	}
+
+	w := c.MustGet(helper.ContextWebAuthn).(*webauthn.WebAuthn)
+	credential, err := w.FinishRegistration(user, ceremony.Session, c.Request)
+	if err != nil {
+		log.Printf("failed to finish WebAuthn registration for user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: "invalid credential"})
+		return
+	}
+
+	transports := make([]string, len(credential.Transport))
+	for i := range credential.Transport {
+		transports[i] = string(credential.Transport[i])
+	}
+	name := ceremony.Name
+	if len(name) == 0 {
+		name = "Passkey"
+	}
+	dbCredential := db.WebAuthnCredential{
+		ID:              base64.RawURLEncoding.EncodeToString(credential.ID),
+		UserID:          userID,
+		Name:            name,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		UserPresent:     credential.Flags.UserPresent,
+		UserVerified:    credential.Flags.UserVerified,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+		CreatedAt:       time.Now().UTC(),
+	}
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	if err = database.CreateWebAuthnCredential(&dbCredential); err != nil {
+		log.Printf("failed to create WebAuthn credential for user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, dbCredential)
+}
+
+// HandleWebAuthnLoginBegin starts the passkey login.
+// The user is identified by the passkey, so no email is required.
+func HandleWebAuthnLoginBegin(c *gin.Context) {
+	w := c.MustGet(helper.ContextWebAuthn).(*webauthn.WebAuthn)
+	options, session, err := w.BeginDiscoverableLogin()
+	if err != nil {
+		log.Println("failed to begin WebAuthn login:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, webAuthnBeginResponse{
+		CeremonyID: beginWebAuthnCeremony(c, webAuthnCeremony{Session: *session}),
+		Options:    options,
+	})
+}
+
+// HandleWebAuthnLoginFinish verifies the assertion and returns an access token of the new session.
+func HandleWebAuthnLoginFinish(c *gin.Context) {
+	ceremony, ok := finishWebAuthnCeremony(c)
+	if !ok {
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	var user webAuthnUser
+	findUser := func(_, userHandle []byte) (webauthn.User, error) {
+		u, err := database.GetUserByID(string(userHandle))
+		if err != nil {
+			return nil, err
+		}
+		credentials, err := database.GetWebAuthnCredentials(u.ID)
+		if err != nil {
+			return nil, err
+		}
+		user = webAuthnUser{user: u, credentials: credentials}
+		return user, nil
+	}
+
+	w := c.MustGet(helper.ContextWebAuthn).(*webauthn.WebAuthn)
+	credential, err := w.FinishDiscoverableLogin(findUser, ceremony.Session, c.Request)
+	if err != nil {
+		log.Println("failed to finish WebAuthn login:", err)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, helper.HTTPMessage{Message: "invalid credential"})
+		return
+	}
+	// The signature counter did not increase, the authenticator might have been cloned.
+	if credential.Authenticator.CloneWarning {
+		log.Printf("WebAuthn sign count check failed for user '%s'\n", user.user.ID)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, helper.HTTPMessage{Message: "invalid credential"})
+		return
+	}
+
+	err = database.UpdateWebAuthnCredentialUsage(
+		base64.RawURLEncoding.EncodeToString(credential.ID),
+		credential.Authenticator.SignCount,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		log.Printf("failed to update WebAuthn credential of user '%s': %s\n", user.user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithSession(c, http.StatusOK, user.user, nil)
+}
+
+// HandleWebAuthnCredentials returns the passkeys of the authenticated user.
+func HandleWebAuthnCredentials(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	credentials, err := database.GetWebAuthnCredentials(userID)
+	if err != nil {
+		log.Printf("failed to get WebAuthn credentials of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, credentials)
+}
+
+// HandleWebAuthnCredentialDelete deletes a passkey of the authenticated user.
+func HandleWebAuthnCredentialDelete(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	err := database.DeleteWebAuthnCredential(userID, c.Param("credentialid"))
+	if err != nil {
+		if err == db.ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{Message: "credential not found"})
+			return
+		}
+		log.Printf("failed to delete WebAuthn credential of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+func loadWebAuthnUser(c *gin.Context, userID string) (webAuthnUser, bool) {
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("failed to get user by ID '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			helper.HTTPMessage{Message: "failed to get user"},
+		)
+		return webAuthnUser{}, false
+	}
+	credentials, err := database.GetWebAuthnCredentials(userID)
+	if err != nil {
+		log.Printf("failed to get WebAuthn credentials of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return webAuthnUser{}, false
+	}
+	return webAuthnUser{user: user, credentials: credentials}, true
+}
+
+// beginWebAuthnCeremony stores the ceremony in the session cache and returns its ID.
+func beginWebAuthnCeremony(c *gin.Context, ceremony webAuthnCeremony) string {
+	ceremonyID := helper.GenerateRandomString(16)
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	sessionCache.Set(webAuthnCacheKeyPrefix+ceremonyID, ceremony, webAuthnCeremonyTTL)
+	return ceremonyID
+}
+
+// finishWebAuthnCeremony finds the ceremony by 'ceremony_id' query and deletes it,
+// so that the challenge can only be used once.
+func finishWebAuthnCeremony(c *gin.Context) (webAuthnCeremony, bool) {
+	key := webAuthnCacheKeyPrefix + c.Query("ceremony_id")
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+
+	webAuthnCeremoniesMx.Lock()
+	defer webAuthnCeremoniesMx.Unlock()
+
+	ceremony, ok := sessionCache.Get(key)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "ceremony is missing or expired",
+		})
+		return webAuthnCeremony{}, false
+	}
+	sessionCache.Delete(key)
+	return ceremony.(webAuthnCeremony), true
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akyoto/cache"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+func TestFinishWebAuthnCeremonyConcurrently(t *testing.T) {
+	sessionCache := cache.New(time.Minute)
+	var (
+		mx       sync.Mutex
+		finished int
+	)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set(helper.ContextCache, sessionCache)
+	})
+	r.GET("/begin", func(c *gin.Context) {
+		c.String(http.StatusOK, beginWebAuthnCeremony(c, webAuthnCeremony{UserID: "user"}))
+	})
+	r.GET("/finish", func(c *gin.Context) {
+		if _, ok := finishWebAuthnCeremony(c); ok {
+			mx.Lock()
+			finished++
+			mx.Unlock()
+			c.Status(http.StatusOK)
+		}
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/begin", nil))
+	ceremonyID := w.Body.String()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/finish?ceremony_id="+ceremonyID, nil))
+		}()
+	}
+	wg.Wait()
+
+	if finished != 1 {
+		t.Errorf("expected the ceremony to be finished once, got %d", finished)
+	}
+}
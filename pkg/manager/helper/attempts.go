@@ -0,0 +1,50 @@
+package helper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/akyoto/cache"
+)
+
+// attemptsMx makes sure that concurrent attempts are counted one by one.
+var attemptsMx sync.Mutex
+
+// attempts counts the attempts since the start of the window.
+type attempts struct {
+	Count   int
+	StartAt time.Time
+}
+
+// CountAttempt counts an attempt under the key in the session cache before it is made
+// and returns false if the attempts are used up within the window.
+// The window starts with the first attempt.
+func CountAttempt(sessionCache *cache.Cache, key string, maxAttempts int, window time.Duration) bool {
+	attemptsMx.Lock()
+	defer attemptsMx.Unlock()
+
+	now := time.Now()
+	counted := attempts{StartAt: now}
+	if value, ok := sessionCache.Get(key); ok {
+		counted = value.(attempts)
+	}
+	remaining := window - now.Sub(counted.StartAt)
+	if remaining <= 0 {
+		counted = attempts{StartAt: now}
+		remaining = window
+	}
+	if counted.Count >= maxAttempts {
+		return false
+	}
+	counted.Count++
+	sessionCache.Set(key, counted, remaining)
+	return true
+}
+
+// ResetAttempts forgets the attempts counted under the key, e.g. after a successful attempt.
+func ResetAttempts(sessionCache *cache.Cache, key string) {
+	attemptsMx.Lock()
+	defer attemptsMx.Unlock()
+
+	sessionCache.Delete(key)
+}
@@ -2,18 +2,44 @@ package helper
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+
+	"github.com/akyoto/cache"
 )
 
 // Context keys that can be used to fetch useful information
 // from a request's context.
 // Context availability depends on the middleware called before a handler.
 const (
-	ContextDatabase        = "db"
-	ContextCache           = "cache"
-	ContextFileStore       = "fileStore"
-	ContextUserID          = "userID"
-	ContextUserAccessLevel = "userAccessLevel"
+	ContextDatabase              = "db"
+	ContextCache                 = "cache"
+	ContextFileStore             = "fileStore"
+	ContextAuthProviders         = "authProviders"
+	ContextPasswordConfig        = "passwordConfig"
+	ContextMailer                = "mailer"
+	ContextEmailConfig           = "emailConfig"
+	ContextTwoFactorConfig       = "twoFactorConfig"
+	ContextWebAuthn              = "webAuthn"
+	ContextRoles                 = "roles"
+	ContextScopesConfig          = "scopesConfig"
+	ContextRedirectConfig        = "redirectConfig"
+	ContextSessionCookieConfig   = "sessionCookieConfig"
+	ContextOAuthStateKey         = "oauthStateKey"
+	ContextProfileSyncConfig     = "profileSyncConfig"
+	ContextAccountDeletionConfig = "accountDeletionConfig"
+	ContextInvitationConfig      = "invitationConfig"
+	ContextFilesConfig           = "filesConfig"
+	ContextUserID                = "userID"
+	ContextOrganization          = "organization"
+	ContextOrgRole               = "orgRole"
+	ContextUserAccessLevel       = "userAccessLevel"
+	ContextAccessToken           = "accessToken"
+	ContextAPIKeyID              = "apiKeyID"
+	ContextUserPermissions       = "userPermissions"
+	ContextScopes                = "scopes"
+	ContextImpersonatorID        = "impersonatorID"
 )
 
 type HTTPMessage struct {
@@ -23,6 +49,29 @@ type HTTPMessage struct {
 type SessionData struct {
 	UserID      string
 	AccessLevel string
+	// TwoFactorPending is true until the second factor of the user is verified.
+	TwoFactorPending bool
+	// TwoFactorEnrollmentRequired is true until the user enrolls
+	// the second factor required for the access level.
+	TwoFactorEnrollmentRequired bool
+	// Scopes limit what the session can do on behalf of the user.
+	Scopes []string
+	// ImpersonatorID is the ID of the admin who impersonates the user.
+	ImpersonatorID string
+	// CSRFToken must be echoed in unsafe requests authenticated with the session cookie.
+	CSRFToken string
+}
+
+// UserSessions returns the sessions of the user from the session cache by access token.
+func UserSessions(sessionCache *cache.Cache, userID string) map[string]SessionData {
+	sessions := make(map[string]SessionData)
+	sessionCache.Range(func(key, value interface{}) bool {
+		if sessionData, ok := value.(SessionData); ok && sessionData.UserID == userID {
+			sessions[key.(string)] = sessionData
+		}
+		return true
+	})
+	return sessions
 }
 
 func GenerateRandomString(length int) string {
@@ -30,3 +79,9 @@ func GenerateRandomString(length int) string {
 	_, _ = rand.Read(b)
 	return base64.URLEncoding.EncodeToString(b)
 }
+
+// HashToken returns the hash of the token, so that only the hash is stored.
+func HashToken(rawToken string) string {
+	sum := sha256.Sum256([]byte(rawToken))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,49 @@
+package helper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BodyLimitMiddleware rejects the requests with the body larger than the limit of the route.
+// The limits are looked up by the full path of the route, e.g. '/api/v1/users/me/files',
+// and the default limit applies to the other routes.
+// Bodies without the length declared are read up to the limit before the handlers.
+func BodyLimitMiddleware(defaultLimit int64, limits map[string]int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, ok := limits[c.FullPath()]
+		if !ok {
+			limit = defaultLimit
+		}
+		if c.Request.ContentLength > limit {
+			abortRequestTooLarge(c, limit)
+			return
+		}
+		if c.Request.ContentLength < 0 {
+			body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					abortRequestTooLarge(c, limit)
+					return
+				}
+				c.AbortWithStatusJSON(http.StatusBadRequest, HTTPMessage{Message: "failed to read the request body"})
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		c.Next()
+	}
+}
+
+// abortRequestTooLarge responds with '413 Request Entity Too Large'.
+func abortRequestTooLarge(c *gin.Context, limit int64) {
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, HTTPMessage{
+		Message: fmt.Sprintf("the request body exceeds the limit of %d bytes", limit),
+	})
+}
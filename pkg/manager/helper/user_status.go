@@ -0,0 +1,31 @@
+package helper
+
+import (
+	"time"
+
+	"github.com/akyoto/cache"
+)
+
+const (
+	// userStatusTTL is how long the user status is cached,
+	// so that it is not read from the database on every request.
+	userStatusTTL = time.Minute
+	// userStatusCacheKeyPrefix prefixes user IDs in the session cache.
+	userStatusCacheKeyPrefix = "user-status:"
+)
+
+// CacheUserStatus caches the status of the user for the authentication checks.
+// It must be called whenever the status is updated, so that the sessions of the user
+// are locked out on their next request unless the user is active.
+func CacheUserStatus(sessionCache *cache.Cache, userID, status string) {
+	sessionCache.Set(userStatusCacheKeyPrefix+userID, status, userStatusTTL)
+}
+
+// CachedUserStatus returns the cached status of the user, if any.
+func CachedUserStatus(sessionCache *cache.Cache, userID string) (string, bool) {
+	status, ok := sessionCache.Get(userStatusCacheKeyPrefix + userID)
+	if !ok {
+		return "", false
+	}
+	return status.(string), true
+}
@@ -0,0 +1,87 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// HTTPValidationErrors is the response to a request with invalid fields.
+type HTTPValidationErrors struct {
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors"`
+}
+
+// FieldError describes why a field of the request is invalid.
+type FieldError struct {
+	// Field is the JSON name of the field.
+	Field string `json:"field"`
+	// Rule is the validation rule the field has failed, e.g. 'max'.
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// fieldErrorMessages are the messages of the validation rules.
+// The parameter of the rule, if any, is passed to the message.
+var fieldErrorMessages = map[string]string{
+	"required":           "is required",
+	"email":              "must be a valid email",
+	"max":                "must be at most %s characters long",
+	"min":                "must be at least %s characters long",
+	"oneof":              "must be one of: %s",
+	"datetime":           "must be a date in '%s' format",
+	"bcp47_language_tag": "must be a language tag, e.g. 'en-US'",
+}
+
+// RegisterValidation registers a custom validation rule and its error message in the binding validator.
+// The field errors of the rules are reported with the JSON names of the fields.
+func RegisterValidation(rule, message string, fn validator.Func) error {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return errors.New("unsupported binding validator")
+	}
+	v.RegisterTagNameFunc(jsonFieldName)
+	fieldErrorMessages[rule] = message
+	return v.RegisterValidation(rule, fn)
+}
+
+// NewHTTPValidationErrors converts the binding error to field errors.
+// It returns false if the error is not caused by the validation, e.g. malformed JSON.
+func NewHTTPValidationErrors(err error) (HTTPValidationErrors, bool) {
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return HTTPValidationErrors{}, false
+	}
+
+	response := HTTPValidationErrors{
+		Message: "invalid request",
+		Errors:  make([]FieldError, 0, len(validationErrs)),
+	}
+	for _, fieldErr := range validationErrs {
+		message, ok := fieldErrorMessages[fieldErr.Tag()]
+		if !ok {
+			message = "is invalid"
+		}
+		if strings.Contains(message, "%s") {
+			message = fmt.Sprintf(message, fieldErr.Param())
+		}
+		response.Errors = append(response.Errors, FieldError{
+			Field:   fieldErr.Field(),
+			Rule:    fieldErr.Tag(),
+			Message: message,
+		})
+	}
+	return response, true
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" || len(name) == 0 {
+		return field.Name
+	}
+	return name
+}
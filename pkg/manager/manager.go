@@ -1,18 +1,31 @@
 package manager
 
 import (
+	"crypto/rand"
 	"net/http"
+	"time"
 
 	"github.com/akyoto/cache"
 	"github.com/bazuker/backend-bootstrap/pkg/db"
 	"github.com/bazuker/backend-bootstrap/pkg/filestore"
+	"github.com/bazuker/backend-bootstrap/pkg/mailer"
+	localMailer "github.com/bazuker/backend-bootstrap/pkg/mailer/local"
+	adminHandlers "github.com/bazuker/backend-bootstrap/pkg/manager/admin"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/audit"
 	authHandlers "github.com/bazuker/backend-bootstrap/pkg/manager/auth"
 	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	orgsHandlers "github.com/bazuker/backend-bootstrap/pkg/manager/orgs"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/rbac"
 	usersHandlers "github.com/bazuker/backend-bootstrap/pkg/manager/users"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
+// multipartOverhead is the room left in the body limit of the upload routes
+// for the boundaries, the headers and the other fields of the multipart form.
+const multipartOverhead = 64 << 10
+
 // Manager is a smart HTTP server and router that handles requests routing
 // and provides useful context to handlers.
 type Manager struct {
@@ -24,7 +37,14 @@ type Config struct {
 	// ServerAddress is server HTTP address
 	ServerAddress string
 	// ServerMaxUploadFilesizeMB maximum upload filesize in megabytes.
+	// It is the body size limit of the upload routes.
 	ServerMaxUploadFilesizeMB int64
+	// ServerMaxBodySizeKB is the body size limit of the other routes in kilobytes.
+	// Defaults to 1 MB.
+	ServerMaxBodySizeKB int64
+	// ServerBodyLimits override the body size limits in bytes by the full path of the route,
+	// e.g. '/api/v1/users/me/files'.
+	ServerBodyLimits map[string]int64
 	// ServerCORS is cross-origin resource sharing configuration
 	ServerCORS *cors.Config
 	// DB is a database adapter.
@@ -33,70 +53,630 @@ type Config struct {
 	Cache *cache.Cache
 	// FileStore is a file storage provider.
 	FileStore filestore.FileStore
+	// AuthProviders are the authentication providers available
+	// under /api/v1/auth/:provider.
+	AuthProviders authHandlers.Providers
+	// Password is the configuration of the email and password authentication.
+	Password authHandlers.PasswordConfig
+	// Mailer sends emails, e.g. email verification links.
+	// Defaults to writing the emails to the log.
+	Mailer mailer.Mailer
+	// Email is the configuration of the links sent by email.
+	Email authHandlers.EmailConfig
+	// TwoFactor is the configuration of the two-factor authentication.
+	TwoFactor authHandlers.TwoFactorConfig
+	// WebAuthn is the relying party used for passkeys.
+	// Passkeys are disabled if it is nil.
+	WebAuthn *webauthn.WebAuthn
+	// Roles maps the role names to the permissions they grant.
+	// Defaults to rbac.DefaultRoles.
+	Roles rbac.Roles
+	// Scopes maps the access levels to the scopes their sessions and API keys may receive.
+	// Defaults to authHandlers.DefaultScopes.
+	Scopes authHandlers.ScopesConfig
+	// Redirect is the allow-list of the URLs users are redirected to after authentication.
+	// No redirects are allowed unless the origins are configured.
+	Redirect authHandlers.RedirectConfig
+	// SessionCookie enables the sessions in HttpOnly cookies protected from CSRF for browsers.
+	// The cookies are secure unless SessionCookie.Insecure is set.
+	SessionCookie authHandlers.SessionCookieConfig
+	// OAuthStateKey is the key of the MAC binding the OAuth state to the browser cookie.
+	// Defaults to a random key, which is enough as long as the state is stored in the in-memory cache.
+	OAuthStateKey []byte
+	// ProfileSync refreshes the profile of the users from the identity providers on sign in.
+	ProfileSync authHandlers.ProfileSyncConfig
+	// AccountDeletion is the grace period of the accounts deleted by the users
+	// before they are erased for good.
+	AccountDeletion usersHandlers.AccountDeletionConfig
+	// Invitations is the configuration of the links inviting users to the organizations.
+	Invitations orgsHandlers.InvitationConfig
+	// Files is the configuration of the file libraries of the users.
+	Files usersHandlers.FilesConfig
 }
 
 func New(cfg Config) *Manager {
 	if cfg.ServerMaxUploadFilesizeMB < 1 {
 		cfg.ServerMaxUploadFilesizeMB = 10
 	}
+	if cfg.ServerMaxBodySizeKB < 1 {
+		cfg.ServerMaxBodySizeKB = 1024
+	}
+	// Uploads are limited by the upload filesize unless the limits of their routes are set.
+	// The limit of the body leaves room for the multipart envelope around the file,
+	// while the size of the file itself is checked by the handlers.
+	bodyLimits := map[string]int64{
+		"/api/v1/users/me/photo": cfg.ServerMaxUploadFilesizeMB<<20 + multipartOverhead,
+		"/api/v1/users/me/files": cfg.ServerMaxUploadFilesizeMB<<20 + multipartOverhead,
+	}
+	for path, limit := range cfg.ServerBodyLimits {
+		bodyLimits[path] = limit
+	}
+	cfg.ServerBodyLimits = bodyLimits
 	if cfg.ServerCORS == nil {
 		corsCfg := cors.DefaultConfig()
 		corsCfg.AllowOrigins = []string{"*"}
 		corsCfg.AllowHeaders = []string{"*"}
 		cfg.ServerCORS = &corsCfg
 	}
+	if cfg.AuthProviders == nil {
+		cfg.AuthProviders = authHandlers.NewProviders()
+	}
+	if cfg.Password.Hashing == (authHandlers.Argon2Params{}) {
+		cfg.Password.Hashing = authHandlers.DefaultArgon2Params
+	}
+	if cfg.Password.Policy == (authHandlers.PasswordPolicy{}) {
+		cfg.Password.Policy = authHandlers.DefaultPasswordPolicy
+	}
+	if cfg.Mailer == nil {
+		cfg.Mailer = localMailer.New(localMailer.Config{})
+	}
+	if cfg.Email.VerifyEmailTTL <= 0 {
+		cfg.Email.VerifyEmailTTL = time.Hour * 24
+	}
+	if cfg.Email.ResetPasswordTTL <= 0 {
+		cfg.Email.ResetPasswordTTL = time.Hour
+	}
+	if cfg.Email.MagicLinkTTL <= 0 {
+		cfg.Email.MagicLinkTTL = time.Minute * 15
+	}
+	if len(cfg.TwoFactor.Issuer) == 0 {
+		cfg.TwoFactor.Issuer = "backend-bootstrap"
+	}
+	if cfg.Roles == nil {
+		cfg.Roles = rbac.DefaultRoles
+	}
+	if cfg.Scopes == nil {
+		cfg.Scopes = authHandlers.DefaultScopes
+	}
+	if len(cfg.Redirect.TokenDelivery) == 0 {
+		cfg.Redirect.TokenDelivery = authHandlers.TokenDeliveryQuery
+	}
+	if len(cfg.SessionCookie.Name) == 0 {
+		cfg.SessionCookie.Name = "session"
+	}
+	if len(cfg.SessionCookie.CSRFName) == 0 {
+		cfg.SessionCookie.CSRFName = "csrf_token"
+	}
+	if len(cfg.SessionCookie.CSRFHeader) == 0 {
+		cfg.SessionCookie.CSRFHeader = "X-CSRF-Token"
+	}
+	if len(cfg.SessionCookie.Path) == 0 {
+		cfg.SessionCookie.Path = "/"
+	}
+	if cfg.SessionCookie.SameSite == 0 {
+		cfg.SessionCookie.SameSite = http.SameSiteLaxMode
+	}
+	if cfg.ProfileSync.MaxPhotoSize <= 0 {
+		cfg.ProfileSync.MaxPhotoSize = cfg.ServerMaxUploadFilesizeMB << 20
+	}
+	if cfg.AccountDeletion.GracePeriod <= 0 {
+		cfg.AccountDeletion.GracePeriod = time.Hour * 24 * 30
+	}
+	if cfg.AccountDeletion.ErasureInterval <= 0 {
+		cfg.AccountDeletion.ErasureInterval = time.Hour
+	}
+	if cfg.Invitations.TTL <= 0 {
+		cfg.Invitations.TTL = time.Hour * 24 * 7
+	}
+	if cfg.Files.MaxFileSize <= 0 {
+		cfg.Files.MaxFileSize = cfg.ServerMaxUploadFilesizeMB << 20
+	}
+	if cfg.Files.Quota <= 0 {
+		cfg.Files.Quota = 100 << 20
+	}
+	if len(cfg.OAuthStateKey) == 0 {
+		cfg.OAuthStateKey = make([]byte, 32)
+		_, _ = rand.Read(cfg.OAuthStateKey)
+	}
 	return &Manager{router: gin.Default(), cfg: cfg}
 }
 
 func (r *Manager) Start() error {
 	r.router.MaxMultipartMemory = r.cfg.ServerMaxUploadFilesizeMB << 20
 
+	if err := usersHandlers.RegisterValidations(); err != nil {
+		return err
+	}
+
+	// Erase the accounts deleted by the users once the grace period is over.
+	go usersHandlers.RunErasure(r.cfg.DB, r.cfg.FileStore, r.cfg.AccountDeletion.ErasureInterval)
+
 	r.router.Use(cors.New(*r.cfg.ServerCORS))
 
 	api := r.router.Group("/api")
-	api.Use(contextMiddleware(r.cfg.DB, r.cfg.Cache, r.cfg.FileStore))
+	api.Use(
+		helper.BodyLimitMiddleware(r.cfg.ServerMaxBodySizeKB<<10, r.cfg.ServerBodyLimits),
+		contextMiddleware(r.cfg),
+		authHandlers.CSRFMiddleware,
+	)
 
 	v1 := api.Group("/v1")
 
 	/* Authentication */
 	auth := v1.Group("/auth")
-	// Route to initiate Google authentication.
+	// Route to sign up with email and password.
+	// e.g. https://example.com/api/v1/auth/register
+	auth.POST("/register", authHandlers.HandleAuthRegister)
+	// Route to sign in with email and password.
+	// e.g. https://example.com/api/v1/auth/login
+	auth.POST("/login", authHandlers.HandleAuthLogin)
+	// Route to confirm the email with the token from the verification link.
+	auth.POST("/email/verify", authHandlers.HandleConfirmEmailVerification)
+	// Route to request a password reset link.
+	auth.POST("/password/forgot", authHandlers.HandleForgotPassword)
+	// Route to set a new password with the token from the password reset link.
+	auth.POST("/password/reset", authHandlers.HandleResetPassword)
+	// Route to cancel the deletion of the account with the token from the restore link
+	// sent when the account was deleted.
+	auth.POST("/account/restore", usersHandlers.HandleRestoreAccount)
+	// Route to request a passwordless sign-in link.
+	// e.g. https://example.com/api/v1/auth/magic-link?redirect_url=https://example.com/home
+	auth.POST("/magic-link", authHandlers.HandleMagicLinkInitiation)
+	// Routes to handle the sign-in link from the email.
+	// The link opens a confirmation page, which signs the user in with POST.
+	// e.g. https://example.com/api/v1/auth/magic-link/callback?token=...
+	auth.GET("/magic-link/callback", authHandlers.HandleMagicLinkConfirmation)
+	auth.POST("/magic-link/callback", authHandlers.HandleMagicLinkCallback)
+	// Route to exchange the one-time code from the redirect after authentication for an access token.
+	// e.g. https://example.com/api/v1/auth/token
+	auth.POST("/token", authHandlers.HandleTokenExchange)
+	// Route to verify the second factor of a pending session.
+	// The pending session token must be passed in 'Access-Token' header.
+	auth.POST("/2fa/verify", authHandlers.HandleTwoFactorVerify)
+	// Route to sign out, i.e. delete the session and the session cookies.
+	// e.g. https://example.com/api/v1/auth/logout
+	auth.POST("/logout", authHandlers.HandleLogout)
+
+	/* Passkeys */
+	if r.cfg.WebAuthn != nil {
+		webAuthn := auth.Group("/webauthn")
+		// Protected routes to register a new passkey for the authenticated user.
+		// e.g. https://example.com/api/v1/auth/webauthn/register/begin?name=YubiKey
+		// then https://example.com/api/v1/auth/webauthn/register/finish?ceremony_id=...
+		webAuthn.POST(
+			"/register/begin",
+			authHandlers.CheckAuthenticationMiddleware,
+			authHandlers.RejectImpersonationMiddleware,
+			authHandlers.RequireScope(authHandlers.ScopeCredentialsWrite),
+			authHandlers.HandleWebAuthnRegistrationBegin,
+		)
+		webAuthn.POST(
+			"/register/finish",
+			authHandlers.CheckAuthenticationMiddleware,
+			authHandlers.RejectImpersonationMiddleware,
+			authHandlers.RequireScope(authHandlers.ScopeCredentialsWrite),
+			audit.Middleware(audit.ActionWebAuthnRegister),
+			authHandlers.HandleWebAuthnRegistrationFinish,
+		)
+		// Routes to sign in with a passkey.
+		// e.g. https://example.com/api/v1/auth/webauthn/login/begin
+		// then https://example.com/api/v1/auth/webauthn/login/finish?ceremony_id=...
+		webAuthn.POST("/login/begin", authHandlers.HandleWebAuthnLoginBegin)
+		webAuthn.POST("/login/finish", authHandlers.HandleWebAuthnLoginFinish)
+		// Protected routes to list and delete the passkeys of the authenticated user.
+		webAuthn.GET(
+			"/credentials",
+			authHandlers.CheckAuthenticationMiddleware,
+			authHandlers.RequireScope(authHandlers.ScopeCredentialsRead),
+			authHandlers.HandleWebAuthnCredentials,
+		)
+		webAuthn.DELETE(
+			"/credentials/:credentialid",
+			authHandlers.CheckAuthenticationMiddleware,
+			authHandlers.RejectImpersonationMiddleware,
+			authHandlers.RequireScope(authHandlers.ScopeCredentialsWrite),
+			audit.Middleware(audit.ActionWebAuthnDelete),
+			authHandlers.HandleWebAuthnCredentialDelete,
+		)
+	}
+	// Route to initiate authentication with one of the providers.
 	// e.g. https://example.com/api/v1/auth/google
-	auth.Match([]string{http.MethodGet, http.MethodPost}, "/google", authHandlers.HandleAuthGoogleInitiation)
-	// Route to handle Google authentication callback.
-	auth.Match([]string{http.MethodGet, http.MethodPost}, "/google/callback", authHandlers.HandleAuthGoogleCallback)
+	auth.Match([]string{http.MethodGet, http.MethodPost}, "/:provider", authHandlers.HandleAuthInitiation)
+	// Route to handle the provider authentication callback.
+	// e.g. https://example.com/api/v1/auth/google/callback
+	auth.Match([]string{http.MethodGet, http.MethodPost}, "/:provider/callback", authHandlers.HandleAuthCallback)
 
 	/* Users */
 	users := v1.Group("/users")
 	// Authentication check middleware will verify that the user is authentication
-	// i.e. has 'Access-Token' header with a token that exists in the session cache.
+	// i.e. has 'Access-Token' header with a token that exists in the session cache
+	// or 'Authorization' header with a valid API key.
 	// and also create 'ContextUserID' for convenience.
 	users.Use(authHandlers.CheckAuthenticationMiddleware)
+	// Every protected route declares the scopes the session or the API key must have
+	// followed by the permissions the user must have.
+	// Sensitive routes reject the sessions of admins impersonating users
+	// and the actions changing the account are recorded in the audit log.
 	// Protected route that returns information about the authenticated user.
 	// e.g. https://example.com/api/v1/users/me
-	users.GET("/me", usersHandlers.HandleUsersMe)
+	users.GET(
+		"/me",
+		authHandlers.RequireScope(authHandlers.ScopeProfileRead),
+		rbac.RequirePermission(rbac.PermissionUsersReadSelf),
+		usersHandlers.HandleUsersMe,
+	)
+	// Protected route that updates the profile of the authenticated user.
+	// Only the fields present in the request are changed.
+	// e.g. https://example.com/api/v1/users/me
+	users.PATCH(
+		"/me",
+		authHandlers.RequireScope(authHandlers.ScopeProfileWrite),
+		rbac.RequirePermission(rbac.PermissionUsersWriteSelf),
+		audit.Middleware(audit.ActionProfileUpdate),
+		usersHandlers.HandleUpdateUsersMe,
+	)
+	// Protected route that deletes the account of the authenticated user.
+	// The account is erased for good after the grace period.
+	// e.g. https://example.com/api/v1/users/me
+	users.DELETE(
+		"/me",
+		authHandlers.RejectImpersonationMiddleware,
+		authHandlers.RequireScope(authHandlers.ScopeProfileWrite),
+		rbac.RequirePermission(rbac.PermissionUsersWriteSelf),
+		audit.Middleware(audit.ActionAccountDelete),
+		authHandlers.RevokeSessionsMiddleware,
+		usersHandlers.HandleDeleteAccount,
+	)
+	// Protected route that returns a ZIP archive of all data of the authenticated user.
+	// e.g. https://example.com/api/v1/users/me/export
+	users.GET(
+		"/me/export",
+		authHandlers.RejectImpersonationMiddleware,
+		authHandlers.RequireScope(authHandlers.ScopeProfileRead),
+		rbac.RequirePermission(rbac.PermissionUsersReadSelf),
+		audit.Middleware(audit.ActionAccountExport),
+		usersHandlers.HandleUsersMeExport,
+	)
+	// Protected route that sends an email verification link to the user.
+	users.POST(
+		"/me/email/verification",
+		authHandlers.RequireScope(authHandlers.ScopeProfileWrite),
+		authHandlers.HandleSendEmailVerification,
+	)
+	// Protected routes that manage personal API keys of the user.
+	// The keys are accepted in 'Authorization: Bearer <key>' header.
+	users.GET(
+		"/me/api-keys",
+		authHandlers.RequireScope(authHandlers.ScopeCredentialsRead),
+		authHandlers.HandleAPIKeys,
+	)
+	users.POST(
+		"/me/api-keys",
+		authHandlers.RejectImpersonationMiddleware,
+		authHandlers.RequireScope(authHandlers.ScopeCredentialsWrite),
+		audit.Middleware(audit.ActionAPIKeyCreate),
+		authHandlers.HandleCreateAPIKey,
+	)
+	users.DELETE(
+		"/me/api-keys/:keyid",
+		authHandlers.RejectImpersonationMiddleware,
+		authHandlers.RequireScope(authHandlers.ScopeCredentialsWrite),
+		audit.Middleware(audit.ActionAPIKeyDelete),
+		authHandlers.HandleDeleteAPIKey,
+	)
+	// Protected routes that manage the identity providers linked to the user.
+	// Linking responds with the URL of the provider's consent page the user must be sent to.
+	// e.g. https://example.com/api/v1/users/me/identities/github?redirect_url=https://example.com/settings
+	users.GET(
+		"/me/identities",
+		authHandlers.RequireScope(authHandlers.ScopeCredentialsRead),
+		authHandlers.HandleUserIdentities,
+	)
+	users.POST(
+		"/me/identities/:provider",
+		authHandlers.RejectImpersonationMiddleware,
+		authHandlers.RequireScope(authHandlers.ScopeCredentialsWrite),
+		authHandlers.HandleLinkUserIdentity,
+	)
+	users.DELETE(
+		"/me/identities/:identityid",
+		authHandlers.RejectImpersonationMiddleware,
+		authHandlers.RequireScope(authHandlers.ScopeCredentialsWrite),
+		audit.Middleware(audit.ActionIdentityUnlink),
+		authHandlers.HandleUnlinkUserIdentity,
+	)
 	// Protected route that allows users to upload profile photos.
-	users.POST("/me/photo", usersHandlers.HandleUsersMePhoto)
+	users.POST(
+		"/me/photo",
+		authHandlers.RequireScope(authHandlers.ScopePhotoWrite),
+		rbac.RequirePermission(rbac.PermissionUsersWriteSelf),
+		audit.Middleware(audit.ActionPhotoUpload),
+		usersHandlers.HandleUsersMePhoto,
+	)
 	// Protected route that allows users to delete profile photo.
-	users.DELETE("/me/photo", usersHandlers.HandleUsersMeDeletePhoto)
+	users.DELETE(
+		"/me/photo",
+		authHandlers.RequireScope(authHandlers.ScopePhotoWrite),
+		rbac.RequirePermission(rbac.PermissionUsersWriteSelf),
+		audit.Middleware(audit.ActionPhotoDelete),
+		usersHandlers.HandleUsersMeDeletePhoto,
+	)
+	// Protected routes that manage the file library of the authenticated user.
+	// e.g. https://example.com/api/v1/users/me/files?limit=20&cursor=...
+	users.GET(
+		"/me/files",
+		authHandlers.RequireScope(authHandlers.ScopeFilesRead),
+		rbac.RequirePermission(rbac.PermissionUsersReadSelf),
+		usersHandlers.HandleGetFiles,
+	)
+	users.POST(
+		"/me/files",
+		authHandlers.RequireScope(authHandlers.ScopeFilesWrite),
+		rbac.RequirePermission(rbac.PermissionUsersWriteSelf),
+		audit.Middleware(audit.ActionFileUpload),
+		usersHandlers.HandleUploadFile,
+	)
+	// Protected route that returns the storage used by the files and the quota.
+	// e.g. https://example.com/api/v1/users/me/storage
+	users.GET(
+		"/me/storage",
+		authHandlers.RequireScope(authHandlers.ScopeFilesRead),
+		rbac.RequirePermission(rbac.PermissionUsersReadSelf),
+		usersHandlers.HandleGetStorageUsage,
+	)
+	users.GET(
+		"/me/files/:fileid",
+		authHandlers.RequireScope(authHandlers.ScopeFilesRead),
+		rbac.RequirePermission(rbac.PermissionUsersReadSelf),
+		usersHandlers.HandleGetFile,
+	)
+	users.GET(
+		"/me/files/:fileid/download",
+		authHandlers.RequireScope(authHandlers.ScopeFilesRead),
+		rbac.RequirePermission(rbac.PermissionUsersReadSelf),
+		usersHandlers.HandleDownloadFile,
+	)
+	users.DELETE(
+		"/me/files/:fileid",
+		authHandlers.RequireScope(authHandlers.ScopeFilesWrite),
+		rbac.RequirePermission(rbac.PermissionUsersWriteSelf),
+		audit.Middleware(audit.ActionFileDelete),
+		usersHandlers.HandleDeleteFile,
+	)
 	// Protected route that returns information about a user.
-	// Users with basic access can only get information about themselves.
-	// Users with admin access can get information about any user.
-	users.GET("/:userid", usersHandlers.HandleGetUsers)
+	// Requires 'users:read:self' for the authenticated user and 'users:read:any' for other users.
+	users.GET(
+		"/:userid",
+		authHandlers.RequireScope(authHandlers.ScopeProfileRead),
+		rbac.RequireUserPermission("userid", "users:read"),
+		usersHandlers.HandleGetUsers,
+	)
+	// Protected routes that manage the roles of a user.
+	users.GET(
+		"/:userid/roles",
+		authHandlers.RequireScope(authHandlers.ScopeAdminUsers),
+		rbac.RequirePermission(rbac.PermissionRolesRead),
+		rbac.HandleGetUserRoles,
+	)
+	users.PUT(
+		"/:userid/roles/:role",
+		authHandlers.RequireScope(authHandlers.ScopeAdminUsers),
+		rbac.RequirePermission(rbac.PermissionRolesWrite),
+		audit.Middleware(audit.ActionRoleAssign),
+		rbac.HandleAssignUserRole,
+	)
+	users.DELETE(
+		"/:userid/roles/:role",
+		authHandlers.RequireScope(authHandlers.ScopeAdminUsers),
+		rbac.RequirePermission(rbac.PermissionRolesWrite),
+		audit.Middleware(audit.ActionRoleUnassign),
+		rbac.HandleUnassignUserRole,
+	)
+
+	/* Organizations */
+	orgs := v1.Group("/orgs")
+	orgs.Use(authHandlers.CheckAuthenticationMiddleware)
+	// Protected routes that list the organizations of the authenticated user
+	// and create a new one owned by the user.
+	// e.g. https://example.com/api/v1/orgs
+	orgs.GET("", authHandlers.RequireScope(authHandlers.ScopeOrgsRead), orgsHandlers.HandleGetOrganizations)
+	orgs.POST(
+		"",
+		authHandlers.RequireScope(authHandlers.ScopeOrgsWrite),
+		audit.Middleware(audit.ActionOrgCreate),
+		orgsHandlers.HandleCreateOrganization,
+	)
+	// Every route of an organization requires the membership of the authenticated user
+	// and declares the role the member must have after the organization middleware.
+	// e.g. https://example.com/api/v1/orgs/123
+	orgs.GET(
+		"/:orgid",
+		authHandlers.RequireScope(authHandlers.ScopeOrgsRead),
+		orgsHandlers.Middleware,
+		orgsHandlers.HandleGetOrganization,
+	)
+	orgs.PATCH(
+		"/:orgid",
+		authHandlers.RequireScope(authHandlers.ScopeOrgsWrite),
+		orgsHandlers.Middleware,
+		orgsHandlers.RequireRole(db.OrgRoleAdmin),
+		audit.Middleware(audit.ActionOrgUpdate),
+		orgsHandlers.HandleUpdateOrganization,
+	)
+	orgs.DELETE(
+		"/:orgid",
+		authHandlers.RejectImpersonationMiddleware,
+		authHandlers.RequireScope(authHandlers.ScopeOrgsWrite),
+		orgsHandlers.Middleware,
+		orgsHandlers.RequireRole(db.OrgRoleOwner),
+		audit.Middleware(audit.ActionOrgDelete),
+		orgsHandlers.HandleDeleteOrganization,
+	)
+	// Protected routes that manage the members of an organization.
+	// Members can remove themselves, i.e. leave the organization.
+	// e.g. https://example.com/api/v1/orgs/123/members/456
+	orgs.GET(
+		"/:orgid/members",
+		authHandlers.RequireScope(authHandlers.ScopeOrgsRead),
+		orgsHandlers.Middleware,
+		orgsHandlers.HandleGetOrganizationMembers,
+	)
+	orgs.PUT(
+		"/:orgid/members/:userid",
+		authHandlers.RequireScope(authHandlers.ScopeOrgsWrite),
+		orgsHandlers.Middleware,
+		orgsHandlers.RequireRole(db.OrgRoleAdmin),
+		audit.Middleware(audit.ActionOrgMemberUpdate),
+		orgsHandlers.HandleUpdateOrganizationMember,
+	)
+	orgs.DELETE(
+		"/:orgid/members/:userid",
+		authHandlers.RequireScope(authHandlers.ScopeOrgsWrite),
+		orgsHandlers.Middleware,
+		audit.Middleware(audit.ActionOrgMemberRemove),
+		orgsHandlers.HandleDeleteOrganizationMember,
+	)
+	// Protected routes that invite users to an organization by email.
+	// Resending replaces the link and extends the expiration, revoking deletes the invitation.
+	// e.g. https://example.com/api/v1/orgs/123/invitations
+	orgs.GET(
+		"/:orgid/invitations",
+		authHandlers.RequireScope(authHandlers.ScopeOrgsRead),
+		orgsHandlers.Middleware,
+		orgsHandlers.RequireRole(db.OrgRoleAdmin),
+		orgsHandlers.HandleGetInvitations,
+	)
+	orgs.POST(
+		"/:orgid/invitations",
+		authHandlers.RequireScope(authHandlers.ScopeOrgsWrite),
+		orgsHandlers.Middleware,
+		orgsHandlers.RequireRole(db.OrgRoleAdmin),
+		audit.Middleware(audit.ActionOrgInvite),
+		orgsHandlers.HandleCreateInvitation,
+	)
+	orgs.POST(
+		"/:orgid/invitations/:invitationid/resend",
+		authHandlers.RequireScope(authHandlers.ScopeOrgsWrite),
+		orgsHandlers.Middleware,
+		orgsHandlers.RequireRole(db.OrgRoleAdmin),
+		audit.Middleware(audit.ActionOrgInviteResend),
+		orgsHandlers.HandleResendInvitation,
+	)
+	orgs.DELETE(
+		"/:orgid/invitations/:invitationid",
+		authHandlers.RequireScope(authHandlers.ScopeOrgsWrite),
+		orgsHandlers.Middleware,
+		orgsHandlers.RequireRole(db.OrgRoleAdmin),
+		audit.Middleware(audit.ActionOrgInviteRevoke),
+		orgsHandlers.HandleRevokeInvitation,
+	)
+
+	/* Invitations */
+	invitations := v1.Group("/invitations")
+	// Protected route that accepts the invitation with the token from the link.
+	// The user signs in with any method first and the invitation must be sent to the user's email.
+	// e.g. https://example.com/api/v1/invitations/abc/accept
+	invitations.POST(
+		"/:token/accept",
+		authHandlers.CheckAuthenticationMiddleware,
+		authHandlers.RejectImpersonationMiddleware,
+		authHandlers.RequireScope(authHandlers.ScopeOrgsWrite),
+		audit.Middleware(audit.ActionOrgInviteAccept),
+		orgsHandlers.HandleAcceptInvitation,
+	)
+
+	/* Administration */
+	admin := v1.Group("/admin")
+	// Every admin route requires an authenticated admin
+	// and none of them is available while impersonating a user.
+	admin.Use(authHandlers.CheckAuthenticationMiddleware, authHandlers.RejectImpersonationMiddleware)
+	admin.Use(adminHandlers.Middleware()...)
+	// Protected route that changes the access level of a user.
+	// e.g. https://example.com/api/v1/admin/users/123/access-level
+	admin.PUT(
+		"/users/:userid/access-level",
+		audit.Middleware(audit.ActionAdminAccessLevel),
+		adminHandlers.HandleUpdateAccessLevel,
+	)
+	// Protected route that overrides the storage quota of a user.
+	// e.g. https://example.com/api/v1/admin/users/123/storage-quota
+	admin.PUT(
+		"/users/:userid/storage-quota",
+		audit.Middleware(audit.ActionAdminStorageQuota),
+		adminHandlers.HandleUpdateStorageQuota,
+	)
+	// Protected routes that disable and enable the account of a user.
+	admin.POST("/users/:userid/disable", audit.Middleware(audit.ActionAdminDisable), adminHandlers.HandleDisableUser)
+	admin.POST("/users/:userid/enable", audit.Middleware(audit.ActionAdminEnable), adminHandlers.HandleEnableUser)
+	// Protected route that signs a user out of all sessions.
+	admin.DELETE(
+		"/users/:userid/sessions",
+		audit.Middleware(audit.ActionAdminRevokeSessions),
+		adminHandlers.HandleRevokeUserSessions,
+	)
+	// Protected route that erases a user together with their photo and files.
+	// The deletion is recorded in the audit log by the handler, as the user is anonymized.
+	admin.DELETE("/users/:userid", adminHandlers.HandleDeleteUser)
+	// Protected route that issues a short-lived session of a user for the admin.
+	// e.g. https://example.com/api/v1/admin/users/123/impersonate
+	admin.POST(
+		"/users/:userid/impersonate",
+		audit.Middleware(audit.ActionAdminImpersonate),
+		adminHandlers.HandleImpersonateUser,
+	)
+	// Protected route that returns the audit log of a user.
+	admin.GET("/users/:userid/audit-log", audit.HandleGetAuditLog)
+
+	/* Two-factor authentication */
+	twoFactor := v1.Group("/users/me/2fa")
+	// The enrollment is also available to the sessions that are required to enroll
+	// a second factor before they can access anything else.
+	twoFactor.Use(
+		authHandlers.CheckTwoFactorEnrollmentMiddleware,
+		authHandlers.RejectImpersonationMiddleware,
+		authHandlers.RequireScope(authHandlers.ScopeCredentialsWrite),
+	)
+	// Protected route that starts TOTP enrollment and returns the provisioning URI.
+	twoFactor.POST("/totp", authHandlers.HandleTOTPEnrollment)
+	// Protected route that completes TOTP enrollment and returns the recovery codes.
+	twoFactor.POST("/totp/confirm", audit.Middleware(audit.ActionTOTPEnable), authHandlers.HandleTOTPConfirm)
+	// Protected route that disables TOTP.
+	twoFactor.DELETE("/totp", audit.Middleware(audit.ActionTOTPDisable), authHandlers.HandleTOTPDisable)
 
 	return r.router.Run(r.cfg.ServerAddress)
 }
 
 // contextMiddleware sets additional useful context to be used by other handlers.
-func contextMiddleware(
-	adapter db.Adapter,
-	sessionCache *cache.Cache,
-	fileStore filestore.FileStore,
-) gin.HandlerFunc {
+func contextMiddleware(cfg Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Set(helper.ContextDatabase, adapter)
-		c.Set(helper.ContextCache, sessionCache)
-		c.Set(helper.ContextFileStore, fileStore)
+		c.Set(helper.ContextDatabase, cfg.DB)
+		c.Set(helper.ContextCache, cfg.Cache)
+		c.Set(helper.ContextFileStore, cfg.FileStore)
+		c.Set(helper.ContextAuthProviders, cfg.AuthProviders)
+		c.Set(helper.ContextPasswordConfig, cfg.Password)
+		c.Set(helper.ContextMailer, cfg.Mailer)
+		c.Set(helper.ContextEmailConfig, cfg.Email)
+		c.Set(helper.ContextTwoFactorConfig, cfg.TwoFactor)
+		c.Set(helper.ContextWebAuthn, cfg.WebAuthn)
+		c.Set(helper.ContextRoles, cfg.Roles)
+		c.Set(helper.ContextScopesConfig, cfg.Scopes)
+		c.Set(helper.ContextRedirectConfig, cfg.Redirect)
+		c.Set(helper.ContextSessionCookieConfig, cfg.SessionCookie)
+		c.Set(helper.ContextOAuthStateKey, cfg.OAuthStateKey)
+		c.Set(helper.ContextProfileSyncConfig, cfg.ProfileSync)
+		c.Set(helper.ContextAccountDeletionConfig, cfg.AccountDeletion)
+		c.Set(helper.ContextInvitationConfig, cfg.Invitations)
+		c.Set(helper.ContextFilesConfig, cfg.Files)
 		c.Next()
 	}
 }
@@ -0,0 +1,264 @@
+package orgs
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type organizationRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
+
+type memberRoleRequest struct {
+	Role string `json:"role" binding:"required,oneof=owner admin member"`
+}
+
+// organizationResponse is an organization along with the role of the authenticated user in it.
+type organizationResponse struct {
+	db.Organization
+	Role string `json:"role"`
+}
+
+// HandleCreateOrganization creates an organization owned by the authenticated user.
+func HandleCreateOrganization(c *gin.Context) {
+	var req organizationRequest
+	if !bindOrAbort(c, &req) {
+		return
+	}
+
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	now := time.Now().UTC()
+	org := db.Organization{
+		ID:        uuid.NewString(),
+		Name:      strings.TrimSpace(req.Name),
+		CreatedBy: userID,
+		CreatedAt: now,
+	}
+	if err := database.CreateOrganization(&org); err != nil {
+		log.Printf("failed to create organization for user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	err := database.PutOrganizationMember(&db.OrganizationMember{
+		OrgID:     org.ID,
+		UserID:    userID,
+		Role:      db.OrgRoleOwner,
+		CreatedAt: now,
+	})
+	if err != nil {
+		log.Printf("failed to add owner '%s' to organization '%s': %s\n", userID, org.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, organizationResponse{Organization: org, Role: db.OrgRoleOwner})
+}
+
+// HandleGetOrganizations returns the organizations the authenticated user is a member of.
+func HandleGetOrganizations(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	memberships, err := database.GetUserMemberships(userID)
+	if err != nil {
+		log.Printf("failed to get memberships of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	orgs := make([]organizationResponse, 0, len(memberships))
+	for _, membership := range memberships {
+		org, err := database.GetOrganization(membership.OrgID)
+		if err != nil {
+			if err == db.ErrNotFound {
+				continue
+			}
+			log.Printf("failed to get organization '%s': %s\n", membership.OrgID, err.Error())
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		orgs = append(orgs, organizationResponse{Organization: org, Role: membership.Role})
+	}
+
+	c.JSON(http.StatusOK, orgs)
+}
+
+// HandleGetOrganization returns the organization from the path.
+func HandleGetOrganization(c *gin.Context) {
+	c.JSON(http.StatusOK, organizationResponse{
+		Organization: c.MustGet(helper.ContextOrganization).(db.Organization),
+		Role:         c.MustGet(helper.ContextOrgRole).(string),
+	})
+}
+
+// HandleUpdateOrganization renames the organization from the path.
+func HandleUpdateOrganization(c *gin.Context) {
+	var req organizationRequest
+	if !bindOrAbort(c, &req) {
+		return
+	}
+
+	org := c.MustGet(helper.ContextOrganization).(db.Organization)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	org, err := database.UpdateOrganizationName(org.ID, strings.TrimSpace(req.Name))
+	if err != nil {
+		log.Printf("failed to update organization '%s': %s\n", org.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, organizationResponse{
+		Organization: org,
+		Role:         c.MustGet(helper.ContextOrgRole).(string),
+	})
+}
+
+// HandleDeleteOrganization deletes the organization from the path along with the memberships.
+func HandleDeleteOrganization(c *gin.Context) {
+	org := c.MustGet(helper.ContextOrganization).(db.Organization)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	if err := database.DeleteOrganization(org.ID); err != nil {
+		log.Printf("failed to delete organization '%s': %s\n", org.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// HandleGetOrganizationMembers returns the members of the organization from the path.
+func HandleGetOrganizationMembers(c *gin.Context) {
+	org := c.MustGet(helper.ContextOrganization).(db.Organization)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	members, err := database.GetOrganizationMembers(org.ID)
+	if err != nil {
+		log.Printf("failed to get members of organization '%s': %s\n", org.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// HandleUpdateOrganizationMember changes the role of the member from the path.
+// Only owners can grant or revoke the owner role and the last owner cannot be demoted.
+func HandleUpdateOrganizationMember(c *gin.Context) {
+	var req memberRoleRequest
+	if !bindOrAbort(c, &req) {
+		return
+	}
+	member, ok := targetMemberOrAbort(c)
+	if !ok {
+		return
+	}
+	if (req.Role == db.OrgRoleOwner || member.Role == db.OrgRoleOwner) &&
+		!HasRole(c.MustGet(helper.ContextOrgRole).(string), db.OrgRoleOwner) {
+		c.AbortWithStatusJSON(http.StatusForbidden, helper.HTTPMessage{
+			Message: "only owners can manage owners",
+		})
+		return
+	}
+	if member.Role == db.OrgRoleOwner && req.Role != db.OrgRoleOwner && !hasOtherOwnerOrAbort(c, member) {
+		return
+	}
+
+	member.Role = req.Role
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	if err := database.PutOrganizationMember(&member); err != nil {
+		log.Printf("failed to update member '%s' of organization '%s': %s\n", member.UserID, member.OrgID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, member)
+}
+
+// HandleDeleteOrganizationMember removes the member from the path from the organization.
+// Members can leave on their own, otherwise it requires the admin role
+// and only owners can remove owners. The last owner cannot leave.
+func HandleDeleteOrganizationMember(c *gin.Context) {
+	member, ok := targetMemberOrAbort(c)
+	if !ok {
+		return
+	}
+	role := c.MustGet(helper.ContextOrgRole).(string)
+	if member.UserID != c.MustGet(helper.ContextUserID).(string) &&
+		(!HasRole(role, db.OrgRoleAdmin) || !HasRole(role, member.Role)) {
+		c.AbortWithStatusJSON(http.StatusForbidden, helper.HTTPMessage{
+			Message: "insufficient rights in the organization",
+		})
+		return
+	}
+	if member.Role == db.OrgRoleOwner && !hasOtherOwnerOrAbort(c, member) {
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	if err := database.DeleteOrganizationMember(member.OrgID, member.UserID); err != nil {
+		log.Printf("failed to delete member '%s' of organization '%s': %s\n", member.UserID, member.OrgID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// targetMemberOrAbort finds the member from 'userid' path parameter in the organization.
+func targetMemberOrAbort(c *gin.Context) (db.OrganizationMember, bool) {
+	org := c.MustGet(helper.ContextOrganization).(db.Organization)
+	userID := c.Param("userid")
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	member, err := database.GetOrganizationMember(org.ID, userID)
+	if err != nil {
+		if err == db.ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{Message: "member not found"})
+			return db.OrganizationMember{}, false
+		}
+		log.Printf("failed to get member '%s' of organization '%s': %s\n", userID, org.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return db.OrganizationMember{}, false
+	}
+	return member, true
+}
+
+// hasOtherOwnerOrAbort verifies that the organization has an owner besides the member,
+// so that it is never left without one.
+func hasOtherOwnerOrAbort(c *gin.Context, member db.OrganizationMember) bool {
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	members, err := database.GetOrganizationMembers(member.OrgID)
+	if err != nil {
+		log.Printf("failed to get members of organization '%s': %s\n", member.OrgID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	for _, m := range members {
+		if m.Role == db.OrgRoleOwner && m.UserID != member.UserID {
+			return true
+		}
+	}
+	c.AbortWithStatusJSON(http.StatusConflict, helper.HTTPMessage{
+		Message: "the organization must have an owner",
+	})
+	return false
+}
+
+func bindOrAbort(c *gin.Context, req interface{}) bool {
+	if err := c.ShouldBindJSON(req); err != nil {
+		if response, ok := helper.NewHTTPValidationErrors(err); ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, response)
+			return false
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,344 @@
+package orgs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/mailer"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var ErrInvalidInvitation = errors.New("invalid or expired invitation")
+
+// InvitationConfig is the configuration of the invitations to the organizations.
+type InvitationConfig struct {
+	// URL is the URL of the frontend page that accepts the invitation once the user signs in,
+	// e.g. https://example.com/invitations
+	// The token is added to the query as 'token'.
+	URL string
+	// TTL is how long an invitation is valid.
+	TTL time.Duration
+}
+
+type invitationRequest struct {
+	Email string `json:"email" binding:"required,email,max=254"`
+	Role  string `json:"role" binding:"required,oneof=owner admin member"`
+}
+
+// HandleCreateInvitation invites the email to the organization from the path with the role
+// and sends the invitation link to the email.
+// Only owners can invite owners.
+func HandleCreateInvitation(c *gin.Context) {
+	var req invitationRequest
+	if !bindOrAbort(c, &req) {
+		return
+	}
+	req.Email = db.NormalizeEmail(req.Email)
+	if !canInviteOrAbort(c, req.Role) {
+		return
+	}
+
+	org := c.MustGet(helper.ContextOrganization).(db.Organization)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	user, err := database.GetUserByEmail(req.Email)
+	if err == nil {
+		_, err = database.GetOrganizationMember(org.ID, user.ID)
+		if err == nil {
+			c.AbortWithStatusJSON(http.StatusConflict, helper.HTTPMessage{Message: "the user is already a member"})
+			return
+		}
+	}
+	if err != nil && err != db.ErrNotFound {
+		log.Printf("failed to check membership of '%s' in organization '%s': %s\n", req.Email, org.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	invitations, err := database.GetInvitationsByEmail(req.Email)
+	if err != nil {
+		log.Printf("failed to get invitations of '%s': %s\n", req.Email, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	for _, invitation := range invitations {
+		if invitation.OrgID == org.ID {
+			c.AbortWithStatusJSON(http.StatusConflict, helper.HTTPMessage{
+				Message: "the email is already invited, resend or revoke the invitation",
+			})
+			return
+		}
+	}
+
+	cfg := c.MustGet(helper.ContextInvitationConfig).(InvitationConfig)
+	rawToken := helper.GenerateRandomString(32)
+	now := time.Now().UTC()
+	invitation := db.Invitation{
+		ID:        uuid.NewString(),
+		OrgID:     org.ID,
+		Email:     req.Email,
+		Role:      req.Role,
+		TokenHash: helper.HashToken(rawToken),
+		InvitedBy: c.MustGet(helper.ContextUserID).(string),
+		CreatedAt: now,
+		ExpiresAt: now.Add(cfg.TTL),
+	}
+	if err = database.CreateInvitation(&invitation); err != nil {
+		log.Printf("failed to create invitation to organization '%s': %s\n", org.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err = sendInvitation(c, org, invitation, rawToken); err != nil {
+		log.Printf("failed to send invitation '%s': %s\n", invitation.ID, err.Error())
+		if err = database.DeleteInvitation(invitation.ID); err != nil {
+			log.Printf("failed to delete invitation '%s': %s\n", invitation.ID, err.Error())
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, helper.HTTPMessage{
+			Message: "failed to send invitation",
+		})
+		return
+	}
+
+	invitation.TokenHash = ""
+	c.JSON(http.StatusCreated, invitation)
+}
+
+// HandleGetInvitations returns the invitations to the organization from the path, including the expired ones.
+func HandleGetInvitations(c *gin.Context) {
+	org := c.MustGet(helper.ContextOrganization).(db.Organization)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	invitations, err := database.GetOrganizationInvitations(org.ID)
+	if err != nil {
+		log.Printf("failed to get invitations to organization '%s': %s\n", org.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	for i := range invitations {
+		invitations[i].TokenHash = ""
+	}
+
+	c.JSON(http.StatusOK, invitations)
+}
+
+// HandleResendInvitation sends the invitation from the path again with a new link
+// and extends its expiration. The previous link no longer works.
+func HandleResendInvitation(c *gin.Context) {
+	invitation, ok := targetInvitationOrAbort(c)
+	if !ok {
+		return
+	}
+	if !canInviteOrAbort(c, invitation.Role) {
+		return
+	}
+
+	cfg := c.MustGet(helper.ContextInvitationConfig).(InvitationConfig)
+	rawToken := helper.GenerateRandomString(32)
+	invitation.TokenHash = helper.HashToken(rawToken)
+	invitation.InvitedBy = c.MustGet(helper.ContextUserID).(string)
+	invitation.ExpiresAt = time.Now().UTC().Add(cfg.TTL)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	err := database.UpdateInvitationToken(invitation.ID, invitation.TokenHash, invitation.InvitedBy, invitation.ExpiresAt)
+	if err != nil {
+		log.Printf("failed to update invitation '%s': %s\n", invitation.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	org := c.MustGet(helper.ContextOrganization).(db.Organization)
+	if err = sendInvitation(c, org, invitation, rawToken); err != nil {
+		log.Printf("failed to send invitation '%s': %s\n", invitation.ID, err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, helper.HTTPMessage{
+			Message: "failed to send invitation",
+		})
+		return
+	}
+
+	invitation.TokenHash = ""
+	c.JSON(http.StatusOK, invitation)
+}
+
+// HandleRevokeInvitation deletes the invitation from the path, so its link no longer works.
+func HandleRevokeInvitation(c *gin.Context) {
+	invitation, ok := targetInvitationOrAbort(c)
+	if !ok {
+		return
+	}
+	if !canInviteOrAbort(c, invitation.Role) {
+		return
+	}
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	if err := database.DeleteInvitation(invitation.ID); err != nil && err != db.ErrNotFound {
+		log.Printf("failed to delete invitation '%s': %s\n", invitation.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// HandleAcceptInvitation adds the authenticated user to the organization
+// with the token from the invitation link in the path.
+// The invitation must be sent to the email of the user, however the user signed in.
+// The email of the user is verified by the link.
+func HandleAcceptInvitation(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	invitation, err := database.GetInvitationByTokenHash(helper.HashToken(c.Param("token")))
+	if err != nil {
+		if err == db.ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: ErrInvalidInvitation.Error()})
+			return
+		}
+		log.Println("failed to get invitation by token:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if time.Now().After(invitation.ExpiresAt) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: ErrInvalidInvitation.Error()})
+		return
+	}
+
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("failed to get user by ID '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !strings.EqualFold(user.Email, invitation.Email) {
+		c.AbortWithStatusJSON(http.StatusForbidden, helper.HTTPMessage{
+			Message: "the invitation was sent to another email",
+		})
+		return
+	}
+
+	member, err := acceptInvitation(database, invitation, userID)
+	if err != nil {
+		if err == ErrInvalidInvitation {
+			c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: err.Error()})
+			return
+		}
+		log.Printf("failed to accept invitation '%s': %s\n", invitation.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !user.VerifiedEmail {
+		if err = database.UpdateUserVerifiedEmail(userID, true); err != nil {
+			log.Printf("failed to update user '%s' verified email: %s\n", userID, err.Error())
+		}
+	}
+
+	c.JSON(http.StatusOK, member)
+}
+
+// AcceptInvitationsByEmail adds the user to the organizations the email of the user is invited to.
+// It must only be used once the email is verified, e.g. by the identity provider on the first sign in.
+func AcceptInvitationsByEmail(database db.Adapter, user db.User) error {
+	invitations, err := database.GetInvitationsByEmail(db.NormalizeEmail(user.Email))
+	if err != nil {
+		return fmt.Errorf("failed to get invitations: %w", err)
+	}
+	for _, invitation := range invitations {
+		if time.Now().After(invitation.ExpiresAt) {
+			continue
+		}
+		_, err = acceptInvitation(database, invitation, user.ID)
+		if err == ErrInvalidInvitation {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept invitation '%s': %w", invitation.ID, err)
+		}
+		log.Printf("user '%s' joined organization '%s' by invitation\n", user.ID, invitation.OrgID)
+	}
+	return nil
+}
+
+// acceptInvitation deletes the invitation and adds the user to the organization with the role of the invitation.
+// The role of a user who is already a member is only ever raised.
+func acceptInvitation(database db.Adapter, invitation db.Invitation, userID string) (db.OrganizationMember, error) {
+	// The invitation is deleted first, so it is only accepted once.
+	if err := database.DeleteInvitation(invitation.ID); err != nil {
+		if err == db.ErrNotFound {
+			return db.OrganizationMember{}, ErrInvalidInvitation
+		}
+		return db.OrganizationMember{}, err
+	}
+
+	member, err := database.GetOrganizationMember(invitation.OrgID, userID)
+	switch {
+	case err == nil && HasRole(member.Role, invitation.Role):
+		return member, nil
+	case err == nil:
+		member.Role = invitation.Role
+	case err == db.ErrNotFound:
+		member = db.OrganizationMember{
+			OrgID:     invitation.OrgID,
+			UserID:    userID,
+			Role:      invitation.Role,
+			CreatedAt: time.Now().UTC(),
+		}
+	default:
+		return db.OrganizationMember{}, err
+	}
+	if err = database.PutOrganizationMember(&member); err != nil {
+		return db.OrganizationMember{}, err
+	}
+	return member, nil
+}
+
+// sendInvitation emails the invitation link with the token to the invited email.
+func sendInvitation(c *gin.Context, org db.Organization, invitation db.Invitation, rawToken string) error {
+	cfg := c.MustGet(helper.ContextInvitationConfig).(InvitationConfig)
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("invalid invitation URL: %w", err)
+	}
+	query := u.Query()
+	query.Set("token", rawToken)
+	u.RawQuery = query.Encode()
+
+	m := c.MustGet(helper.ContextMailer).(mailer.Mailer)
+	return m.Send(mailer.Message{
+		To:      invitation.Email,
+		Subject: fmt.Sprintf("You are invited to join %s", org.Name),
+		Body: fmt.Sprintf(
+			"You are invited to join %s as %s. Follow the link to accept the invitation:\n\n%s\n\nThe link expires in %s.\n",
+			org.Name, invitation.Role, u.String(), cfg.TTL,
+		),
+	})
+}
+
+// targetInvitationOrAbort finds the invitation from 'invitationid' path parameter in the organization.
+func targetInvitationOrAbort(c *gin.Context) (db.Invitation, bool) {
+	org := c.MustGet(helper.ContextOrganization).(db.Organization)
+	invitationID := c.Param("invitationid")
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	invitation, err := database.GetInvitation(invitationID)
+	if err != nil && err != db.ErrNotFound {
+		log.Printf("failed to get invitation '%s': %s\n", invitationID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return db.Invitation{}, false
+	}
+	if err == db.ErrNotFound || invitation.OrgID != org.ID {
+		c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{Message: "invitation not found"})
+		return db.Invitation{}, false
+	}
+	return invitation, true
+}
+
+// canInviteOrAbort verifies that the authenticated user may invite with the role.
+func canInviteOrAbort(c *gin.Context, role string) bool {
+	if role == db.OrgRoleOwner && !HasRole(c.MustGet(helper.ContextOrgRole).(string), db.OrgRoleOwner) {
+		c.AbortWithStatusJSON(http.StatusForbidden, helper.HTTPMessage{
+			Message: "only owners can manage owners",
+		})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package orgs
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// roleRanks orders the roles of the members, so that a role includes the rights of the lower ones.
+var roleRanks = map[string]int{
+	db.OrgRoleMember: 1,
+	db.OrgRoleAdmin:  2,
+	db.OrgRoleOwner:  3,
+}
+
+// HasRole returns true if the role of the member is the role or a more privileged one.
+func HasRole(memberRole, role string) bool {
+	return roleRanks[memberRole] >= roleRanks[role]
+}
+
+// Middleware resolves the organization from ':orgid' path parameter
+// and verifies that the authenticated user is a member of it.
+// The organization and the role of the member are set in the context.
+// It must be used after the authentication check.
+func Middleware(c *gin.Context) {
+	orgID := c.Param("orgid")
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	org, err := database.GetOrganization(orgID)
+	if err != nil {
+		if err == db.ErrNotFound {
+			abortOrganizationNotFound(c)
+			return
+		}
+		log.Printf("failed to get organization '%s': %s\n", orgID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	member, err := database.GetOrganizationMember(orgID, userID)
+	if err != nil {
+		// Organizations of others are not revealed.
+		if err == db.ErrNotFound {
+			abortOrganizationNotFound(c)
+			return
+		}
+		log.Printf("failed to get member '%s' of organization '%s': %s\n", userID, orgID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Set(helper.ContextOrganization, org)
+	c.Set(helper.ContextOrgRole, member.Role)
+	c.Next()
+}
+
+// RequireRole returns a middleware that verifies that the authenticated user
+// has the role or a more privileged one in the organization.
+// It must be used after Middleware.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasRole(c.MustGet(helper.ContextOrgRole).(string), role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, helper.HTTPMessage{
+				Message: "insufficient rights in the organization",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+func abortOrganizationNotFound(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{Message: "organization not found"})
+}
@@ -0,0 +1,90 @@
+package rbac
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+type userRolesResponse struct {
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// HandleGetUserRoles returns the roles and the permissions of a user.
+func HandleGetUserRoles(c *gin.Context) {
+	userID := c.Param("userid")
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	roles, err := UserRoles(database, userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{Message: "user not found"})
+			return
+		}
+		log.Printf("failed to get roles of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, userRolesResponse{
+		Roles:       roles,
+		Permissions: c.MustGet(helper.ContextRoles).(Roles).Permissions(roles),
+	})
+}
+
+// HandleAssignUserRole assigns a role to a user.
+func HandleAssignUserRole(c *gin.Context) {
+	userID := c.Param("userid")
+	role := c.Param("role")
+	if _, ok := c.MustGet(helper.ContextRoles).(Roles)[role]; !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: "unknown role"})
+		return
+	}
+
+	// Migrate the user first, so the assignment does not replace the migrated role.
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	if _, err := UserRoles(database, userID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{Message: "user not found"})
+			return
+		}
+		log.Printf("failed to get roles of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := database.AssignUserRole(userID, role); err != nil {
+		log.Printf("failed to assign role '%s' to user '%s': %s\n", role, userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// HandleUnassignUserRole removes a role from a user.
+// The last role of a user cannot be removed.
+func HandleUnassignUserRole(c *gin.Context) {
+	userID := c.Param("userid")
+	role := c.Param("role")
+
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	if err := UnassignUserRole(database, userID, role); err != nil {
+		if errors.Is(err, ErrLastRole) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: err.Error()})
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{Message: "role is not assigned"})
+			return
+		}
+		log.Printf("failed to unassign role '%s' from user '%s': %s\n", role, userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
@@ -0,0 +1,230 @@
+package rbac
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// Permissions are in the 'resource:action:scope' format.
+// A '*' segment matches the segment and everything after it, e.g. 'users:*'.
+const (
+	PermissionAll            = "*"
+	PermissionUsersReadSelf  = "users:read:self"
+	PermissionUsersReadAny   = "users:read:any"
+	PermissionUsersWriteSelf = "users:write:self"
+	PermissionUsersWriteAny  = "users:write:any"
+	PermissionRolesRead      = "roles:read"
+	PermissionRolesWrite     = "roles:write"
+)
+
+// AdminPermissions are the permissions that act on other users or on the roles.
+var AdminPermissions = []string{
+	PermissionUsersReadAny,
+	PermissionUsersWriteAny,
+	PermissionRolesRead,
+	PermissionRolesWrite,
+}
+
+const (
+	// RoleSuperuser has all permissions.
+	RoleSuperuser = "superuser"
+	// RoleMember is the default role of every user.
+	RoleMember = "member"
+)
+
+// Roles maps role names to the permissions they grant.
+type Roles map[string][]string
+
+var DefaultRoles = Roles{
+	RoleSuperuser: {PermissionAll},
+	RoleMember: {
+		PermissionUsersReadSelf,
+		PermissionUsersWriteSelf,
+	},
+}
+
+// Permissions returns all permissions granted by the roles.
+// Unknown roles grant nothing.
+func (r Roles) Permissions(roles []string) []string {
+	var permissions []string
+	for _, role := range roles {
+		permissions = append(permissions, r[role]...)
+	}
+	return permissions
+}
+
+// HasPermission returns true if any of the granted permissions matches the permission.
+func HasPermission(granted []string, permission string) bool {
+	for _, g := range granted {
+		if matchPermission(g, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAdminPermission returns true if any of the granted permissions matches one of AdminPermissions.
+func HasAdminPermission(granted []string) bool {
+	for _, permission := range AdminPermissions {
+		if HasPermission(granted, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPermission(granted, permission string) bool {
+	grantedParts := strings.Split(granted, ":")
+	parts := strings.Split(permission, ":")
+	for i, g := range grantedParts {
+		if g == "*" {
+			return true
+		}
+		if i >= len(parts) || g != parts[i] {
+			return false
+		}
+	}
+	return len(grantedParts) == len(parts)
+}
+
+// RequirePermission returns a middleware that verifies that the authenticated user
+// has all the permissions.
+func RequirePermission(permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted, ok := loadPermissions(c)
+		if !ok {
+			return
+		}
+		for _, permission := range permissions {
+			if !HasPermission(granted, permission) {
+				abortInsufficientRights(c)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// RequireUserPermission returns a middleware that verifies that the authenticated user
+// may perform the action, e.g. 'users:read', on the user from the path parameter.
+// The action requires the ':self' scope for the authenticated user and the ':any' scope for other users.
+func RequireUserPermission(param, action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted, ok := loadPermissions(c)
+		if !ok {
+			return
+		}
+		permission := action + ":any"
+		if c.Param(param) == c.MustGet(helper.ContextUserID).(string) {
+			permission = action + ":self"
+		}
+		if !HasPermission(granted, permission) {
+			abortInsufficientRights(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// ContextHasPermission returns true if the authenticated user has the permission.
+func ContextHasPermission(c *gin.Context, permission string) bool {
+	granted, err := contextPermissions(c)
+	if err != nil {
+		log.Println("failed to load permissions:", err)
+		return false
+	}
+	return HasPermission(granted, permission)
+}
+
+func loadPermissions(c *gin.Context) ([]string, bool) {
+	granted, err := contextPermissions(c)
+	if err != nil {
+		log.Println("failed to load permissions:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	return granted, true
+}
+
+// contextPermissions resolves the permissions of the authenticated user
+// and stores them in the context for the next handlers.
+func contextPermissions(c *gin.Context) ([]string, error) {
+	if permissions, ok := c.Get(helper.ContextUserPermissions); ok {
+		return permissions.([]string), nil
+	}
+
+	userID := c.MustGet(helper.ContextUserID).(string)
+	database := c.MustGet(helper.ContextDatabase).(db.Adapter)
+	roles, err := UserRoles(database, userID)
+	if err != nil {
+		return nil, err
+	}
+	permissions := c.MustGet(helper.ContextRoles).(Roles).Permissions(roles)
+	c.Set(helper.ContextUserPermissions, permissions)
+	return permissions, nil
+}
+
+// UserRoles returns the roles of the user.
+// Users without roles are migrated from the access level:
+// admins become superusers and everybody else becomes a member.
+func UserRoles(database db.Adapter, userID string) ([]string, error) {
+	roles, err := database.GetUserRoles(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user roles: %w", err)
+	}
+	if len(roles) > 0 {
+		return roles, nil
+	}
+
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	role := RoleMember
+	if user.AccessLevel == db.AccessLevelAdmin {
+		role = RoleSuperuser
+	}
+	if err = database.AssignUserRole(userID, role); err != nil {
+		return nil, fmt.Errorf("failed to assign role: %w", err)
+	}
+	log.Printf("migrated user '%s' with access level '%s' to role '%s'\n", userID, user.AccessLevel, role)
+
+	return []string{role}, nil
+}
+
+var ErrLastRole = errors.New("the last role of a user cannot be removed")
+
+// userRolesMx makes sure that the concurrent unassignments cannot remove all roles of a user.
+var userRolesMx sync.Mutex
+
+// UnassignUserRole unassigns the role from the user.
+// Users without roles would be migrated from the access level again,
+// so ErrLastRole is returned instead of removing the last role.
+func UnassignUserRole(database db.Adapter, userID, role string) error {
+	userRolesMx.Lock()
+	defer userRolesMx.Unlock()
+
+	roles, err := database.GetUserRoles(userID)
+	if err != nil {
+		return fmt.Errorf("failed to get user roles: %w", err)
+	}
+	if len(roles) == 1 && roles[0] == role {
+		return ErrLastRole
+	}
+	return database.UnassignUserRole(userID, role)
+}
+
+func abortInsufficientRights(c *gin.Context) {
+	c.AbortWithStatusJSON(
+		http.StatusForbidden,
+		helper.HTTPMessage{Message: "insufficient rights"},
+	)
+}
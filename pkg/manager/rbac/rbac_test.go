@@ -0,0 +1,145 @@
+package rbac
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/bazuker/backend-bootstrap/pkg/db"
+	localDB "github.com/bazuker/backend-bootstrap/pkg/db/local"
+)
+
+func newTestDB(t *testing.T) db.Adapter {
+	t.Helper()
+	database, err := localDB.New(localDB.Config{Filename: filepath.Join(t.TempDir(), "db.json")})
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	return database
+}
+
+func TestHasPermission(t *testing.T) {
+	tests := []struct {
+		name       string
+		granted    []string
+		permission string
+		ok         bool
+	}{
+		{
+			name:       "exact match",
+			granted:    []string{PermissionUsersReadSelf},
+			permission: PermissionUsersReadSelf,
+			ok:         true,
+		},
+		{
+			name:       "all permissions",
+			granted:    []string{PermissionAll},
+			permission: PermissionRolesWrite,
+			ok:         true,
+		},
+		{
+			name:       "wildcard segment",
+			granted:    []string{"users:*"},
+			permission: PermissionUsersWriteAny,
+			ok:         true,
+		},
+		{
+			name:       "wildcard of another resource",
+			granted:    []string{"roles:*"},
+			permission: PermissionUsersReadAny,
+		},
+		{
+			name:       "another scope",
+			granted:    []string{PermissionUsersReadSelf},
+			permission: PermissionUsersReadAny,
+		},
+		{
+			name:       "shorter permission",
+			granted:    []string{PermissionUsersReadSelf},
+			permission: "users:read",
+		},
+		{
+			name:       "longer permission",
+			granted:    []string{PermissionRolesRead},
+			permission: "roles:read:any",
+		},
+		{
+			name:       "nothing granted",
+			permission: PermissionUsersReadSelf,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ok := HasPermission(test.granted, test.permission); ok != test.ok {
+				t.Errorf("expected %t, got %t", test.ok, ok)
+			}
+		})
+	}
+}
+
+func TestHasAdminPermission(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles []string
+		ok    bool
+	}{
+		{
+			name:  "superuser",
+			roles: []string{RoleSuperuser},
+			ok:    true,
+		},
+		{
+			name:  "member",
+			roles: []string{RoleMember},
+		},
+		{
+			name:  "unknown role",
+			roles: []string{"unknown"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ok := HasAdminPermission(DefaultRoles.Permissions(test.roles)); ok != test.ok {
+				t.Errorf("expected %t, got %t", test.ok, ok)
+			}
+		})
+	}
+}
+
+func TestUnassignUserRole(t *testing.T) {
+	database := newTestDB(t)
+	for _, role := range []string{RoleMember, RoleSuperuser} {
+		if err := database.AssignUserRole("user", role); err != nil {
+			t.Fatalf("failed to assign role: %s", err)
+		}
+	}
+
+	// Only one of the concurrent unassignments succeeds, so the user keeps a role.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, role := range []string{RoleMember, RoleSuperuser} {
+		wg.Add(1)
+		go func(i int, role string) {
+			defer wg.Done()
+			errs[i] = UnassignUserRole(database, "user", role)
+		}(i, role)
+	}
+	wg.Wait()
+
+	if (errs[0] == nil) == (errs[1] == nil) {
+		t.Fatalf("expected exactly one unassignment to succeed, got %v", errs)
+	}
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, ErrLastRole) {
+			t.Errorf("expected ErrLastRole, got %v", err)
+		}
+	}
+	roles, err := database.GetUserRoles("user")
+	if err != nil {
+		t.Fatalf("failed to get roles: %s", err)
+	}
+	if len(roles) != 1 {
+		t.Errorf("expected one role, got %v", roles)
+	}
+}
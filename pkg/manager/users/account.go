@@ -0,0 +1,436 @@
+package users
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/akyoto/cache"
+	database "github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/filestore"
+	"github.com/bazuker/backend-bootstrap/pkg/mailer"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+)
+
+// AccountDeletionConfig configures the deletion of the accounts by the users themselves.
+type AccountDeletionConfig struct {
+	// GracePeriod is how long the deleted accounts are kept before they are erased for good.
+	// Defaults to 30 days.
+	GracePeriod time.Duration
+	// ErasureInterval is how often the accounts past the grace period are erased.
+	// Defaults to an hour.
+	ErasureInterval time.Duration
+	// RestoreAccountURL is the URL of the frontend page that cancels the deletion of the account,
+	// e.g. https://example.com/restore-account
+	// The token is added to the query as 'token'. The link is valid for the grace period.
+	RestoreAccountURL string
+}
+
+var ErrInvalidRestoreToken = errors.New("invalid or expired token")
+
+type restoreAccountRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type deleteAccountResponse struct {
+	Message string `json:"message"`
+	// ErasureAt is when the account is erased for good.
+	ErasureAt time.Time `json:"erasureAt"`
+}
+
+// exportSession is a session of the user in the export.
+// The access token is never exported.
+type exportSession struct {
+	AccessLevel      string   `json:"accessLevel"`
+	Scopes           []string `json:"scopes"`
+	TwoFactorPending bool     `json:"twoFactorPending"`
+	Impersonated     bool     `json:"impersonated"`
+}
+
+// exportDocument is a JSON document in the export.
+type exportDocument struct {
+	name string
+	v    interface{}
+}
+
+// HandleUsersMeExport responds with a ZIP archive of the data of the authenticated user:
+// the profile, the linked identities, the roles, the credentials without secrets, the memberships,
+// the audit log, the active sessions, the photo and the library files.
+func HandleUsersMeExport(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		log.Printf("failed to get user by ID '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			helper.HTTPMessage{Message: "failed to get user"},
+		)
+		return
+	}
+
+	documents, keys, err := exportUser(c, user)
+	if err != nil {
+		log.Printf("failed to export user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			helper.HTTPMessage{Message: "failed to export user"},
+		)
+		return
+	}
+
+	// The archive is streamed, so that the library files are not held in memory at once.
+	// The status is sent with the first bytes, so the errors past this point can only cut the archive short.
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%s.zip"`, userID))
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+	fs := c.MustGet(helper.ContextFileStore).(filestore.FileStore)
+	if err = writeExport(c.Writer, fs, documents, keys); err != nil {
+		log.Printf("failed to write export of user '%s': %s\n", userID, err.Error())
+		c.Abort()
+	}
+}
+
+// exportUser collects the documents of the user and the keys of the objects in the file store to export.
+func exportUser(c *gin.Context, user database.User) ([]exportDocument, []string, error) {
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	identities, err := db.GetUserIdentities(user.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get identities: %w", err)
+	}
+	roles, err := db.GetUserRoles(user.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get roles: %w", err)
+	}
+	apiKeys, err := db.GetAPIKeys(user.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get API keys: %w", err)
+	}
+	for i := range apiKeys {
+		apiKeys[i].Hash = ""
+	}
+	webAuthnCredentials, err := db.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get WebAuthn credentials: %w", err)
+	}
+	memberships, err := db.GetUserMemberships(user.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get memberships: %w", err)
+	}
+	files, err := userFiles(db, user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	auditEntries, err := db.GetAuditEntries(user.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get audit entries: %w", err)
+	}
+	sessions := []exportSession{}
+	sessionCache := c.MustGet(helper.ContextCache).(*cache.Cache)
+	for _, sessionData := range helper.UserSessions(sessionCache, user.ID) {
+		sessions = append(sessions, exportSession{
+			AccessLevel:      sessionData.AccessLevel,
+			Scopes:           sessionData.Scopes,
+			TwoFactorPending: sessionData.TwoFactorPending,
+			Impersonated:     len(sessionData.ImpersonatorID) > 0,
+		})
+	}
+
+	documents := []exportDocument{
+		{"profile.json", user},
+		{"identities.json", identities},
+		{"roles.json", roles},
+		{"api-keys.json", apiKeys},
+		{"webauthn-credentials.json", webAuthnCredentials},
+		{"organizations.json", memberships},
+		{"files.json", files},
+		{"audit-log.json", auditEntries},
+		{"sessions.json", sessions},
+	}
+	keys := UserObjectKeys(user)
+	for _, file := range files {
+		keys = append(keys, file.Key)
+	}
+	return documents, keys, nil
+}
+
+// writeExport writes the documents and the objects to a ZIP archive one by one.
+func writeExport(out io.Writer, fs filestore.FileStore, documents []exportDocument, keys []string) error {
+	w := zip.NewWriter(out)
+	for _, document := range documents {
+		data, err := json.MarshalIndent(document.v, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %w", document.name, err)
+		}
+		if err = writeZipFile(w, document.name, data); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		object, err := fs.GetObject(key)
+		if err != nil {
+			return fmt.Errorf("failed to get object '%s': %w", key, err)
+		}
+		if err = writeZipFile(w, "files/"+key, object); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close the archive: %w", err)
+	}
+	return nil
+}
+
+func writeZipFile(w *zip.Writer, name string, data []byte) error {
+	f, err := w.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	if _, err = f.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// HandleDeleteAccount deletes the account of the authenticated user.
+// The photo of the user is deleted and the sessions are locked out immediately,
+// the library files and the rest of the account are erased and the audit log is anonymized
+// after the grace period. A link to restore the account is emailed to the user.
+// The sessions and the session cookies are revoked by the authentication middleware.
+func HandleDeleteAccount(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		log.Printf("failed to get user by ID '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			helper.HTTPMessage{Message: "failed to get user"},
+		)
+		return
+	}
+
+	fs := c.MustGet(helper.ContextFileStore).(filestore.FileStore)
+	for _, key := range UserObjectKeys(user) {
+		if err = fs.DeleteObject(key); err != nil {
+			log.Printf("failed to delete object '%s' of user '%s': %s\n", key, userID, err.Error())
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	cfg := c.MustGet(helper.ContextAccountDeletionConfig).(AccountDeletionConfig)
+	erasureAt := time.Now().UTC().Add(cfg.GracePeriod)
+	noPhoto := ""
+	_, err = db.UpdateUser(userID, database.UserUpdate{
+		PhotoURL:       &noPhoto,
+		PhotoSourceURL: &noPhoto,
+		ErasureAt:      &erasureAt,
+	})
+	if err != nil {
+		log.Printf("failed to schedule erasure of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err = updateUserStatus(c, userID, database.UserStatusDeleted); err != nil {
+		log.Printf("failed to update status of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// The account is deleted even if the restore link cannot be sent.
+	if len(user.Email) > 0 {
+		if err = sendRestoreLink(c, user, cfg); err != nil {
+			log.Printf("failed to send account restore link to user '%s': %s\n", userID, err.Error())
+		}
+	}
+
+	log.Printf("user '%s' deleted their account, erasure at %s\n", userID, erasureAt.Format(time.RFC3339))
+
+	c.JSON(http.StatusAccepted, deleteAccountResponse{
+		Message:   "the account is deleted and will be erased",
+		ErasureAt: erasureAt,
+	})
+}
+
+// HandleRestoreAccount cancels the deletion of the account with the token from the restore link.
+// The account becomes active again and is no longer erased. The photo deleted along with the account is not restored.
+func HandleRestoreAccount(c *gin.Context) {
+	var req restoreAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	token, err := db.ConsumeToken(database.TokenPurposeAccountRestore, helper.HashToken(req.Token))
+	if err != nil {
+		if err == database.ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: ErrInvalidRestoreToken.Error()})
+			return
+		}
+		log.Println("failed to get token:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if time.Now().After(token.ExpiresAt) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: ErrInvalidRestoreToken.Error()})
+		return
+	}
+
+	// The account may have been erased or restored already.
+	user, err := db.GetUserByID(token.UserID)
+	if err != nil {
+		if err == database.ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: ErrInvalidRestoreToken.Error()})
+			return
+		}
+		log.Printf("failed to get user by ID '%s': %s\n", token.UserID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if user.Status != database.UserStatusDeleted ||
+		database.NormalizeEmail(user.Email) != database.NormalizeEmail(token.Email) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: ErrInvalidRestoreToken.Error()})
+		return
+	}
+
+	_, err = db.UpdateUser(user.ID, database.UserUpdate{ErasureAt: &time.Time{}})
+	if err != nil {
+		log.Printf("failed to cancel erasure of user '%s': %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err = updateUserStatus(c, user.ID, database.UserStatusActive); err != nil {
+		log.Printf("failed to update status of user '%s': %s\n", user.ID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("user '%s' restored their account\n", user.ID)
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// updateUserStatus updates the status of the user and caches it for the authentication checks,
+// so that the sessions of the deleted user are locked out on their next request.
+func updateUserStatus(c *gin.Context, userID, status string) error {
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	if err := db.UpdateUserStatus(userID, status); err != nil {
+		return err
+	}
+	helper.CacheUserStatus(c.MustGet(helper.ContextCache).(*cache.Cache), userID, status)
+	return nil
+}
+
+// sendRestoreLink emails the link with a single-use token that restores the account during the grace period.
+func sendRestoreLink(c *gin.Context, user database.User, cfg AccountDeletionConfig) error {
+	u, err := url.Parse(cfg.RestoreAccountURL)
+	if err != nil {
+		return fmt.Errorf("invalid restore account URL: %w", err)
+	}
+
+	rawToken := helper.GenerateRandomString(32)
+	now := time.Now().UTC()
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	err = db.CreateToken(&database.Token{
+		Hash:      helper.HashToken(rawToken),
+		Purpose:   database.TokenPurposeAccountRestore,
+		UserID:    user.ID,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(cfg.GracePeriod),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create token: %w", err)
+	}
+	query := u.Query()
+	query.Set("token", rawToken)
+	u.RawQuery = query.Encode()
+
+	m := c.MustGet(helper.ContextMailer).(mailer.Mailer)
+	return m.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your account is deleted",
+		Body: fmt.Sprintf(
+			"Your account is deleted and will be erased for good. "+
+				"Follow the link to restore the account:\n\n%s\n\nThe link expires in %s.\n",
+			u.String(), cfg.GracePeriod,
+		),
+	})
+}
+
+// UserObjectKeys returns the keys of the objects of the user in the file store
+// besides the library files.
+func UserObjectKeys(user database.User) []string {
+	var keys []string
+	if len(user.PhotoURL) > 0 {
+		keys = append(keys, user.PhotoURL)
+	}
+	return keys
+}
+
+// DeleteUserObjects deletes the objects of the user from the file store
+// along with the library files.
+// It is run when the user is erased, so that the library is kept until the grace period is over.
+func DeleteUserObjects(db database.Adapter, fs filestore.FileStore, user database.User) error {
+	for _, key := range UserObjectKeys(user) {
+		if err := fs.DeleteObject(key); err != nil {
+			return fmt.Errorf("failed to delete object '%s': %w", key, err)
+		}
+	}
+	files, err := userFiles(db, user.ID)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = deleteFile(db, fs, file); err != nil && err != database.ErrNotFound {
+			return fmt.Errorf("failed to delete file '%s': %w", file.ID, err)
+		}
+	}
+	return nil
+}
+
+// EraseScheduledUsers erases the deleted users whose grace period is over
+// along with their objects in the file store.
+// The users that fail to be erased are logged and retried on the next run.
+func EraseScheduledUsers(db database.Adapter, fs filestore.FileStore) error {
+	users, err := db.GetUsersToErase(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err = DeleteUserObjects(db, fs, user); err != nil {
+			log.Printf("failed to erase user '%s': %s\n", user.ID, err.Error())
+			continue
+		}
+		if err = db.EraseUser(user.ID); err != nil {
+			log.Printf("failed to erase user '%s': %s\n", user.ID, err.Error())
+			continue
+		}
+		log.Printf("user '%s' was erased\n", user.ID)
+	}
+	return nil
+}
+
+// RunErasure erases the users past the grace period every interval.
+// It never returns, so it must be run in a goroutine.
+func RunErasure(db database.Adapter, fs filestore.FileStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := EraseScheduledUsers(db, fs); err != nil {
+			log.Println("failed to erase scheduled users:", err)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package users
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/filestore"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultFilesLimit = 20
+	maxFilesLimit     = 100
+	maxFileNameLength = 255
+)
+
+// FilesConfig configures the file libraries of the users.
+// The quotas apply to the library files only, the profile photos are not counted.
+type FilesConfig struct {
+	// MaxFileSize is the maximum size of an uploaded file or photo in bytes.
+	// Defaults to the maximum upload size of the server.
+	MaxFileSize int64
+	// Quota is the total size of the files each user can store in bytes.
+	// Defaults to 100 MB.
+	Quota int64
+	// AccessLevelQuotas override the quota for the users of the access levels, e.g. db.AccessLevelAdmin.
+	AccessLevelQuotas map[string]int64
+}
+
+// UserQuota returns the storage quota of the user: the quota set for the user by an admin,
+// the quota of the user's access level or the default quota.
+func (cfg FilesConfig) UserQuota(user database.User) int64 {
+	if user.StorageQuota > 0 {
+		return user.StorageQuota
+	}
+	if quota, ok := cfg.AccessLevelQuotas[user.AccessLevel]; ok {
+		return quota
+	}
+	return cfg.Quota
+}
+
+type filesResponse struct {
+	Files      []database.File `json:"files"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+}
+
+type storageUsageResponse struct {
+	Used      int64 `json:"used"`
+	Quota     int64 `json:"quota"`
+	Available int64 `json:"available"`
+}
+
+// HandleUploadFile adds the file from the multipart form to the library of the authenticated user.
+func HandleUploadFile(c *gin.Context) {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "failed to get the form file",
+		})
+		return
+	}
+	filesConfig := c.MustGet(helper.ContextFilesConfig).(FilesConfig)
+	if fileHeader.Size > filesConfig.MaxFileSize {
+		abortFileTooLarge(c, filesConfig.MaxFileSize)
+		return
+	}
+	name := strings.TrimSpace(filepath.Base(fileHeader.Filename))
+	if len(name) == 0 || name == "." || name == string(filepath.Separator) || len(name) > maxFileNameLength {
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: fmt.Sprintf("the file name must be between 1 and %d characters", maxFileNameLength),
+		})
+		return
+	}
+
+	userID := c.MustGet(helper.ContextUserID).(string)
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		log.Printf("failed to get user by ID '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			helper.HTTPMessage{Message: "failed to get user"},
+		)
+		return
+	}
+	if user, err = trackStorageUsed(db, user); err != nil {
+		log.Printf("failed to recompute storage used by user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	// The quota is checked before the file is stored and enforced by the database when it is created.
+	quota := filesConfig.UserQuota(user)
+	if user.StorageUsed+fileHeader.Size > quota {
+		abortQuotaExceeded(c, user.StorageUsed, quota)
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		log.Println("failed to open the form file:", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "failed to open the form file",
+		})
+		return
+	}
+	defer file.Close()
+	buf := bytes.NewBuffer(nil)
+	if _, err = io.Copy(buf, file); err != nil {
+		log.Println("failed to read the form file:", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, helper.HTTPMessage{
+			Message: "failed to read the form file",
+		})
+		return
+	}
+
+	checksum := sha256.Sum256(buf.Bytes())
+	fileID := uuid.NewString()
+	metadata := database.File{
+		ID:          fileID,
+		UserID:      userID,
+		Name:        name,
+		Size:        int64(buf.Len()),
+		ContentType: fileContentType(fileHeader.Header.Get("Content-Type"), buf.Bytes()),
+		Checksum:    hex.EncodeToString(checksum[:]),
+		Key:         fileObjectKey(userID, fileID),
+		CreatedAt:   time.Now().UTC(),
+	}
+	fs := c.MustGet(helper.ContextFileStore).(filestore.FileStore)
+	if err = fs.PutObject(buf.Bytes(), metadata.Key); err != nil {
+		log.Printf("failed to save file '%s': %s\n", metadata.Key, err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, helper.HTTPMessage{
+			Message: "failed to save file",
+		})
+		return
+	}
+	if err = db.CreateFile(&metadata, quota); err != nil {
+		if deleteErr := fs.DeleteObject(metadata.Key); deleteErr != nil {
+			log.Printf("failed to delete file '%s': %s\n", metadata.Key, deleteErr.Error())
+		}
+		// Another upload has taken the remaining storage in the meantime.
+		if err == database.ErrQuotaExceeded {
+			abortQuotaExceeded(c, user.StorageUsed, quota)
+			return
+		}
+		log.Printf("failed to create file of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, helper.HTTPMessage{
+			Message: "failed to save file",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, metadata)
+}
+
+// HandleGetFiles returns a page of the files of the authenticated user.
+// The page size is set by 'limit' query parameter and the next page is requested with 'cursor'.
+func HandleGetFiles(c *gin.Context) {
+	limit := defaultFilesLimit
+	if value := c.Query("limit"); len(value) > 0 {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxFilesLimit {
+			c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+				Message: fmt.Sprintf("the limit must be between 1 and %d", maxFilesLimit),
+			})
+			return
+		}
+	}
+
+	userID := c.MustGet(helper.ContextUserID).(string)
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	files, nextCursor, err := db.GetFiles(userID, limit, c.Query("cursor"))
+	if err != nil {
+		if err == database.ErrInvalidCursor {
+			c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{Message: "invalid cursor"})
+			return
+		}
+		log.Printf("failed to get files of user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, filesResponse{Files: files, NextCursor: nextCursor})
+}
+
+// HandleGetStorageUsage returns the storage used by the files of the authenticated user and the quota.
+func HandleGetStorageUsage(c *gin.Context) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		log.Printf("failed to get user by ID '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			helper.HTTPMessage{Message: "failed to get user"},
+		)
+		return
+	}
+	if user, err = trackStorageUsed(db, user); err != nil {
+		log.Printf("failed to recompute storage used by user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	quota := c.MustGet(helper.ContextFilesConfig).(FilesConfig).UserQuota(user)
+	c.JSON(http.StatusOK, storageUsageResponse{
+		Used:      user.StorageUsed,
+		Quota:     quota,
+		Available: max(quota-user.StorageUsed, 0),
+	})
+}
+
+// HandleGetFile returns the metadata of the file from the path.
+func HandleGetFile(c *gin.Context) {
+	file, ok := targetFileOrAbort(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, file)
+}
+
+// HandleDownloadFile responds with the content of the file from the path as an attachment.
+func HandleDownloadFile(c *gin.Context) {
+	file, ok := targetFileOrAbort(c)
+	if !ok {
+		return
+	}
+
+	fs := c.MustGet(helper.ContextFileStore).(filestore.FileStore)
+	object, err := fs.GetObject(file.Key)
+	if err != nil {
+		log.Printf("failed to get file '%s': %s\n", file.Key, err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, helper.HTTPMessage{
+			Message: "failed to get file",
+		})
+		return
+	}
+
+	// The content is never rendered by the browsers, so that the uploaded files cannot run scripts.
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, file.ContentType, object)
+}
+
+// HandleDeleteFile deletes the file from the path.
+func HandleDeleteFile(c *gin.Context) {
+	file, ok := targetFileOrAbort(c)
+	if !ok {
+		return
+	}
+
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	fs := c.MustGet(helper.ContextFileStore).(filestore.FileStore)
+	if err := deleteFile(db, fs, file); err != nil {
+		if err == database.ErrNotFound {
+			abortFileNotFound(c)
+			return
+		}
+		log.Printf("failed to delete file '%s': %s\n", file.ID, err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, helper.HTTPMessage{
+			Message: "failed to delete file",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
+}
+
+// targetFileOrAbort finds the file from 'fileid' path parameter of the authenticated user.
+func targetFileOrAbort(c *gin.Context) (database.File, bool) {
+	userID := c.MustGet(helper.ContextUserID).(string)
+	fileID := c.Param("fileid")
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	file, err := db.GetFile(userID, fileID)
+	if err != nil {
+		if err == database.ErrNotFound {
+			abortFileNotFound(c)
+			return database.File{}, false
+		}
+		log.Printf("failed to get file '%s' of user '%s': %s\n", fileID, userID, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return database.File{}, false
+	}
+	return file, true
+}
+
+// abortQuotaExceeded responds with '507 Insufficient Storage'.
+func abortQuotaExceeded(c *gin.Context, used, quota int64) {
+	c.AbortWithStatusJSON(http.StatusInsufficientStorage, helper.HTTPMessage{
+		Message: fmt.Sprintf("storage quota exceeded: %d of %d bytes are used", used, quota),
+	})
+}
+
+// abortFileTooLarge responds with '413 Request Entity Too Large'.
+func abortFileTooLarge(c *gin.Context, maxSize int64) {
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, helper.HTTPMessage{
+		Message: fmt.Sprintf("the file exceeds the limit of %d bytes", maxSize),
+	})
+}
+
+func abortFileNotFound(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusNotFound, helper.HTTPMessage{Message: "file not found"})
+}
+
+// deleteFile deletes the metadata of the file and then its object from the file store.
+func deleteFile(db database.Adapter, fs filestore.FileStore, file database.File) error {
+	if err := db.DeleteFile(file.UserID, file.ID); err != nil {
+		return err
+	}
+	if err := fs.DeleteObject(file.Key); err != nil {
+		return fmt.Errorf("failed to delete object '%s': %w", file.Key, err)
+	}
+	return nil
+}
+
+// trackStorageUsed recomputes the storage used by the user from the files
+// unless it already accounts for the files stored before the storage used was tracked.
+func trackStorageUsed(db database.Adapter, user database.User) (database.User, error) {
+	if user.StorageTracked {
+		return user, nil
+	}
+	return db.RecomputeStorageUsed(user.ID)
+}
+
+// userFiles returns all files of the user.
+func userFiles(db database.Adapter, userID string) ([]database.File, error) {
+	var files []database.File
+	cursor := ""
+	for {
+		page, nextCursor, err := db.GetFiles(userID, maxFilesLimit, cursor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get files: %w", err)
+		}
+		files = append(files, page...)
+		if len(nextCursor) == 0 {
+			return files, nil
+		}
+		cursor = nextCursor
+	}
+}
+
+// fileObjectKey returns the key of the file in the file store.
+func fileObjectKey(userID, fileID string) string {
+	return fmt.Sprintf("%s-file-%s", userID, fileID)
+}
+
+// fileContentType returns the content type declared by the client
+// or detects it by the content if it is missing or malformed.
+func fileContentType(declared string, content []byte) string {
+	if mediaType, params, err := mime.ParseMediaType(declared); err == nil {
+		if contentType := mime.FormatMediaType(mediaType, params); len(contentType) > 0 {
+			return contentType
+		}
+	}
+	return http.DetectContentType(content)
+}
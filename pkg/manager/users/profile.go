@@ -0,0 +1,167 @@
+package users
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	database "github.com/bazuker/backend-bootstrap/pkg/db"
+	"github.com/bazuker/backend-bootstrap/pkg/manager/helper"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	// dobLayout is the format of the date of birth in the requests.
+	dobLayout = "2006-01-02"
+	// maxAgeYears is the oldest age the date of birth is accepted for.
+	// It must match the message of the validation rule.
+	maxAgeYears = 130
+)
+
+var (
+	// e164Pattern matches the phone numbers in E.164 format, e.g. +14155552671.
+	e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+	// phoneSeparators are removed from the phone numbers before they are validated.
+	phoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+)
+
+// updateProfileRequest is a partial update of the profile.
+// The fields that are omitted are not changed and the empty strings remove the phone and the date of birth.
+type updateProfileRequest struct {
+	FirstName *string `json:"firstName" binding:"omitempty,max=100"`
+	LastName  *string `json:"lastName" binding:"omitempty,max=100"`
+	Phone     *string `json:"phone" binding:"omitempty,max=32,phone"`
+	DOB       *string `json:"dob" binding:"omitempty,dob"`
+	Locale    *string `json:"locale" binding:"omitempty,max=35,bcp47_language_tag"`
+}
+
+// RegisterValidations registers the validation rules of the profile in the binding validator.
+func RegisterValidations() error {
+	err := helper.RegisterValidation(
+		"phone",
+		"must be a phone number in international format, e.g. '+14155552671'",
+		func(fl validator.FieldLevel) bool {
+			_, ok := NormalizePhone(fl.Field().String())
+			return ok
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return helper.RegisterValidation(
+		"dob",
+		"must be a date in 'YYYY-MM-DD' format within the last 130 years",
+		func(fl validator.FieldLevel) bool {
+			if len(fl.Field().String()) == 0 {
+				return true
+			}
+			dob, err := time.Parse(dobLayout, fl.Field().String())
+			return err == nil && validDOB(dob, time.Now())
+		},
+	)
+}
+
+// HandleUpdateUsersMe updates the profile of the authenticated user and returns the user.
+// The edited names and locale are no longer synced from the identity providers.
+func HandleUpdateUsersMe(c *gin.Context) {
+	var req updateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if response, ok := helper.NewHTTPValidationErrors(err); ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, response)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, helper.HTTPMessage{
+			Message: "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	userID := c.MustGet(helper.ContextUserID).(string)
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		log.Printf("failed to get user by ID '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			helper.HTTPMessage{Message: "failed to get user"},
+		)
+		return
+	}
+
+	update := database.UserUpdate{
+		FirstName: trimmed(req.FirstName),
+		LastName:  trimmed(req.LastName),
+		Locale:    req.Locale,
+	}
+	if req.Phone != nil {
+		phone, _ := NormalizePhone(*req.Phone)
+		update.Phone = &phone
+	}
+	if req.DOB != nil {
+		// The zero time removes the date of birth.
+		var dob time.Time
+		if len(*req.DOB) > 0 {
+			dob, _ = time.Parse(dobLayout, *req.DOB)
+		}
+		update.DOB = &dob
+	}
+	var edited []string
+	if update.FirstName != nil {
+		edited = append(edited, database.UserFieldFirstName)
+	}
+	if update.LastName != nil {
+		edited = append(edited, database.UserFieldLastName)
+	}
+	if update.Locale != nil {
+		edited = append(edited, database.UserFieldLocale)
+	}
+	if len(edited) > 0 {
+		editedFields := user.WithEditedFields(edited...)
+		update.EditedFields = &editedFields
+	}
+
+	user, err = db.UpdateUser(userID, update)
+	if err != nil {
+		log.Printf("failed to update user '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			helper.HTTPMessage{Message: "failed to update user"},
+		)
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// NormalizePhone removes the separators from the phone number, replaces the international
+// call prefix '00' with '+' and returns the number in E.164 format.
+// An empty phone number is valid and stays empty.
+func NormalizePhone(phone string) (string, bool) {
+	phone = phoneSeparators.Replace(strings.TrimSpace(phone))
+	if len(phone) == 0 {
+		return "", true
+	}
+	if strings.HasPrefix(phone, "00") {
+		phone = "+" + phone[2:]
+	}
+	if !e164Pattern.MatchString(phone) {
+		return "", false
+	}
+	return phone, true
+}
+
+// validDOB returns true if the date of birth is not in the future and not too long ago.
+func validDOB(dob, now time.Time) bool {
+	return !dob.After(now) && dob.After(now.AddDate(-maxAgeYears, 0, 0))
+}
+
+func trimmed(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	t := strings.TrimSpace(*s)
+	return &t
+}
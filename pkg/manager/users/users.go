@@ -51,6 +51,10 @@ func HandleUsersMePhoto(c *gin.Context) {
 		)
 		return
 	}
+	if maxSize := c.MustGet(helper.ContextFilesConfig).(FilesConfig).MaxFileSize; fileHeader.Size > maxSize {
+		abortFileTooLarge(c, maxSize)
+		return
+	}
 
 	// Check if the file extension is appropriate.
 	ext := strings.ToLower(filepath.Ext(fileHeader.Filename))
@@ -93,33 +97,28 @@ func HandleUsersMePhoto(c *gin.Context) {
 		return
 	}
 
-	// Save (or upload) to the file store.
+	// Find the authenticated user.
 	userIDContext := c.MustGet(helper.ContextUserID)
 	userID := userIDContext.(string)
-	fileStoreContext := c.MustGet(helper.ContextFileStore)
-	fs := fileStoreContext.(filestore.FileStore)
-	objectKey := fmt.Sprintf("%s-photo%s", userID, ext)
-	err = fs.PutObject(buf.Bytes(), objectKey)
+	dbContext := c.MustGet(helper.ContextDatabase)
+	db := dbContext.(database.Adapter)
+	user, err := db.GetUserByID(userID)
 	if err != nil {
-		log.Println("failed to save the file to the filestore:", err)
-		c.JSON(
+		log.Printf("failed to get user by ID '%s': %s\n", userID, err.Error())
+		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
-			helper.HTTPMessage{
-				Message: "failed to save the file to the filestore",
-			},
+			helper.HTTPMessage{Message: "failed to get user"},
 		)
 		return
 	}
 
-	// Update user's photo in the database.
-	dbContext := c.MustGet(helper.ContextDatabase)
-	db := dbContext.(database.Adapter)
-	err = db.UpdateUserPhotoURL(userID, objectKey)
-	if err != nil {
-		log.Printf("failed to update user '%s' photo URL: %s\n", userID, err.Error())
+	// Save (or upload) to the file store and update user's photo in the database.
+	// The uploaded photo is no longer synced from the identity providers.
+	if _, err = SavePhoto(c, user, buf.Bytes(), ext, ""); err != nil {
+		log.Printf("failed to save photo of user '%s': %s\n", userID, err.Error())
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
-			helper.HTTPMessage{Message: "failed to update user photo URL"},
+			helper.HTTPMessage{Message: "failed to save photo"},
 		)
 		return
 	}
@@ -148,26 +147,36 @@ func HandleUsersMeDeletePhoto(c *gin.Context) {
 	}
 
 	// No photo - nothing to delete.
-	if len(user.PhotoURL) == 0 {
+	// The deletion is still recorded, so that no photo is synced from the identity providers.
+	if len(user.PhotoURL) == 0 && user.IsEdited(database.UserFieldPhoto) {
 		c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
 		return
 	}
 
 	// Delete the photo from the file store.
-	fileStoreContext := c.MustGet(helper.ContextFileStore)
-	fs := fileStoreContext.(filestore.FileStore)
-	err = fs.DeleteObject(user.PhotoURL)
-	if err != nil {
-		log.Printf("failed to delete user photo '%s': %s\n", user.PhotoURL, err.Error())
-		c.AbortWithStatusJSON(
-			http.StatusInternalServerError,
-			helper.HTTPMessage{Message: "failed to delete photo"},
-		)
-		return
+	if len(user.PhotoURL) > 0 {
+		fileStoreContext := c.MustGet(helper.ContextFileStore)
+		fs := fileStoreContext.(filestore.FileStore)
+		err = fs.DeleteObject(user.PhotoURL)
+		if err != nil {
+			log.Printf("failed to delete user photo '%s': %s\n", user.PhotoURL, err.Error())
+			c.AbortWithStatusJSON(
+				http.StatusInternalServerError,
+				helper.HTTPMessage{Message: "failed to delete photo"},
+			)
+			return
+		}
 	}
 
 	// Delete the photo URL from the database.
-	err = db.UpdateUserPhotoURL(userID, "")
+	// The deleted photo is no longer synced from the identity providers either.
+	noPhoto := ""
+	editedFields := user.WithEditedFields(database.UserFieldPhoto)
+	_, err = db.UpdateUser(userID, database.UserUpdate{
+		PhotoURL:       &noPhoto,
+		PhotoSourceURL: &noPhoto,
+		EditedFields:   &editedFields,
+	})
 	if err != nil {
 		log.Printf("failed to update user '%s' photo URL: %s\n", userID, err.Error())
 		c.AbortWithStatusJSON(
@@ -180,22 +189,11 @@ func HandleUsersMeDeletePhoto(c *gin.Context) {
 	c.JSON(http.StatusOK, helper.HTTPMessage{Message: "ok"})
 }
 
-// HandleGetUsers returns information about any user if access level is sufficient.
+// HandleGetUsers returns information about any user.
+// The permissions must be checked by the middleware before the handler.
 func HandleGetUsers(c *gin.Context) {
-	userIDContext := c.MustGet(helper.ContextUserID)
 	requestedUserID := c.Param("userid")
 
-	// Check user's access level. Only admins can retrieve information about other users
-	userAccessLevelContext := c.MustGet(helper.ContextUserAccessLevel)
-	if userAccessLevelContext != database.AccessLevelAdmin &&
-		userIDContext.(string) != requestedUserID {
-		c.AbortWithStatusJSON(
-			http.StatusForbidden,
-			helper.HTTPMessage{Message: "insufficient rights"},
-		)
-		return
-	}
-
 	// Get the database from the context.
 	dbContext := c.MustGet(helper.ContextDatabase)
 	db := dbContext.(database.Adapter)
@@ -213,3 +211,49 @@ func HandleGetUsers(c *gin.Context) {
 
 	c.JSON(http.StatusOK, user)
 }
+
+// PhotoExtension returns the file extension of the photo by its content
+// or an empty string if the format is not supported.
+func PhotoExtension(photo []byte) string {
+	switch http.DetectContentType(photo) {
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	}
+	return ""
+}
+
+// SavePhoto saves the photo to the file store and updates the photo of the user.
+// The source URL is the provider's picture the photo was downloaded from,
+// otherwise the photo is uploaded by the user and it is marked as edited.
+// The previous photo is deleted if it was stored under another key.
+// The photo is not counted in the storage quota, as every user has a single photo limited in size.
+func SavePhoto(c *gin.Context, user database.User, photo []byte, ext, sourceURL string) (database.User, error) {
+	fs := c.MustGet(helper.ContextFileStore).(filestore.FileStore)
+	objectKey := fmt.Sprintf("%s-photo%s", user.ID, ext)
+	if err := fs.PutObject(photo, objectKey); err != nil {
+		return database.User{}, fmt.Errorf("failed to save the file to the filestore: %w", err)
+	}
+
+	update := database.UserUpdate{
+		PhotoURL:       &objectKey,
+		PhotoSourceURL: &sourceURL,
+	}
+	if len(sourceURL) == 0 {
+		editedFields := user.WithEditedFields(database.UserFieldPhoto)
+		update.EditedFields = &editedFields
+	}
+	db := c.MustGet(helper.ContextDatabase).(database.Adapter)
+	updatedUser, err := db.UpdateUser(user.ID, update)
+	if err != nil {
+		return database.User{}, fmt.Errorf("failed to update photo URL: %w", err)
+	}
+
+	if len(user.PhotoURL) > 0 && user.PhotoURL != objectKey {
+		if err = fs.DeleteObject(user.PhotoURL); err != nil {
+			log.Printf("failed to delete previous photo '%s': %s\n", user.PhotoURL, err.Error())
+		}
+	}
+	return updatedUser, nil
+}